@@ -0,0 +1,696 @@
+// Package btreestore is a copy-on-write B+tree store in a single paged file.
+// A write never changes a page that the last commit can reach: it writes
+// new copies of the pages from the leaf up to the root, and then points a
+// new meta at them. Pages that drop out of the tree go on a free list, and
+// are reused once no commit that a crash could fall back to can reach them.
+package btreestore
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ankeesler/andb/failpoint"
+	"github.com/ankeesler/andb/filestore/manifest"
+	"github.com/ankeesler/andb/fileutil"
+	api "github.com/ankeesler/andb/server"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Filename is the paged file in the store dir.
+const Filename = "andbbtree.db"
+
+const (
+	// DefaultPageSize is the page size of a new file, unless Options says
+	// otherwise.
+	DefaultPageSize = 4096
+
+	// MinPageSize leaves room for both meta slots in page 0.
+	MinPageSize = 2 * metaSlotSize
+)
+
+// Options tune the store. Zero values use the defaults.
+type Options struct {
+	// PageSize is the page size of a new file. An existing file keeps the
+	// one that it was created with.
+	PageSize int
+}
+
+func (o *Options) setDefaults() {
+	if o.PageSize <= 0 {
+		o.PageSize = DefaultPageSize
+	}
+}
+
+type Store struct {
+	file     *os.File
+	pageSize int
+
+	// writeMutex is held by writers, since only one commit can be built at
+	// a time.
+	writeMutex *sync.Mutex
+
+	// mutex guards the last commit's meta and free list, and the last
+	// commit that is known to be durable. Readers hold it for reading while
+	// they walk the tree, so a commit can not make the pages that they are
+	// reading free until they are done.
+	mutex         *sync.RWMutex
+	meta          meta
+	free          []uint64
+	pending       []pendingPage
+	freelistPages int
+	durableTxID   uint64
+
+	degraded    error
+	statusMutex *sync.Mutex
+}
+
+// Open opens the store in the provided dir, creating it if it does not
+// exist yet.
+func Open(dir string, options Options) (*Store, error) {
+	options.setDefaults()
+	if options.PageSize < MinPageSize {
+		return nil, errors.Errorf("page size %d is smaller than %d", options.PageSize, MinPageSize)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, manifest.Filename)); err == nil {
+		return nil, errors.Errorf("store dir %s holds a file engine store", dir)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, Filename), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file")
+	}
+
+	s := &Store{
+		file:        file,
+		writeMutex:  &sync.Mutex{},
+		mutex:       &sync.RWMutex{},
+		statusMutex: &sync.Mutex{},
+	}
+	if err := s.load(dir, options); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Store) load(dir string, options Options) error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+
+	if info.Size() == 0 {
+		log.Infof("creating %s with %d byte pages", s.file.Name(), options.PageSize)
+		s.pageSize = options.PageSize
+		s.meta = meta{
+			Magic:     metaMagic,
+			Version:   metaVersion,
+			PageSize:  uint32(options.PageSize),
+			PageCount: 1,
+		}
+
+		page := make([]byte, options.PageSize)
+		copy(page, encodeMeta(s.meta))
+		copy(page[metaSlotSize:], encodeMeta(s.meta))
+		if _, err := s.file.WriteAt(page, 0); err != nil {
+			return errors.Wrap(err, "write meta page")
+		}
+		if err := s.file.Sync(); err != nil {
+			return errors.Wrap(err, "sync")
+		}
+		return errors.Wrap(fileutil.SyncDir(dir), "sync dir")
+	}
+
+	data := make([]byte, 2*metaSlotSize)
+	if _, err := s.file.ReadAt(data, 0); err != nil {
+		return errors.Wrap(err, "read meta page")
+	}
+	metas, errs := [2]meta{}, [2]error{}
+	for i := range metas {
+		metas[i], errs[i] = decodeMeta(data[i*metaSlotSize:])
+	}
+	switch {
+	case errs[0] != nil && errs[1] != nil:
+		return errors.Errorf("no valid meta page (slot 0: %s, slot 1: %s)", errs[0].Error(), errs[1].Error())
+	case errs[0] != nil:
+		log.Warnf("ignoring meta slot 0: %s", errs[0].Error())
+		s.meta = metas[1]
+	case errs[1] != nil:
+		log.Warnf("ignoring meta slot 1: %s", errs[1].Error())
+		s.meta = metas[0]
+	case metas[0].TxID >= metas[1].TxID:
+		s.meta = metas[0]
+	default:
+		s.meta = metas[1]
+	}
+	s.pageSize = int(s.meta.PageSize)
+	log.Debugf("opened %s at commit %d (%d byte pages)", s.file.Name(), s.meta.TxID, s.pageSize)
+
+	// Whatever the last run handed to the OS is made durable, so that no
+	// commit before this one can come back after a crash.
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync")
+	}
+	s.durableTxID = s.meta.TxID
+
+	// Losing the free list only leaks the pages on it, so the store can
+	// still be opened without it.
+	if s.meta.Freelist != 0 {
+		if err := s.loadFreelist(); err != nil {
+			log.Warnf("ignoring free list: %s", err.Error())
+			s.free, s.pending, s.freelistPages = nil, nil, 0
+		}
+	}
+
+	return nil
+}
+
+func (s *Store) loadFreelist() error {
+	header, data, err := s.readPage(s.meta.Freelist, s.meta.PageCount)
+	if err != nil {
+		return errors.Wrap(err, "read free list")
+	}
+	if header.Type != pageTypeFreelist {
+		return errors.Errorf("incorrect free list page type %d", header.Type)
+	}
+	if s.free, s.pending, err = decodeFreelist(data, s.meta); err != nil {
+		return errors.Wrap(err, "decode free list")
+	}
+	s.freelistPages = int(header.Overflow) + 1
+
+	return nil
+}
+
+// Close closes the file. Every commit is already in it.
+func (s *Store) Close() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	return s.file.Close()
+}
+
+func (s *Store) Get(key string) (string, error) {
+	log.Debugf("begin get %s", key)
+	defer log.Debugf("end get %s", key)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	page := s.meta.Root
+	for page != 0 {
+		n, err := s.readNode(page, s.meta.PageCount)
+		if err != nil {
+			return "", err
+		}
+
+		if n.leaf {
+			if i, found := n.search(key); found {
+				return n.values[i], nil
+			}
+			break
+		}
+		page = n.children[n.childIndex(key)]
+	}
+
+	return "", errors.New("not found")
+}
+
+func (s *Store) Set(key, value string, durability api.Durability) error {
+	log.Debugf("begin set %s => %s (%s)", key, value, durability)
+	defer log.Debugf("end set %s => %s (%s)", key, value, durability)
+
+	return s.write(key, &value, durability)
+}
+
+func (s *Store) Delete(key string, durability api.Durability) error {
+	log.Debugf("begin delete %s (%s)", key, durability)
+	defer log.Debugf("end delete %s (%s)", key, durability)
+
+	return s.write(key, nil, durability)
+}
+
+// write sets the key to the value, or deletes it if the value is nil, in a
+// commit of its own. Every commit is handed to the OS before it is
+// acknowledged, whatever durability was asked for.
+func (s *Store) write(key string, value *string, durability api.Durability) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.Status(); err != nil {
+		return errors.Wrap(err, "store is degraded")
+	}
+
+	// Rather than grow the file while more pages wait for the last commit to
+	// be durable than are free, make it durable.
+	waiting := 0
+	for _, p := range s.pending {
+		if p.FreedBy >= s.durableTxID && p.FreedBy < s.meta.TxID {
+			waiting++
+		}
+	}
+	if waiting > len(s.free) {
+		if err := s.sync(); err != nil {
+			return s.degrade(errors.Wrap(err, "sync to free pages"))
+		}
+	}
+
+	s.mutex.RLock()
+	tx := &txn{
+		s:       s,
+		meta:    s.meta,
+		free:    append([]uint64{}, s.free...),
+		durable: s.durableTxID,
+	}
+	s.mutex.RUnlock()
+
+	changed, err := tx.put(key, value)
+	if err != nil {
+		return errors.Wrap(err, "update tree")
+	}
+	if !changed {
+		// There is nothing to commit, but the tree already holding the write
+		// only counts once it is as durable as was asked for. Every commit
+		// is handed to the OS before it is acknowledged, so only an fsynced
+		// write can still need something done.
+		if durability == api.Durability_FSYNCED && tx.durable < tx.meta.TxID {
+			if err := s.sync(); err != nil {
+				return s.degrade(errors.Wrap(err, "sync"))
+			}
+		}
+		return nil
+	}
+
+	if err := tx.commit(durability); err != nil {
+		return s.degrade(errors.Wrap(err, "commit"))
+	}
+
+	return nil
+}
+
+// Sync makes every commit before it durable.
+func (s *Store) Sync() error {
+	if err := s.Status(); err != nil {
+		return errors.Wrap(err, "store is degraded")
+	}
+
+	return s.sync()
+}
+
+// sync syncs the file, and with it every commit that was written before it
+// started.
+func (s *Store) sync() error {
+	s.mutex.RLock()
+	txID := s.meta.TxID
+	s.mutex.RUnlock()
+
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync file")
+	}
+
+	s.mutex.Lock()
+	if txID > s.durableTxID {
+		s.durableTxID = txID
+	}
+	s.mutex.Unlock()
+
+	return nil
+}
+
+// Status returns the error that degraded the store, if there is one.
+func (s *Store) Status() error {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	return s.degraded
+}
+
+// degrade stops the store from taking any more writes, and returns the
+// error that made it do so.
+func (s *Store) degrade(err error) error {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	log.Errorf("degrading store: %s", err.Error())
+	if s.degraded == nil {
+		s.degraded = err
+	}
+
+	return err
+}
+
+// ForEach calls the provided handler with every key from the provided one
+// onward, in order, along with its value.
+func (s *Store) ForEach(from string, handler func(key, value string) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.meta.Root == 0 {
+		return nil
+	}
+	return s.forEach(s.meta.Root, from, handler)
+}
+
+func (s *Store) forEach(page uint64, from string, handler func(key, value string) error) error {
+	n, err := s.readNode(page, s.meta.PageCount)
+	if err != nil {
+		return err
+	}
+
+	if n.leaf {
+		i, _ := n.search(from)
+		for ; i < len(n.keys); i++ {
+			if err := handler(n.keys[i], n.values[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i := n.childIndex(from); i < len(n.children); i++ {
+		if err := s.forEach(n.children[i], from, handler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPage reads the node that starts at the provided page, and returns its
+// header and entries.
+func (s *Store) readPage(page, pageCount uint64) (*pageHeader, []byte, error) {
+	if page == 0 || page >= pageCount {
+		return nil, nil, errors.Errorf("incorrect page %d (%d pages)", page, pageCount)
+	}
+
+	data := make([]byte, s.pageSize)
+	if _, err := s.file.ReadAt(data, int64(page)*int64(s.pageSize)); err != nil {
+		return nil, nil, errors.Wrapf(err, "read page %d", page)
+	}
+
+	header := &pageHeader{
+		CRC32:    byteOrder.Uint32(data[0:]),
+		Type:     data[4],
+		Overflow: byteOrder.Uint32(data[5:]),
+		Count:    byteOrder.Uint32(data[9:]),
+		Length:   byteOrder.Uint32(data[13:]),
+	}
+	if header.Type < pageTypeLeaf || header.Type > pageTypeFreelist {
+		return nil, nil, errors.Errorf("incorrect page type %d (page %d)", header.Type, page)
+	}
+	if page+uint64(header.Overflow) >= pageCount {
+		return nil, nil, errors.Errorf("incorrect overflow %d (page %d)", header.Overflow, page)
+	}
+	pages := int(header.Overflow) + 1
+	if int64(header.Length) > int64(pages*s.pageSize-pageHeaderSize) {
+		return nil, nil, errors.Errorf("incorrect length %d (page %d)", header.Length, page)
+	}
+
+	if pages > 1 {
+		data = append(data, make([]byte, (pages-1)*s.pageSize)...)
+		if _, err := s.file.ReadAt(data[s.pageSize:], int64(page+1)*int64(s.pageSize)); err != nil {
+			return nil, nil, errors.Wrapf(err, "read page %d overflow", page)
+		}
+	}
+
+	end := pageHeaderSize + int(header.Length)
+	if crc := pageCRC32(page, data[4:end]); crc != header.CRC32 {
+		return nil, nil, errors.Errorf("incorrect crc32 (0x%08X != 0x%08X) (page %d)", header.CRC32, crc, page)
+	}
+
+	return header, data[pageHeaderSize:end], nil
+}
+
+func (s *Store) readNode(page, pageCount uint64) (*node, error) {
+	header, data, err := s.readPage(page, pageCount)
+	if err != nil {
+		return nil, err
+	}
+	if header.Type != pageTypeLeaf && header.Type != pageTypeBranch {
+		return nil, errors.Errorf("incorrect node page type %d (page %d)", header.Type, page)
+	}
+
+	n, err := decodeNode(header.Type, header.Count, data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decode page %d", page)
+	}
+	if !n.leaf && len(n.children) == 0 {
+		return nil, errors.Errorf("incorrect empty branch (page %d)", page)
+	}
+	n.pages = int(header.Overflow) + 1
+
+	return n, nil
+}
+
+// txn builds one commit.
+type txn struct {
+	s    *Store
+	meta meta
+
+	// free is what is left of the last commit's free list, and freed is
+	// every page that this commit drops out of the tree. durable is the
+	// last commit that was known to be durable when this one started.
+	free    []uint64
+	freed   []uint64
+	durable uint64
+}
+
+// ref points at a node that a txn wrote, by its smallest key.
+type ref struct {
+	key  string
+	page uint64
+}
+
+// put sets the key to the value, or deletes it if the value is nil, and
+// returns whether the tree changed.
+func (tx *txn) put(key string, value *string) (bool, error) {
+	refs := []ref{}
+	if tx.meta.Root == 0 {
+		if value == nil {
+			return false, nil
+		}
+
+		var err error
+		if refs, err = tx.writeNodes([]*node{{leaf: true, keys: []string{key}, values: []string{*value}}}); err != nil {
+			return false, err
+		}
+	} else {
+		var changed bool
+		var err error
+		if refs, changed, err = tx.update(tx.meta.Root, key, value); err != nil || !changed {
+			return false, err
+		}
+	}
+
+	// Grow the tree upward until one node holds everything.
+	for len(refs) > 1 {
+		root := &node{}
+		for _, r := range refs {
+			root.keys = append(root.keys, r.key)
+			root.children = append(root.children, r.page)
+		}
+
+		var err error
+		if refs, err = tx.writeNodes(root.split(tx.s.pageSize)); err != nil {
+			return false, err
+		}
+	}
+
+	if len(refs) == 0 {
+		tx.meta.Root = 0
+		return true, nil
+	}
+	tx.meta.Root = refs[0].page
+
+	// Shrink the tree while the root only has one child.
+	for {
+		n, err := tx.s.readNode(tx.meta.Root, tx.meta.PageCount)
+		if err != nil {
+			return false, err
+		}
+		if n.leaf || len(n.children) > 1 {
+			break
+		}
+		tx.freePages(tx.meta.Root, n.pages)
+		tx.meta.Root = n.children[0]
+	}
+
+	return true, nil
+}
+
+// update applies the write to the subtree at the provided page, and returns
+// the nodes that replace it, if the write changed anything.
+func (tx *txn) update(page uint64, key string, value *string) ([]ref, bool, error) {
+	n, err := tx.s.readNode(page, tx.meta.PageCount)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if n.leaf {
+		i, found := n.search(key)
+		switch {
+		case value != nil && found:
+			if n.values[i] == *value {
+				return nil, false, nil
+			}
+			n.values[i] = *value
+		case value != nil:
+			n.keys = append(n.keys[:i], append([]string{key}, n.keys[i:]...)...)
+			n.values = append(n.values[:i], append([]string{*value}, n.values[i:]...)...)
+		case found:
+			n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			n.values = append(n.values[:i], n.values[i+1:]...)
+		default:
+			return nil, false, nil
+		}
+	} else {
+		i := n.childIndex(key)
+		refs, changed, err := tx.update(n.children[i], key, value)
+		if err != nil || !changed {
+			return nil, false, err
+		}
+
+		keys, children := []string{}, []uint64{}
+		for _, r := range refs {
+			keys = append(keys, r.key)
+			children = append(children, r.page)
+		}
+		n.keys = append(n.keys[:i], append(keys, n.keys[i+1:]...)...)
+		n.children = append(n.children[:i], append(children, n.children[i+1:]...)...)
+	}
+
+	tx.freePages(page, n.pages)
+	if len(n.keys) == 0 {
+		return []ref{}, true, nil
+	}
+
+	refs, err := tx.writeNodes(n.split(tx.s.pageSize))
+	return refs, true, err
+}
+
+// writeNodes writes each node to newly allocated pages.
+func (tx *txn) writeNodes(nodes []*node) ([]ref, error) {
+	refs := []ref{}
+	for _, n := range nodes {
+		typ, count, data := n.encode()
+		pages := pagesFor(len(data), tx.s.pageSize)
+		page := tx.allocate(pages)
+		if err := tx.writePage(page, pages, typ, count, data); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref{key: n.keys[0], page: page})
+	}
+	return refs, nil
+}
+
+func (tx *txn) writePage(page uint64, pages int, typ uint8, count uint32, data []byte) error {
+	_, err := tx.s.file.WriteAt(
+		encodePage(page, pages, typ, count, data, tx.s.pageSize),
+		int64(page)*int64(tx.s.pageSize),
+	)
+	return errors.Wrapf(err, "write page %d", page)
+}
+
+// allocate returns the first run of free pages that is long enough, or
+// grows the file if there is none.
+func (tx *txn) allocate(pages int) uint64 {
+	var page uint64
+	if tx.free, page = takeRun(tx.free, pages); page != 0 {
+		return page
+	}
+
+	page = tx.meta.PageCount
+	tx.meta.PageCount += uint64(pages)
+	return page
+}
+
+// takeRun removes the first run of the provided number of pages from the
+// sorted free pages, and returns where it starts, or 0 if there is none.
+func takeRun(free []uint64, pages int) ([]uint64, uint64) {
+	for i := 0; i+pages <= len(free); i++ {
+		if free[i+pages-1] == free[i]+uint64(pages-1) {
+			page := free[i]
+			return append(free[:i:i], free[i+pages:]...), page
+		}
+	}
+	return free, 0
+}
+
+func (tx *txn) freePages(page uint64, pages int) {
+	for i := 0; i < pages; i++ {
+		tx.freed = append(tx.freed, page+uint64(i))
+	}
+}
+
+// commit writes out the free list and then the meta. A page that commit T
+// freed can still be reached from commit T-1 and before, so it stays pending
+// until commit T+1 is durable: after that, a crash that tears the metas
+// written since can only fall back as far as commit T. Until then, pages
+// freed by this commit and by the ones before it are pending.
+func (tx *txn) commit(durability api.Durability) error {
+	s := tx.s
+	if tx.meta.Freelist != 0 {
+		tx.freePages(tx.meta.Freelist, s.freelistPages)
+	}
+
+	txID := tx.meta.TxID + 1
+	free, pending := tx.free, []pendingPage{}
+	for _, p := range s.pending {
+		if p.FreedBy < tx.durable {
+			free = append(free, p.Page)
+		} else {
+			pending = append(pending, p)
+		}
+	}
+	for _, page := range tx.freed {
+		pending = append(pending, pendingPage{Page: page, FreedBy: txID})
+	}
+	sort.Slice(free, func(i, j int) bool { return free[i] < free[j] })
+	freelistPages := 0
+	tx.meta.Freelist = 0
+	if len(free)+len(pending) > 0 {
+		// Taking the free list's own pages from the free list only makes it
+		// smaller, so the pages it needs now are enough.
+		freelistPages = pagesFor(len(encodeFreelist(free, pending)), s.pageSize)
+		if free, tx.meta.Freelist = takeRun(free, freelistPages); tx.meta.Freelist == 0 {
+			tx.meta.Freelist = tx.meta.PageCount
+			tx.meta.PageCount += uint64(freelistPages)
+		}
+
+		data := encodeFreelist(free, pending)
+		if err := tx.writePage(tx.meta.Freelist, freelistPages, pageTypeFreelist, 0, data); err != nil {
+			return errors.Wrap(err, "write free list")
+		}
+	}
+
+	if durability == api.Durability_FSYNCED {
+		if err := s.file.Sync(); err != nil {
+			return errors.Wrap(err, "sync pages")
+		}
+	}
+
+	failpoint.Crash("btree-before-meta")
+
+	tx.meta.TxID, tx.meta.Version = txID, metaVersion
+	slot := int64(tx.meta.TxID%2) * metaSlotSize
+	if _, err := s.file.WriteAt(encodeMeta(tx.meta), slot); err != nil {
+		return errors.Wrap(err, "write meta")
+	}
+	if durability == api.Durability_FSYNCED {
+		if err := s.file.Sync(); err != nil {
+			return errors.Wrap(err, "sync meta")
+		}
+	}
+
+	s.mutex.Lock()
+	s.meta, s.free, s.pending, s.freelistPages = tx.meta, free, pending, freelistPages
+	if durability == api.Durability_FSYNCED {
+		s.durableTxID = tx.meta.TxID
+	}
+	s.mutex.Unlock()
+
+	return nil
+}
@@ -0,0 +1,322 @@
+package btreestore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+// The file is laid out in fixed-size pages. Page 0 holds the two meta slots,
+// and every other page belongs to a node: a leaf, a branch, or the free
+// list. A node that does not fit in one page spills over into the pages
+// right after it.
+//
+// Each node page starts with a pageHeader, followed by the node's entries:
+//
+//   - a leaf entry is a key length (u32), a value length (u32), the key, and
+//     the value
+//   - a branch entry is a key length (u32), a child page (u64), and the key,
+//     which is no bigger than any key under the child
+//   - a free list holds the number of free pages (u32), the number of
+//     pending pages (u32), and then each page (u64)
+type pageHeader struct {
+	CRC32    uint32
+	Type     uint8
+	Overflow uint32
+	Count    uint32
+	Length   uint32
+}
+
+const (
+	pageTypeLeaf     = 1
+	pageTypeBranch   = 2
+	pageTypeFreelist = 3
+)
+
+// meta says where the tree and the free list are. Every commit writes a new
+// one, alternating between the two slots, so a torn meta write leaves the
+// one before it in place.
+type meta struct {
+	Magic     uint32
+	Version   uint32
+	PageSize  uint32
+	TxID      uint64
+	Root      uint64
+	Freelist  uint64
+	PageCount uint64
+	CRC32     uint32
+}
+
+const (
+	metaMagic = 0x414E4254
+
+	// metaVersion 2 says which commit freed each pending page on the free
+	// list. Version 1 free lists are still read: their pending pages were
+	// all freed by the commit that wrote them.
+	metaVersion = 2
+
+	// metaSlotSize is how far apart the meta slots are in page 0. Each slot
+	// is written with a single aligned write, which the disk does not tear.
+	metaSlotSize = 512
+)
+
+var (
+	pageHeaderSize = binary.Size(&pageHeader{})
+
+	byteOrder = binary.BigEndian
+)
+
+func (m meta) calculateCRC32() uint32 {
+	m.CRC32 = 0
+
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, byteOrder, &m)
+
+	return crc32.ChecksumIEEE(buf.Bytes())
+}
+
+func (m *meta) validate() error {
+	if m.Magic != metaMagic {
+		return fmt.Errorf("incorrect meta magic (0x%08X)", m.Magic)
+	}
+	if crc := m.calculateCRC32(); crc != m.CRC32 {
+		return fmt.Errorf("incorrect meta crc32 (0x%08X != 0x%08X)", m.CRC32, crc)
+	}
+	if m.Version == 0 || m.Version > metaVersion {
+		return fmt.Errorf("unsupported meta version %d", m.Version)
+	}
+	if m.PageSize < MinPageSize {
+		return fmt.Errorf("incorrect page size (%d)", m.PageSize)
+	}
+	return nil
+}
+
+func encodeMeta(m meta) []byte {
+	m.CRC32 = m.calculateCRC32()
+
+	buf := bytes.NewBuffer(make([]byte, 0, metaSlotSize))
+	binary.Write(buf, byteOrder, &m)
+	return append(buf.Bytes(), make([]byte, metaSlotSize-buf.Len())...)
+}
+
+func decodeMeta(data []byte) (meta, error) {
+	m := meta{}
+	if err := binary.Read(bytes.NewReader(data), byteOrder, &m); err != nil {
+		return m, errors.Wrap(err, "decode")
+	}
+	return m, m.validate()
+}
+
+// node is a decoded leaf or branch page.
+type node struct {
+	// pages is how many pages the node took up when it was read.
+	pages int
+
+	leaf     bool
+	keys     []string
+	values   []string
+	children []uint64
+}
+
+func (n *node) entrySize(i int) int {
+	if n.leaf {
+		return 8 + len(n.keys[i]) + len(n.values[i])
+	}
+	return 12 + len(n.keys[i])
+}
+
+// search returns the first entry whose key is not less than the provided
+// one, and whether it is equal to it.
+func (n *node) search(key string) (int, bool) {
+	lo, hi := 0, len(n.keys)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if n.keys[mid] < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(n.keys) && n.keys[lo] == key
+}
+
+// childIndex returns the child of a branch that the provided key belongs
+// under.
+func (n *node) childIndex(key string) int {
+	i, found := n.search(key)
+	if found || i == 0 {
+		return i
+	}
+	return i - 1
+}
+
+// slice returns the entries from i up to j as a node of their own.
+func (n *node) slice(i, j int) *node {
+	s := &node{leaf: n.leaf, keys: n.keys[i:j]}
+	if n.leaf {
+		s.values = n.values[i:j]
+	} else {
+		s.children = n.children[i:j]
+	}
+	return s
+}
+
+// split breaks the node up into nodes whose entries fit in one page each,
+// unless an entry is too big for a page by itself.
+func (n *node) split(pageSize int) []*node {
+	capacity := pageSize - pageHeaderSize
+
+	nodes := []*node{}
+	start, size := 0, 0
+	for i := range n.keys {
+		entrySize := n.entrySize(i)
+		if i > start && size+entrySize > capacity {
+			nodes = append(nodes, n.slice(start, i))
+			start, size = i, 0
+		}
+		size += entrySize
+	}
+	if start < len(n.keys) {
+		nodes = append(nodes, n.slice(start, len(n.keys)))
+	}
+	return nodes
+}
+
+func (n *node) encode() (uint8, uint32, []byte) {
+	buf := bytes.NewBuffer([]byte{})
+	for i, key := range n.keys {
+		binary.Write(buf, byteOrder, uint32(len(key)))
+		if n.leaf {
+			binary.Write(buf, byteOrder, uint32(len(n.values[i])))
+			buf.WriteString(key)
+			buf.WriteString(n.values[i])
+		} else {
+			binary.Write(buf, byteOrder, n.children[i])
+			buf.WriteString(key)
+		}
+	}
+
+	if n.leaf {
+		return pageTypeLeaf, uint32(len(n.keys)), buf.Bytes()
+	}
+	return pageTypeBranch, uint32(len(n.keys)), buf.Bytes()
+}
+
+func decodeNode(typ uint8, count uint32, data []byte) (*node, error) {
+	n := &node{leaf: typ == pageTypeLeaf}
+	r := bytes.NewReader(data)
+	for i := uint32(0); i < count; i++ {
+		var keyLength, valueLength uint32
+		var child uint64
+		if err := binary.Read(r, byteOrder, &keyLength); err != nil {
+			return nil, errors.Wrapf(err, "decode entry %d", i)
+		}
+		if n.leaf {
+			if err := binary.Read(r, byteOrder, &valueLength); err != nil {
+				return nil, errors.Wrapf(err, "decode entry %d", i)
+			}
+		} else {
+			if err := binary.Read(r, byteOrder, &child); err != nil {
+				return nil, errors.Wrapf(err, "decode entry %d", i)
+			}
+		}
+		if int64(keyLength)+int64(valueLength) > int64(r.Len()) {
+			return nil, fmt.Errorf("incorrect length for entry %d", i)
+		}
+
+		kv := make([]byte, keyLength+valueLength)
+		r.Read(kv)
+		n.keys = append(n.keys, string(kv[:keyLength]))
+		if n.leaf {
+			n.values = append(n.values, string(kv[keyLength:]))
+		} else {
+			n.children = append(n.children, child)
+		}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("incorrect length (%d bytes left over)", r.Len())
+	}
+
+	return n, nil
+}
+
+// pendingPage is a page that a commit dropped out of the tree, which the
+// commits before it can still reach.
+type pendingPage struct {
+	Page    uint64
+	FreedBy uint64
+}
+
+func encodeFreelist(free []uint64, pending []pendingPage) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, byteOrder, uint32(len(free)))
+	binary.Write(buf, byteOrder, uint32(len(pending)))
+	binary.Write(buf, byteOrder, free)
+	binary.Write(buf, byteOrder, pending)
+	return buf.Bytes()
+}
+
+// decodeFreelist decodes a free list that the provided meta points to.
+func decodeFreelist(data []byte, m meta) ([]uint64, []pendingPage, error) {
+	r := bytes.NewReader(data)
+	var freeCount, pendingCount uint32
+	if err := binary.Read(r, byteOrder, &freeCount); err != nil {
+		return nil, nil, errors.Wrap(err, "decode free count")
+	}
+	if err := binary.Read(r, byteOrder, &pendingCount); err != nil {
+		return nil, nil, errors.Wrap(err, "decode pending count")
+	}
+	pendingSize := int64(binary.Size(pendingPage{}))
+	if m.Version == 1 {
+		pendingSize = 8
+	}
+	if int64(freeCount)*8+int64(pendingCount)*pendingSize != int64(r.Len()) {
+		return nil, nil, fmt.Errorf("incorrect free list length (%d + %d pages)", freeCount, pendingCount)
+	}
+
+	free, pending := make([]uint64, freeCount), make([]pendingPage, pendingCount)
+	binary.Read(r, byteOrder, free)
+	if m.Version == 1 {
+		pages := make([]uint64, pendingCount)
+		binary.Read(r, byteOrder, pages)
+		for i, page := range pages {
+			pending[i] = pendingPage{Page: page, FreedBy: m.TxID}
+		}
+	} else {
+		binary.Read(r, byteOrder, pending)
+	}
+	return free, pending, nil
+}
+
+// pagesFor returns how many pages it takes to hold the provided number of
+// bytes of entries.
+func pagesFor(length, pageSize int) int {
+	return (pageHeaderSize + length + pageSize - 1) / pageSize
+}
+
+// encodePage lays out a node that starts at the provided page and takes up
+// the provided number of pages. The page number is part of the crc32, so a
+// page written to the wrong place is caught too.
+func encodePage(page uint64, pages int, typ uint8, count uint32, data []byte, pageSize int) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, pages*pageSize))
+	binary.Write(buf, byteOrder, &pageHeader{
+		Type:     typ,
+		Overflow: uint32(pages - 1),
+		Count:    count,
+		Length:   uint32(len(data)),
+	})
+	buf.Write(data)
+
+	out := append(buf.Bytes(), make([]byte, pages*pageSize-buf.Len())...)
+	byteOrder.PutUint32(out, pageCRC32(page, out[4:pageHeaderSize+len(data)]))
+	return out
+}
+
+func pageCRC32(page uint64, data []byte) uint32 {
+	number := make([]byte, 8)
+	byteOrder.PutUint64(number, page)
+	return crc32.Update(crc32.ChecksumIEEE(number), crc32.IEEETable, data)
+}
@@ -2,6 +2,8 @@ package andb
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	api "github.com/ankeesler/andb/server"
@@ -9,15 +11,58 @@ import (
 	"google.golang.org/grpc"
 )
 
+// Durability says how far a write must get before the server acknowledges it.
+type Durability = api.Durability
+
+const (
+	// DurabilityAsync writes are acknowledged as soon as they are queued.
+	DurabilityAsync = api.Durability_ASYNC
+	// DurabilityWritten writes are acknowledged once they have been handed to
+	// the OS.
+	DurabilityWritten = api.Durability_WRITTEN
+	// DurabilityFsynced writes are acknowledged once they have been fsynced.
+	DurabilityFsynced = api.Durability_FSYNCED
+)
+
+// ParseDurability parses a durability name (e.g., "fsynced"), ignoring case.
+func ParseDurability(name string) (Durability, error) {
+	d, ok := api.Durability_value[strings.ToUpper(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown durability: %s", name)
+	}
+	return Durability(d), nil
+}
+
 type Client interface {
 	Get(key string) (string, error)
-	Set(key, value string) error
-	Delete(key string) error
+	Set(key, value string, durability Durability) error
+	Delete(key string, durability Durability) error
 	Sync() error
+	Status() (Status, error)
+
+	// Scan returns the keys from start up to (but not including) end, in
+	// order, along with their values. An empty end means every key from
+	// start onward, and a limit of zero means no limit. Big scans take more
+	// than one request. Only engines that keep their keys in order can scan.
+	Scan(start, end string, limit int) ([]KeyValue, error)
 
 	Close() error
 }
 
+// KeyValue is a key that Scan found, along with its value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Status describes the health of the server's store.
+type Status struct {
+	// Degraded is set when the store has stopped taking writes because one
+	// of them failed; Failure says why.
+	Degraded bool
+	Failure  string
+}
+
 type client struct {
 	client api.ANDBClient
 	conn   *grpc.ClientConn
@@ -57,11 +102,11 @@ func (c *client) Get(key string) (string, error) {
 	return rsp.Value, nil
 }
 
-func (c *client) Set(key, value string) error {
+func (c *client) Set(key, value string, durability Durability) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	req := api.SetRequest{Key: key, Value: value}
+	req := api.SetRequest{Key: key, Value: value, Durability: durability}
 
 	rsp, err := c.client.Set(ctx, &req)
 	if err != nil {
@@ -75,11 +120,11 @@ func (c *client) Set(key, value string) error {
 	return nil
 }
 
-func (c *client) Delete(key string) error {
+func (c *client) Delete(key string, durability Durability) error {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
 	defer cancel()
 
-	req := api.DeleteRequest{Key: key}
+	req := api.DeleteRequest{Key: key, Durability: durability}
 
 	rsp, err := c.client.Delete(ctx, &req)
 	if err != nil {
@@ -111,6 +156,65 @@ func (c *client) Sync() error {
 	return nil
 }
 
+func (c *client) Status() (Status, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	req := api.StatusRequest{}
+
+	rsp, err := c.client.Status(ctx, &req)
+	if err != nil {
+		return Status{}, errors.Wrap(err, "status")
+	}
+
+	if rsp.Status != "ok" {
+		return Status{}, errors.Wrap(errors.New(rsp.Status), "status")
+	}
+
+	return Status{Degraded: rsp.Degraded, Failure: rsp.Failure}, nil
+}
+
+func (c *client) Scan(start, end string, limit int) ([]KeyValue, error) {
+	entries := []KeyValue{}
+	for {
+		req := api.ScanRequest{Start: start, End: end}
+		if limit > 0 {
+			req.Limit = int32(limit - len(entries))
+		}
+
+		rsp, err := c.scanPage(&req)
+		if err != nil {
+			return nil, errors.Wrap(err, "scan")
+		}
+
+		for _, entry := range rsp.Entries {
+			entries = append(entries, KeyValue{Key: entry.Key, Value: entry.Value})
+		}
+		if rsp.Next == "" || (limit > 0 && len(entries) >= limit) {
+			return entries, nil
+		}
+		start = rsp.Next
+	}
+}
+
+// scanPage asks the server for the next page of a scan, which is as many of
+// the keys as fit in one response.
+func (c *client) scanPage(req *api.ScanRequest) (*api.ScanResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
+	defer cancel()
+
+	rsp, err := c.client.Scan(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.Status != "ok" {
+		return nil, errors.New(rsp.Status)
+	}
+
+	return rsp, nil
+}
+
 func (c *client) Close() error {
 	return c.conn.Close()
 }
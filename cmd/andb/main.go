@@ -8,8 +8,15 @@ import (
 	"github.com/ankeesler/andb"
 )
 
+var (
+	writeDurability andb.Durability
+	scanLimit       int
+)
+
 func main() {
 	address := flag.String("address", ":8080", "Address at which the server is running")
+	durability := flag.String("durability", "written", "How durable set and delete must be before returning (async, written, or fsynced)")
+	limit := flag.Int("limit", 0, "How many keys scan returns at most (0 means no limit)")
 	help := flag.Bool("help", false, "Print out the help text")
 
 	flag.Parse()
@@ -24,6 +31,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	var err error
+	scanLimit = *limit
+	writeDurability, err = andb.ParseDurability(*durability)
+	if err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
+	}
+
 	var cmd func(andb.Client) error
 	switch flag.Arg(0) {
 	case "get":
@@ -34,6 +49,10 @@ func main() {
 		cmd = delete
 	case "sync":
 		cmd = sync
+	case "status":
+		cmd = status
+	case "scan":
+		cmd = scan
 	}
 
 	if cmd == nil {
@@ -75,7 +94,7 @@ func set(client andb.Client) error {
 		os.Exit(1)
 	}
 
-	if err := client.Set(flag.Arg(1), flag.Arg(2)); err != nil {
+	if err := client.Set(flag.Arg(1), flag.Arg(2), writeDurability); err != nil {
 		return err
 	}
 
@@ -88,7 +107,7 @@ func delete(client andb.Client) error {
 		os.Exit(1)
 	}
 
-	if err := client.Delete(flag.Arg(1)); err != nil {
+	if err := client.Delete(flag.Arg(1), writeDurability); err != nil {
 		return err
 	}
 
@@ -107,3 +126,41 @@ func sync(client andb.Client) error {
 
 	return nil
 }
+
+func status(client andb.Client) error {
+	if flag.NArg() != 1 {
+		fmt.Println("usage: status")
+		os.Exit(1)
+	}
+
+	status, err := client.Status()
+	if err != nil {
+		return err
+	}
+
+	if status.Degraded {
+		fmt.Printf("degraded: %s\n", status.Failure)
+	} else {
+		fmt.Println("ok")
+	}
+
+	return nil
+}
+
+func scan(client andb.Client) error {
+	if flag.NArg() != 2 && flag.NArg() != 3 {
+		fmt.Println("usage: scan <start> [<end>]")
+		os.Exit(1)
+	}
+
+	entries, err := client.Scan(flag.Arg(1), flag.Arg(2), scanLimit)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s %s\n", entry.Key, entry.Value)
+	}
+
+	return nil
+}
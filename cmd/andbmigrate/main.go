@@ -0,0 +1,60 @@
+// andbmigrate upgrades the data and meta files in a store dir to the current
+// format, backing up the old ones so that it can roll back to them. The
+// server must not be running while it does so.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ankeesler/andb/filestore"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	rollback := flag.Bool("rollback", false, "Put back the files from before the last migration")
+	flag.Usage = func() {
+		fmt.Printf("usage: %s [-rollback] <storedir>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	log.SetOutput(ioutil.Discard)
+
+	d, err := filestore.OpenDir(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("error: open store dir: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer d.Close()
+	dataFilename, metaFilename := d.DataFilename(), d.MetaFilename()
+
+	if *rollback {
+		if err := filestore.RollbackMigration(dataFilename, metaFilename); err != nil {
+			fmt.Printf("error: rollback: %s\n", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("rolled back")
+		return
+	}
+
+	count, err := filestore.Migrate(dataFilename, metaFilename)
+	if err != nil {
+		fmt.Printf("error: migrate: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if count == 0 {
+		fmt.Println("already up to date")
+	} else {
+		fmt.Printf("migrated %d block(s), backups are in %s and %s\n",
+			count, dataFilename+filestore.BackupSuffix, metaFilename+filestore.BackupSuffix)
+	}
+}
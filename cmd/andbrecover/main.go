@@ -0,0 +1,83 @@
+// andbrecover rebuilds andbmeta.bin from the keys in andbdata.bin and its
+// segments, reading closed segments from their hint files when it can. The
+// server must not be running while it does so.
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/ankeesler/andb/filestore"
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		fmt.Printf("usage: %s <storedir>\n", os.Args[0])
+		os.Exit(1)
+	}
+
+	storedir := os.Args[1]
+
+	log.SetOutput(ioutil.Discard)
+
+	// Opening the store dir finishes any compaction that a crash interrupted,
+	// which would otherwise replace the rebuilt meta file on the next start.
+	d, err := filestore.OpenDir(storedir)
+	if err != nil {
+		fmt.Printf("error: open store dir: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer d.Close()
+
+	records, skipped, err := recoverMeta(d.DataFilename(), d.MetaFilename())
+	if err != nil {
+		fmt.Printf("error: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("recovered %d record(s), skipped %d byte(s)\n", records, skipped)
+}
+
+// recoverMeta writes a new meta file next to the old one and then renames
+// it into place, so that a crash never leaves a half-written meta file
+// behind.
+func recoverMeta(dataFilename, metaFilename string) (int, int64, error) {
+	data, err := datastore.Open(dataFilename, datastore.ReadOnly)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "open data file")
+	}
+	defer data.Close()
+
+	records, skipped := 0, int64(0)
+	err = fileutil.ReplaceFile(metaFilename, func(metaFile *os.File) error {
+		meta := metastore.New(metaFile)
+		skipped, err = data.ForEachKey(
+			func(h datastore.RecordHeader, keyOffset uint64, key string) error {
+				records++
+				if h.Op == datastore.OpDelete {
+					_, err := meta.WriteTombstone(key, keyOffset)
+					return errors.Wrap(err, "write tombstone")
+				}
+				_, err := meta.WriteBlock(metastore.Block{
+					Kind:        metastore.BlockKindSet,
+					KeyOffset:   keyOffset,
+					KeyLength:   h.KeyLength,
+					KeyCRC32:    h.KeyCRC32,
+					ValueOffset: keyOffset + uint64(h.KeyLength),
+					ValueLength: h.ValueLength,
+					ValueCRC32:  h.ValueCRC32,
+				})
+				return errors.Wrap(err, "write block")
+			},
+		)
+		return errors.Wrap(err, "for each key")
+	})
+
+	return records, skipped, errors.Wrap(err, "replace meta file")
+}
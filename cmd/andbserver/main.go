@@ -4,15 +4,26 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/ankeesler/andb"
 	"github.com/tedsuo/ifrit"
+	"github.com/tedsuo/ifrit/sigmon"
 )
 
 func main() {
 	logfile := flag.String("logfile", "", "The log file that this server will use")
 	loglevel := flag.String("loglevel", "info", "The log level that this server will use")
 	storedir := flag.String("storedir", "/tmp", "The store file that this server will use")
+	engine := flag.String("engine", andb.EngineFile, fmt.Sprintf("The storage engine that this server will use (one of %s)", strings.Join(andb.Engines(), ", ")))
+	engineopts := engineOptions{}
+	flag.Var(engineopts, "engine-opt", "An engine-specific option, as name=value or engine.name=value (can be repeated)")
+	compactinterval := flag.Duration("compactinterval", time.Minute, "How often this server checks whether its store needs compacting (0 disables; file engine only)")
+	indexonly := flag.Bool("indexonly", false, "Only keep the key index in memory, and read values from disk on demand (file engine only)")
+	cachebytes := flag.Int64("cachebytes", 0, "The number of bytes of keys and values to cache in memory (0 is unbounded, or 64 MiB with -indexonly; -1 is always unbounded; file engine only). A bounded cache is split into up to 32 shards of at least 64 KiB each, and never holds a key and value bigger than one shard")
+	segmentbytes := flag.Int64("segmentbytes", 0, "The number of bytes the active data segment gets to before writes roll over to a new one (0 uses the default; file engine only)")
+	readonly := flag.Bool("readonly", false, "Serve reads from a store dir that another server writes to, and reject writes")
 	port := flag.String("port", "8080", "The port that this server will listen on")
 	help := flag.Bool("help", false, "Print out the help text")
 
@@ -23,15 +34,55 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Only the file engine compacts, so the other engines only see the
+	// compaction interval if it is asked for, and refuse it.
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if *engine != andb.EngineFile && !set["compactinterval"] {
+		*compactinterval = 0
+	}
+
 	config := andb.Config{
 		LogFile:  *logfile,
 		LogLevel: *loglevel,
 
 		StoreDir: *storedir,
 
+		Engine:        *engine,
+		EngineOptions: engineopts,
+
+		CompactInterval: *compactinterval,
+
+		IndexOnly:  *indexonly,
+		CacheBytes: *cachebytes,
+
+		SegmentBytes: *segmentbytes,
+
+		ReadOnly: *readonly,
+
 		Address: fmt.Sprintf(":%s", *port),
 	}
 	server := andb.New(&config)
-	p := ifrit.Invoke(server)
+	p := ifrit.Invoke(sigmon.New(server))
 	fmt.Fprintf(os.Stderr, "andb exited with error: %s", <-p.Wait())
 }
+
+// engineOptions collects each -engine-opt flag.
+type engineOptions map[string]string
+
+func (o engineOptions) String() string {
+	options := []string{}
+	for name, value := range o {
+		options = append(options, name+"="+value)
+	}
+	return strings.Join(options, ",")
+}
+
+func (o engineOptions) Set(option string) error {
+	parts := strings.SplitN(option, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("engine option %q is not name=value", option)
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
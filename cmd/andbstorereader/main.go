@@ -7,10 +7,16 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/lock"
+	"github.com/ankeesler/andb/filestore/manifest"
 	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// andbstorereader only ever opens the store read-only, so that it never
+// creates or changes anything in the store dir.
 func main() {
 	if len(os.Args) != 2 {
 		fmt.Printf("usage: %s <storedir>\n", os.Args[0])
@@ -20,10 +26,33 @@ func main() {
 	storedir := os.Args[1]
 
 	log.SetOutput(ioutil.Discard)
+
+	l, err := lock.Shared(storedir)
+	if err != nil {
+		fmt.Printf("error: lock store dir: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer l.Release()
+
+	dataFilename := filepath.Join(storedir, "andbdata.bin")
+	metaFilename := filepath.Join(storedir, "andbmeta.bin")
+	if m, err := manifest.Load(storedir); err == nil {
+		dataFilename, metaFilename = m.Path(m.DataFile), m.Path(m.MetaFile)
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		fmt.Printf("error: load manifest: %s\n", err.Error())
+		os.Exit(1)
+	}
+
 	printFile(
-		filepath.Join(storedir, "andbmeta.bin"),
-		func(file *os.File) error {
-			return metastore.New(file).ForEachBlock(
+		metaFilename,
+		func() error {
+			ms, err := metastore.Open(metaFilename, metastore.ReadOnly)
+			if err != nil {
+				return err
+			}
+			defer ms.Close()
+
+			return ms.ForEachBlock(
 				func(b metastore.Block) error {
 					fmt.Printf("%+v\n", b)
 					return nil
@@ -33,20 +62,29 @@ func main() {
 	)
 
 	printFile(
-		filepath.Join(storedir, "andbdata.bin"),
-		func(file *os.File) error {
-			return nil
+		dataFilename,
+		func() error {
+			ds, err := datastore.Open(dataFilename, datastore.ReadOnly)
+			if err != nil {
+				return err
+			}
+			defer ds.Close()
+
+			skipped, err := ds.ForEachRecord(
+				func(h datastore.RecordHeader, keyOffset uint64, key, value string) error {
+					fmt.Printf("%+v %q => %q\n", h, key, value)
+					return nil
+				},
+			)
+			if skipped > 0 {
+				fmt.Printf("skipped %d byte(s) that are not records\n", skipped)
+			}
+			return err
 		},
 	)
 }
 
-func printFile(filename string, print func(*os.File) error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		fmt.Printf("error: print file %s: open file: %s", filename, err.Error())
-		os.Exit(1)
-	}
-	defer file.Close()
+func printFile(filename string, print func() error) {
 	fmt.Printf("file: %s\n", filename)
 
 	bytes, err := ioutil.ReadFile(filename)
@@ -56,7 +94,7 @@ func printFile(filename string, print func(*os.File) error) {
 	}
 	fmt.Println(hex.Dump(bytes))
 
-	if err := print(file); err != nil {
+	if err := print(); err != nil {
 		fmt.Printf("error: print file %s: %s\n", filename, err.Error())
 		os.Exit(1)
 	}
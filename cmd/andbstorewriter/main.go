@@ -4,13 +4,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strconv"
 
 	"github.com/ankeesler/andb/filestore"
-	"github.com/ankeesler/andb/filestore/datastore"
-	"github.com/ankeesler/andb/filestore/metastore"
 	"github.com/ankeesler/andb/memstore"
+	api "github.com/ankeesler/andb/server"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,38 +28,21 @@ func main() {
 
 	log.SetOutput(ioutil.Discard)
 
-	dFile, err := os.OpenFile(
-		filepath.Join(storedir, "andbdata.bin"),
-		os.O_RDWR|os.O_CREATE,
-		0600,
-	)
+	f, closeStore, err := filestore.Open(storedir, filestore.Options{
+		Cache: memstore.New(),
+		Mode:  filestore.ModeFull,
+	})
 	if err != nil {
-		fmt.Printf("error: open metastore: %s\n", err.Error())
+		fmt.Printf("error: open store: %s\n", err.Error())
 		os.Exit(1)
 	}
-	defer dFile.Close()
-
-	mFile, err := os.OpenFile(
-		filepath.Join(storedir, "andbmeta.bin"),
-		os.O_RDWR|os.O_CREATE,
-		0600,
-	)
-	if err != nil {
-		fmt.Printf("error: open metastore: %s\n", err.Error())
-		os.Exit(1)
-	}
-	defer mFile.Close()
-
-	f := filestore.New(
-		memstore.New(),
-		datastore.New(dFile),
-		metastore.New(mFile),
-	)
+	defer closeStore()
 
 	for i := 0; i < keycount; i++ {
 		if err := f.Set(
 			fmt.Sprintf(keyformat, i),
 			fmt.Sprintf("value-%d", i),
+			api.Durability_ASYNC,
 		); err != nil {
 			fmt.Printf("error: set: %s", err.Error())
 			os.Exit(1)
@@ -75,4 +56,9 @@ func main() {
 			}
 		}
 	}
+
+	if err := f.Sync(); err != nil {
+		fmt.Printf("error: sync: %s", err.Error())
+		os.Exit(1)
+	}
 }
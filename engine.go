@@ -0,0 +1,252 @@
+package andb
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ankeesler/andb/btreestore"
+	"github.com/ankeesler/andb/filestore/lock"
+	"github.com/ankeesler/andb/lsmstore"
+	"github.com/ankeesler/andb/memstore"
+	api "github.com/ankeesler/andb/server"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// The storage engines that are registered out of the box.
+const (
+	EngineMemory = "memory"
+	EngineFile   = "file"
+	EngineLSM    = "lsm"
+	EngineBTree  = "btree"
+)
+
+// An Engine opens the store that the config describes. It returns a func
+// that closes the store once the server is done with it.
+type Engine func(config *Config) (api.Store, func(), error)
+
+var (
+	engines      = make(map[string]Engine)
+	enginesMutex = &sync.Mutex{}
+)
+
+func init() {
+	RegisterEngine(EngineMemory, openMemoryEngine)
+	RegisterEngine(EngineFile, openFileEngine)
+	RegisterEngine(EngineLSM, openLSMEngine)
+	RegisterEngine(EngineBTree, openBTreeEngine)
+}
+
+// RegisterEngine makes an engine available to Config.Engine by name. It
+// panics if the name is taken.
+func RegisterEngine(name string, engine Engine) {
+	enginesMutex.Lock()
+	defer enginesMutex.Unlock()
+
+	if _, ok := engines[name]; ok {
+		panic("engine " + name + " is already registered")
+	}
+	engines[name] = engine
+}
+
+// Engines returns the names of the registered engines, in order.
+func Engines() []string {
+	enginesMutex.Lock()
+	defer enginesMutex.Unlock()
+
+	names := []string{}
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func openEngine(config *Config) (api.Store, func(), error) {
+	name := config.Engine
+	if name == "" {
+		name = EngineFile
+	}
+
+	enginesMutex.Lock()
+	engine, ok := engines[name]
+	enginesMutex.Unlock()
+	if !ok {
+		return nil, nil, errors.Errorf("unknown engine %q (registered: %v)", name, Engines())
+	}
+
+	log.Debugf("engine: %s %v", name, config.EngineOptions)
+	return engine(config)
+}
+
+// parseEngineOptions parses each of config.EngineOptions into the *int,
+// *int64, *bool, *string, or *time.Duration that it names, and fails on any
+// option that the engine does not understand. An option's name may start
+// with the engine's name (e.g., "lsm.memtablebytes").
+func parseEngineOptions(config *Config, options map[string]interface{}) error {
+	engine := config.Engine
+	if engine == "" {
+		engine = EngineFile
+	}
+
+	for name, value := range config.EngineOptions {
+		option, ok := options[strings.TrimPrefix(name, engine+".")]
+		if !ok {
+			return errors.Errorf("unknown engine option %q", name)
+		}
+
+		var err error
+		switch option := option.(type) {
+		case *int:
+			*option, err = strconv.Atoi(value)
+		case *int64:
+			*option, err = strconv.ParseInt(value, 10, 64)
+		case *bool:
+			*option, err = strconv.ParseBool(value)
+		case *string:
+			*option = value
+		case *time.Duration:
+			*option, err = time.ParseDuration(value)
+		default:
+			err = errors.Errorf("unsupported option type %T", option)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "parse engine option %q", name)
+		}
+	}
+
+	return nil
+}
+
+// rejectFileOptions fails if the config sets any of the options that only
+// the file engine takes.
+func rejectFileOptions(config *Config, engine string) error {
+	for _, option := range []struct {
+		name string
+		set  bool
+	}{
+		{"compactinterval", config.CompactInterval != 0},
+		{"indexonly", config.IndexOnly},
+		{"cachebytes", config.CacheBytes != 0},
+		{"segmentbytes", config.SegmentBytes != 0},
+	} {
+		if option.set {
+			return errors.Errorf("the %s engine does not take the file engine's %s option", engine, option.name)
+		}
+	}
+	return nil
+}
+
+// openMemoryEngine opens a store that lives in memory. It takes a
+// "snapshot" option, which snapshots the store to the store dir on sync and
+// on shutdown; otherwise, the store dir is left alone.
+func openMemoryEngine(config *Config) (api.Store, func(), error) {
+	snapshot := false
+	if err := parseEngineOptions(config, map[string]interface{}{
+		"snapshot": &snapshot,
+	}); err != nil {
+		return nil, nil, err
+	}
+	if config.ReadOnly {
+		return nil, nil, errors.New("the memory engine cannot be run read-only")
+	}
+	if err := rejectFileOptions(config, EngineMemory); err != nil {
+		return nil, nil, err
+	}
+
+	if !snapshot {
+		return memstore.NewStore(), func() {}, nil
+	}
+
+	storeLock, err := lock.Exclusive(config.StoreDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "lock store dir")
+	}
+
+	ms, err := memstore.OpenStore(filepath.Join(config.StoreDir, memstore.SnapshotFile))
+	if err != nil {
+		storeLock.Release()
+		return nil, nil, errors.Wrap(err, "open memory store")
+	}
+
+	return ms, func() {
+		if err := ms.Close(); err != nil {
+			log.Warnf("close memory store: %s", err.Error())
+		}
+		storeLock.Release()
+	}, nil
+}
+
+// openLSMEngine opens the store dir for writing with the lsm engine. It
+// takes a "memtablebytes" option.
+func openLSMEngine(config *Config) (api.Store, func(), error) {
+	options := lsmstore.Options{}
+	if err := parseEngineOptions(config, map[string]interface{}{
+		"memtablebytes": &options.MemtableBytes,
+	}); err != nil {
+		return nil, nil, err
+	}
+	if config.ReadOnly {
+		return nil, nil, errors.New("the lsm engine cannot be run read-only")
+	}
+	if err := rejectFileOptions(config, EngineLSM); err != nil {
+		return nil, nil, err
+	}
+
+	storeLock, err := lock.Exclusive(config.StoreDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "lock store dir")
+	}
+
+	ls, err := lsmstore.Open(config.StoreDir, options)
+	if err != nil {
+		storeLock.Release()
+		return nil, nil, errors.Wrap(err, "open lsm store")
+	}
+
+	return ls, func() {
+		if err := ls.Close(); err != nil {
+			log.Warnf("close lsm store: %s", err.Error())
+		}
+		storeLock.Release()
+	}, nil
+}
+
+// openBTreeEngine opens the store dir for writing with the btree engine. It
+// takes a "pagebytes" option.
+func openBTreeEngine(config *Config) (api.Store, func(), error) {
+	options := btreestore.Options{}
+	if err := parseEngineOptions(config, map[string]interface{}{
+		"pagebytes": &options.PageSize,
+	}); err != nil {
+		return nil, nil, err
+	}
+	if config.ReadOnly {
+		return nil, nil, errors.New("the btree engine cannot be run read-only")
+	}
+	if err := rejectFileOptions(config, EngineBTree); err != nil {
+		return nil, nil, err
+	}
+
+	storeLock, err := lock.Exclusive(config.StoreDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "lock store dir")
+	}
+
+	bs, err := btreestore.Open(config.StoreDir, options)
+	if err != nil {
+		storeLock.Release()
+		return nil, nil, errors.Wrap(err, "open btree store")
+	}
+
+	return bs, func() {
+		if err := bs.Close(); err != nil {
+			log.Warnf("close btree store: %s", err.Error())
+		}
+		storeLock.Release()
+	}, nil
+}
@@ -0,0 +1,45 @@
+// Package failpoint lets tests make andb fail in interesting places. A
+// failpoint is enabled by listing its name in the comma-separated
+// ANDB_FAILPOINTS environment variable.
+package failpoint
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const EnvVar = "ANDB_FAILPOINTS"
+
+var enabled = parse(os.Getenv(EnvVar))
+
+// Error returns an error if the named failpoint is enabled.
+func Error(name string) error {
+	if enabled[name] {
+		return fmt.Errorf("failpoint %s", name)
+	}
+	return nil
+}
+
+// Crash kills the process, like kill -9 would, if the named failpoint is
+// enabled.
+func Crash(name string) {
+	if !enabled[name] {
+		return
+	}
+
+	if p, err := os.FindProcess(os.Getpid()); err == nil {
+		p.Kill()
+	}
+	select {} // wait for the kill to land
+}
+
+func parse(env string) map[string]bool {
+	enabled := make(map[string]bool)
+	for _, name := range strings.Split(env, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			enabled[name] = true
+		}
+	}
+	return enabled
+}
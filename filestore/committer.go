@@ -0,0 +1,418 @@
+package filestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ankeesler/andb/failpoint"
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/metastore"
+	api "github.com/ankeesler/andb/server"
+	"github.com/ankeesler/andb/wal"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// CheckpointSize is how big the wal can get before the data and meta files
+// are synced and it is truncated.
+const CheckpointSize = 16 << 20
+
+type commitKind int
+
+const (
+	// commitWrite commits are appended to the wal, along with every other
+	// write that is waiting, and then applied to the data and meta files.
+	commitWrite commitKind = iota
+	// commitBarrier commits checkpoint everything before them, and report
+	// the failures of all of the writes since the last barrier.
+	commitBarrier
+	// commitTask commits run a function once everything before them has
+	// been checkpointed.
+	commitTask
+)
+
+type commit struct {
+	kind        commitKind
+	description string
+
+	record     wal.Record
+	seq        uint64
+	durability api.Durability
+
+	task func() error
+
+	// done receives the result of the commit once it is as durable as it
+	// asked to be.
+	done chan error
+}
+
+func newCommit(kind commitKind, description string) *commit {
+	return &commit{
+		kind:        kind,
+		description: description,
+		done:        make(chan error, 1),
+	}
+}
+
+// enqueue hands the commit to the committer without waiting for it.
+func (f *Filestore) enqueue(c *commit) {
+	f.queueMutex.Lock()
+	f.queue = append(f.queue, c)
+	f.queueMutex.Unlock()
+
+	select {
+	case f.queueC <- struct{}{}:
+	default:
+	}
+}
+
+// runTask runs the provided function on the committer, once everything
+// before it has been checkpointed.
+func (f *Filestore) runTask(description string, task func() error) error {
+	if err := f.loadError(); err != nil {
+		return err
+	}
+
+	c := newCommit(commitTask, description)
+	c.task = task
+	f.enqueue(c)
+	return <-c.done
+}
+
+func (f *Filestore) startCommitter() {
+	go func() {
+		log.Debugf("committer starting")
+		for range f.queueC {
+			for {
+				f.queueMutex.Lock()
+				batch := f.queue
+				f.queue = nil
+				f.queueMutex.Unlock()
+
+				if len(batch) == 0 {
+					break
+				}
+
+				f.commitBatch(batch)
+			}
+		}
+	}()
+}
+
+// commitBatch group commits each run of writes in the batch, and handles the
+// barriers and tasks in between them.
+func (f *Filestore) commitBatch(batch []*commit) {
+	writes := []*commit{}
+	for _, c := range batch {
+		if c.kind == commitWrite {
+			writes = append(writes, c)
+			continue
+		}
+
+		f.commitWrites(writes)
+		writes = []*commit{}
+
+		// Once the store is degraded, the wal holds writes that may not have
+		// made it to the data and meta files, so it must not be truncated.
+		err := f.Status()
+		if err == nil {
+			err = f.checkpoint()
+			if err != nil && c.kind == commitBarrier {
+				f.recordFailure(c, err)
+			}
+		} else {
+			err = errors.Wrap(err, "store is degraded")
+		}
+
+		if c.kind == commitBarrier {
+			if failures := f.flushFailures(); failures != nil {
+				err = failures
+			}
+		} else if err == nil {
+			err = c.task()
+		}
+		c.done <- err
+	}
+	f.commitWrites(writes)
+
+	if f.Status() != nil {
+		return
+	}
+
+	if size, err := f.wal.Size(); err != nil {
+		log.Warnf("wal size: %s", err.Error())
+	} else if size > CheckpointSize {
+		if err := f.checkpoint(); err != nil {
+			log.Warnf("checkpoint: %s", err.Error())
+		}
+	}
+}
+
+func (f *Filestore) commitWrites(writes []*commit) {
+	if len(writes) == 0 {
+		return
+	}
+
+	log.Debugf("committing %d write(s)", len(writes))
+
+	if err := f.Status(); err != nil {
+		for _, c := range writes {
+			f.fail(c, errors.Wrap(err, "store is degraded"))
+		}
+		return
+	}
+
+	// The wal is rolled back to the end of the last write that was applied
+	// if any of them fail, so that the writes that are reported as failed are
+	// not replayed on the next startup.
+	start, err := f.wal.Size()
+	if err != nil {
+		f.degrade(errors.Wrap(err, "wal size"))
+		for _, c := range writes {
+			f.fail(c, errors.Wrap(err, "wal size"))
+		}
+		return
+	}
+
+	records := make([]wal.Record, len(writes))
+	fsync := false
+	for i, c := range writes {
+		records[i] = c.record
+		if c.durability == api.Durability_FSYNCED {
+			fsync = true
+		}
+	}
+
+	if err := f.wal.Append(records); err != nil {
+		f.degrade(errors.Wrap(err, "append to wal"))
+		f.rewindWAL(start)
+		for _, c := range writes {
+			f.fail(c, errors.Wrap(err, "append to wal"))
+		}
+		return
+	}
+
+	if fsync {
+		if err := f.wal.Sync(); err != nil {
+			f.degrade(errors.Wrap(err, "sync wal"))
+			f.rewindWAL(start)
+			for _, c := range writes {
+				f.fail(c, errors.Wrap(err, "sync wal"))
+			}
+			return
+		}
+	}
+
+	applied := start
+	for i, c := range writes {
+		if err := f.Status(); err != nil {
+			f.fail(c, errors.Wrap(err, "store is degraded"))
+			continue
+		}
+
+		b, err := f.apply(c.record, c.seq)
+		if err != nil {
+			f.degrade(errors.Wrap(err, "apply"))
+			f.rewindWAL(applied)
+			f.fail(c, errors.Wrap(err, "apply"))
+			continue
+		}
+
+		f.applyPending(c.record.Key, c.seq, b)
+		applied += wal.RecordSize(records[i])
+		c.done <- nil
+	}
+}
+
+// rewindWAL throws away the records in the wal past the provided size, which
+// belong to writes that failed. If it cannot, they will be replayed on the
+// next startup, which the failures file says to look into.
+func (f *Filestore) rewindWAL(size int64) {
+	if err := f.wal.Rewind(size); err != nil {
+		log.Errorf("rewind wal to %d byte(s): %s", size, err.Error())
+	}
+}
+
+// apply writes the record to the data and meta files under the provided
+// sequence number.
+func (f *Filestore) apply(r wal.Record, seq uint64) (metastore.Block, error) {
+	if err := failpoint.Error("apply"); err != nil {
+		return metastore.Block{}, err
+	}
+
+	var (
+		b   metastore.Block
+		err error
+	)
+	if r.Op == wal.OpDelete {
+		f.data.WriteKeyValue(
+			datastore.OpDelete,
+			seq,
+			r.Key,
+			"",
+			func(key, value string, keyOffset, valueOffset uint64) {
+				b, err = f.meta.WriteTombstone(key, keyOffset)
+			},
+			func(err0 error) {
+				err = errors.Wrap(err0, "write key data")
+			},
+		)
+	} else {
+		f.data.WriteKeyValue(
+			datastore.OpSet,
+			seq,
+			r.Key,
+			r.Value,
+			func(key, value string, keyOffset, valueOffset uint64) {
+				b, err = f.meta.Write(key, value, keyOffset, valueOffset)
+			},
+			func(err0 error) {
+				err = errors.Wrap(err0, "write key/value data")
+			},
+		)
+	}
+	return b, err
+}
+
+// checkpoint makes the data and meta files durable, so that the wal is no
+// longer needed, and records that in the store's manifest if the wal held
+// any writes.
+func (f *Filestore) checkpoint() error {
+	f.files.RLock()
+	defer f.files.RUnlock()
+
+	walSize, err := f.wal.Size()
+	if err != nil {
+		return errors.Wrap(err, "wal size")
+	}
+
+	if err := f.data.Sync(); err != nil {
+		return errors.Wrap(err, "sync data file")
+	}
+
+	if err := f.meta.Sync(); err != nil {
+		return errors.Wrap(err, "sync meta file")
+	}
+
+	if err := f.wal.Truncate(); err != nil {
+		return errors.Wrap(err, "truncate wal")
+	}
+
+	// Checkpoints of an empty wal, e.g., for a Sync with nothing written
+	// since the last one, are not worth rewriting the manifest for.
+	if f.manifest != nil && walSize > 0 {
+		if err := f.manifest.Checkpointed(time.Now()); err != nil {
+			return errors.Wrap(err, "record checkpoint in manifest")
+		}
+	}
+
+	return errors.Wrap(f.recordSegments(), "record segments")
+}
+
+// recordSegments lists the data file's segments and hint files in the
+// manifest, if the segments have changed since they were last listed.
+func (f *Filestore) recordSegments() error {
+	if f.manifest == nil {
+		return nil
+	}
+
+	segments := f.data.Segments()
+	if len(segments) == len(f.recordedSegments) {
+		changed := false
+		for i := range segments {
+			if segments[i] != f.recordedSegments[i] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return nil
+		}
+	}
+
+	filenames, err := datastore.SegmentFiles(f.data.Name())
+	if err != nil {
+		return errors.Wrap(err, "segment files")
+	}
+	for i := range filenames {
+		filenames[i] = filepath.Base(filenames[i])
+	}
+	if err := f.manifest.SetSegmentFiles(filenames); err != nil {
+		return errors.Wrap(err, "set segment files")
+	}
+
+	f.recordedSegments = segments
+	return nil
+}
+
+// fail reports a commit's failure to whoever is waiting on it, and to the
+// next barrier. If the commit was a write, it is also recorded in the
+// failures file, and forgotten about so that nobody reads it.
+func (f *Filestore) fail(c *commit, err error) {
+	f.recordFailure(c, err)
+
+	if c.kind == commitWrite {
+		f.dropPending(c.record.Key, c.seq)
+
+		if err := f.appendFailuresFile(c, err); err != nil {
+			log.Errorf("append to failures file: %s", err.Error())
+		}
+	}
+
+	c.done <- err
+}
+
+func (f *Filestore) recordFailure(c *commit, err error) {
+	log.Warnf("commit failed (%s): %s", c.description, err.Error())
+	f.failures = append(
+		f.failures,
+		fmt.Sprintf("%s: %s", c.description, err.Error()),
+	)
+}
+
+// degrade stops the store from taking any more writes.
+func (f *Filestore) degrade(err error) {
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+
+	if f.degraded == nil {
+		log.Errorf("store is degraded and read-only: %s", err.Error())
+		f.degraded = err
+	}
+}
+
+func (f *Filestore) appendFailuresFile(c *commit, err error) error {
+	file, err0 := os.OpenFile(f.failuresFilename(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err0 != nil {
+		return errors.Wrap(err0, "open")
+	}
+	defer file.Close()
+
+	if _, err0 := fmt.Fprintf(
+		file,
+		"%s %s: %s\n",
+		time.Now().Format(time.RFC3339),
+		c.description,
+		err.Error(),
+	); err0 != nil {
+		return errors.Wrap(err0, "write")
+	}
+
+	return file.Sync()
+}
+
+// flushFailures returns (and forgets about) the failures since the last
+// barrier.
+func (f *Filestore) flushFailures() error {
+	failures := f.failures
+	f.failures = nil
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d write(s) failed: %s", len(failures), strings.Join(failures, "; "))
+}
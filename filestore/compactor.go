@@ -0,0 +1,459 @@
+package filestore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ankeesler/andb/failpoint"
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// CompactionGarbageRatio is the fraction of a data segment that must be
+// taken up by overwritten or deleted values before background compaction
+// runs on it.
+const CompactionGarbageRatio = 0.5
+
+const (
+	compactSuffix     = ".compact"
+	compactCommitFile = "andbcompact.commit"
+)
+
+// StartCompactor periodically compacts the store in the background whenever
+// enough of a data segment has become garbage. A store that could not be
+// loaded is never compacted.
+func (f *Filestore) StartCompactor(interval time.Duration) {
+	if err := f.loadError(); err != nil {
+		log.Warnf("not starting compactor: %s", err.Error())
+		return
+	}
+
+	go func() {
+		log.Debugf("compactor starting (interval %s)", interval)
+		for range time.Tick(interval) {
+			if err := f.runTask("compact (background)", func() error {
+				return f.compact(false)
+			}); err != nil {
+				log.Warnf("background compaction failed: %s", err.Error())
+			}
+		}
+	}()
+}
+
+// Compact rewrites the live key/value data in every data segment with any
+// garbage in it, one segment at a time, along with a matching meta file.
+func (f *Filestore) Compact() error {
+	return f.runTask("compact", func() error {
+		return f.compact(true)
+	})
+}
+
+// RecoverCompaction finishes (or throws away) a compaction that was
+// interrupted by a crash. It must be called before the data and meta files
+// are opened.
+func RecoverCompaction(dataFilename, metaFilename string) error {
+	dir := filepath.Dir(dataFilename)
+	commitFilename := filepath.Join(dir, compactCommitFile)
+
+	commit, err := ioutil.ReadFile(commitFilename)
+	if os.IsNotExist(err) {
+		stale, err := filepath.Glob(filepath.Join(dir, "*"+compactSuffix))
+		if err != nil {
+			return errors.Wrap(err, "glob stale compaction files")
+		}
+		for _, filename := range stale {
+			if err := os.Remove(filename); err != nil {
+				return errors.Wrap(err, "remove stale compaction file")
+			}
+		}
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read commit file")
+	}
+
+	// The commit file names the compacted segment and then the meta file.
+	// Commit files from before there were segments are empty.
+	filenames := strings.Fields(string(commit))
+	for i := range filenames {
+		filenames[i] = filepath.Join(dir, filenames[i])
+	}
+	if len(filenames) == 0 {
+		filenames = []string{dataFilename, metaFilename}
+	}
+
+	log.Infof("finishing interrupted compaction")
+	if err := os.Remove(datastore.HintFilename(filenames[0])); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove hint file")
+	}
+	for _, filename := range filenames {
+		if err := os.Rename(filename+compactSuffix, filename); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "rename")
+		}
+	}
+
+	if err := os.Remove(commitFilename); err != nil {
+		return errors.Wrap(err, "remove commit file")
+	}
+
+	return errors.Wrap(fileutil.SyncDir(dir), "sync dir")
+}
+
+type liveBlock struct {
+	key    string
+	header datastore.RecordHeader
+	block  metastore.Block
+}
+
+// segment returns the data segment that the block points into.
+func (lb *liveBlock) segment() int {
+	segment, _ := datastore.SplitAddress(lb.block.KeyOffset)
+	return segment
+}
+
+// compact must only be run from the committer, so that no other writes
+// happen to the data and meta files while they are being copied.
+func (f *Filestore) compact(force bool) error {
+	segments, err := f.segmentsToCompact(force)
+	if err != nil {
+		return errors.Wrap(err, "segments to compact")
+	}
+
+	for _, segment := range segments {
+		if err := f.compactSegment(segment); err != nil {
+			return errors.Wrapf(err, "compact segment %d", segment)
+		}
+	}
+
+	return errors.Wrap(f.recordSegments(), "record segments")
+}
+
+// segmentsToCompact returns the data segments that have enough garbage in
+// them to be compacted, or any garbage at all if force is set. If that
+// includes the active segment, it is rolled over first, so that compaction
+// never touches the segment being written to.
+func (f *Filestore) segmentsToCompact(force bool) ([]int, error) {
+	blocks, err := f.latestBlocks()
+	if err != nil {
+		return nil, errors.Wrap(err, "latest blocks")
+	}
+
+	liveBytes := make(map[int]int64)
+	for _, lb := range blocks {
+		liveBytes[lb.segment()] += int64(datastore.RecordHeaderSize) +
+			int64(lb.block.KeyLength) +
+			int64(lb.block.ValueLength)
+	}
+
+	active := f.data.ActiveSegment()
+	segments := []int{}
+	for _, segment := range f.data.Segments() {
+		size, err := f.data.SegmentSize(segment)
+		if err != nil {
+			return nil, errors.Wrapf(err, "size of segment %d", segment)
+		}
+
+		garbage := size - liveBytes[segment]
+		if size == 0 {
+			if segment != 0 && segment != active {
+				segments = append(segments, segment)
+			}
+			continue
+		}
+		if !force && float64(garbage)/float64(size) < CompactionGarbageRatio ||
+			force && garbage <= 0 {
+			log.Tracef("skipping compaction of segment %d (%d/%d bytes garbage)", segment, garbage, size)
+			continue
+		}
+
+		log.Infof("compacting segment %d (%d/%d bytes garbage)", segment, garbage, size)
+		segments = append(segments, segment)
+	}
+
+	if len(segments) > 0 && segments[len(segments)-1] == active {
+		if err := f.data.Roll(); err != nil {
+			return nil, errors.Wrap(err, "roll active segment")
+		}
+	}
+
+	return segments, nil
+}
+
+// compactSegment rewrites the records in a closed segment that are still
+// the latest for their key into a fresh segment, along with a meta file
+// that points to them, and swaps both into place. Blocks that point into
+// other segments are copied over as they are.
+func (f *Filestore) compactSegment(segment int) error {
+	size, err := f.data.SegmentSize(segment)
+	if err != nil {
+		return errors.Wrap(err, "segment size")
+	}
+	if size == 0 && segment != 0 {
+		log.Infof("removing empty segment %d", segment)
+		return errors.Wrap(f.data.RemoveSegment(segment), "remove segment")
+	}
+
+	blocks, err := f.latestBlocks()
+	if err != nil {
+		return errors.Wrap(err, "latest blocks")
+	}
+
+	tombstones, err := f.neededTombstones(segment, blocks)
+	if err != nil {
+		return errors.Wrap(err, "needed tombstones")
+	}
+
+	segmentFilename := datastore.SegmentFilename(f.data.Name(), segment)
+	index, written, err := f.writeCompacted(
+		segment,
+		blocks,
+		tombstones,
+		segmentFilename+compactSuffix,
+		f.meta.Name()+compactSuffix,
+	)
+	if err != nil {
+		return errors.Wrap(err, "write compacted files")
+	}
+
+	return errors.Wrap(
+		f.swapCompacted(segment, index, written == 0),
+		"swap compacted files",
+	)
+}
+
+// swapCompacted atomically replaces a data segment and the meta file with
+// their fsynced, compacted versions, reopens them, and swaps in the index
+// that points into them. Each step is followed by a failpoint so that tests
+// can crash the process in between them; either RecoverCompaction rolls the
+// swap forward, or nothing has changed.
+func (f *Filestore) swapCompacted(
+	segment int,
+	index map[string]metastore.Block,
+	empty bool,
+) error {
+	segmentFilename := datastore.SegmentFilename(f.data.Name(), segment)
+	metaFilename := f.meta.Name()
+	dir := filepath.Dir(segmentFilename)
+	failpoint.Crash("compact-before-commit")
+
+	commitFile, err := os.Create(filepath.Join(dir, compactCommitFile))
+	if err != nil {
+		return errors.Wrap(err, "create commit file")
+	}
+	if _, err := fmt.Fprintf(
+		commitFile,
+		"%s\n%s\n",
+		filepath.Base(segmentFilename),
+		filepath.Base(metaFilename),
+	); err != nil {
+		commitFile.Close()
+		return errors.Wrap(err, "write commit file")
+	}
+	if err := commitFile.Sync(); err != nil {
+		commitFile.Close()
+		return errors.Wrap(err, "sync commit file")
+	}
+	if err := commitFile.Close(); err != nil {
+		return errors.Wrap(err, "close commit file")
+	}
+	if err := fileutil.SyncDir(dir); err != nil {
+		return errors.Wrap(err, "sync dir")
+	}
+	failpoint.Crash("compact-after-commit")
+
+	// From here on out, RecoverCompaction will roll the swap forward if we
+	// crash.
+	f.files.Lock()
+	defer f.files.Unlock()
+
+	if err := os.Remove(datastore.HintFilename(segmentFilename)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove hint file")
+	}
+	if err := os.Rename(segmentFilename+compactSuffix, segmentFilename); err != nil {
+		return errors.Wrap(err, "rename data segment")
+	}
+	failpoint.Crash("compact-after-data-rename")
+
+	if err := os.Rename(metaFilename+compactSuffix, metaFilename); err != nil {
+		return errors.Wrap(err, "rename meta file")
+	}
+	if err := fileutil.SyncDir(dir); err != nil {
+		return errors.Wrap(err, "sync dir")
+	}
+	failpoint.Crash("compact-after-meta-rename")
+
+	if err := f.data.Reopen(); err != nil {
+		return errors.Wrap(err, "reopen data file")
+	}
+	if err := f.meta.Reopen(); err != nil {
+		return errors.Wrap(err, "reopen meta file")
+	}
+
+	f.setIndex(index)
+
+	if err := os.Remove(commitFile.Name()); err != nil {
+		return errors.Wrap(err, "remove commit file")
+	}
+	if err := fileutil.SyncDir(dir); err != nil {
+		return errors.Wrap(err, "sync dir")
+	}
+
+	if empty && segment != 0 {
+		return errors.Wrap(f.data.RemoveSegment(segment), "remove segment")
+	}
+	return errors.Wrap(f.data.WriteHint(segment), "write hint")
+}
+
+// latestBlocks returns the most recent block for each key, including
+// tombstones, in the order that they were written.
+func (f *Filestore) latestBlocks() ([]liveBlock, error) {
+	f.files.RLock()
+	defer f.files.RUnlock()
+
+	all := []liveBlock{}
+	latest := make(map[string]int)
+	if err := f.meta.ForEachBlock(func(b metastore.Block) error {
+		key, h, err := f.readKey(b)
+		if err != nil {
+			return err
+		}
+
+		latest[key] = len(all)
+		all = append(all, liveBlock{key: key, header: h, block: b})
+
+		return nil
+	}); err != nil {
+		return nil, errors.Wrap(err, "for each block")
+	}
+
+	blocks := make([]liveBlock, 0, len(latest))
+	for i, lb := range all {
+		if latest[lb.key] == i {
+			blocks = append(blocks, lb)
+		}
+	}
+
+	return blocks, nil
+}
+
+// neededTombstones returns the keys of the latest tombstones in the provided
+// segment that still have records in an older segment. The rest are dropped
+// by compaction, since nothing is left for them to hide.
+func (f *Filestore) neededTombstones(segment int, blocks []liveBlock) (map[string]bool, error) {
+	tombstones := make(map[string]bool)
+	for _, lb := range blocks {
+		if lb.segment() == segment && lb.block.Kind == metastore.BlockKindDelete {
+			tombstones[lb.key] = false
+		}
+	}
+
+	for _, older := range f.data.Segments() {
+		if older >= segment || len(tombstones) == 0 {
+			break
+		}
+
+		if _, err := f.data.ForEachKeyIn(
+			older,
+			func(_ datastore.RecordHeader, _ uint64, key string) error {
+				if _, ok := tombstones[key]; ok {
+					tombstones[key] = true
+				}
+				return nil
+			},
+		); err != nil {
+			return nil, errors.Wrapf(err, "for each key in segment %d", older)
+		}
+	}
+
+	return tombstones, nil
+}
+
+// writeCompacted returns an index of the blocks that it wrote, along with
+// how many records it wrote to the compacted segment.
+func (f *Filestore) writeCompacted(
+	segment int,
+	blocks []liveBlock,
+	tombstones map[string]bool,
+	dataFilename, metaFilename string,
+) (map[string]metastore.Block, int, error) {
+	dataFile, err := os.OpenFile(dataFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "open data file")
+	}
+	defer dataFile.Close()
+
+	metaFile, err := os.OpenFile(metaFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "open meta file")
+	}
+	defer metaFile.Close()
+
+	data := datastore.New(dataFile)
+	meta := metastore.New(metaFile)
+	index := make(map[string]metastore.Block, len(blocks))
+	written := 0
+	for _, lb := range blocks {
+		deleted := lb.block.Kind == metastore.BlockKindDelete
+		if lb.segment() != segment {
+			b, err := meta.WriteBlock(lb.block)
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "write block")
+			}
+			if !deleted {
+				index[lb.key] = b
+			}
+			continue
+		}
+
+		if deleted && !tombstones[lb.key] {
+			continue
+		}
+
+		op, value := datastore.OpDelete, ""
+		if !deleted {
+			op = datastore.OpSet
+			if value, err = f.readValue(lb.block); err != nil {
+				return nil, 0, errors.Wrap(err, "read value")
+			}
+		}
+
+		data.WriteKeyValue(
+			op,
+			lb.header.Seq,
+			lb.key,
+			value,
+			func(key, value string, keyOffset, valueOffset uint64) {
+				keyOffset = datastore.Address(segment, int64(keyOffset))
+				valueOffset = datastore.Address(segment, int64(valueOffset))
+				if deleted {
+					_, err = meta.WriteTombstone(key, keyOffset)
+				} else {
+					index[key], err = meta.Write(key, value, keyOffset, valueOffset)
+				}
+			},
+			func(err0 error) {
+				err = errors.Wrap(err0, "write key/value data")
+			},
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		written++
+	}
+
+	if err := data.Sync(); err != nil {
+		return nil, 0, errors.Wrap(err, "sync data file")
+	}
+
+	if err := meta.Sync(); err != nil {
+		return nil, 0, errors.Wrap(err, "sync meta file")
+	}
+
+	return index, written, nil
+}
@@ -1,86 +1,703 @@
 package datastore
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 
+	"github.com/ankeesler/andb/fileutil"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Datastore appends records to a series of numbered segments, rolling over
+// to a new one once the active segment is big enough. Segment 0 is the data
+// file itself; see SegmentFilename for the rest.
 type Datastore struct {
-	file  *os.File
-	mutex *sync.Mutex // TODO: this should be a file lock
+	name        string
+	mode        OpenMode
+	segmentSize int64
+
+	// segments holds the segment files that have been opened so far, and
+	// active is the one being appended to.
+	segments map[int]*os.File
+	active   int
+
+	// tail is where the next record goes in the active segment. It is only
+	// read from disk when the active segment is opened.
+	tail int64
+
+	// activeHint holds the hint entries for the records in the active
+	// segment, so that its hint file can be written out when it is rolled
+	// over without reading it back.
+	activeHint *hint
+
+	// Records are written, and values read, with positional I/O, so nothing
+	// shares a file offset. mutex guards segments and active: readers, and
+	// scans, share it while they read, and it is only held exclusively to
+	// open, roll over, or close segments. writeMutex serializes appends, and
+	// guards segmentSize, tail, and activeHint. It is always taken before
+	// mutex. Other processes are kept out by the store dir lock.
+	mutex      *sync.RWMutex
+	writeMutex *sync.Mutex
 }
 
+type OpenMode int
+
+const (
+	// ReadWrite opens the data file for appending, creating it if it does not
+	// exist yet.
+	ReadWrite OpenMode = iota
+	// ReadOnly opens an existing data file, and never creates or changes it.
+	ReadOnly
+)
+
+var (
+	errReadOnly = errors.New("data file is open read-only")
+	errScanDone = errors.New("scan done")
+)
+
+// New wraps an empty data file that has already been opened for reading and
+// writing. It is never rolled over into segments.
 func New(file *os.File) *Datastore {
 	return &Datastore{
-		file:  file,
-		mutex: &sync.Mutex{},
+		name:       file.Name(),
+		mode:       ReadWrite,
+		segments:   map[int]*os.File{0: file},
+		activeHint: &hint{},
+		mutex:      &sync.RWMutex{},
+		writeMutex: &sync.Mutex{},
+	}
+}
+
+// Open opens the data file at the provided path in the provided mode, along
+// with its segments.
+func Open(filename string, mode OpenMode) (*Datastore, error) {
+	d := &Datastore{
+		name:        filename,
+		mode:        mode,
+		segmentSize: DefaultSegmentSize,
+		activeHint:  &hint{},
+		mutex:       &sync.RWMutex{},
+		writeMutex:  &sync.Mutex{},
+	}
+	if err := d.openSegments(); err != nil {
+		return nil, err
+	}
+
+	if err := d.statTail(); err != nil {
+		d.closeSegments()
+		return nil, err
+	}
+
+	// The records already in the active segment are only read for its hint
+	// file once it rolls over, so that opening the store does not have to.
+	d.activeHint.unscanned = d.tail
+
+	return d, nil
+}
+
+func (mode OpenMode) flag() int {
+	if mode == ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR | os.O_CREATE
+}
+
+// openSegments opens the data file and every segment after it, and makes
+// the last one active.
+func (d *Datastore) openSegments() error {
+	file, err := os.OpenFile(d.name, d.mode.flag(), 0600)
+	if err != nil {
+		return errors.Wrap(err, "open file")
+	}
+	d.segments, d.active = map[int]*os.File{0: file}, 0
+
+	segments, err := findSegments(d.name)
+	if err != nil {
+		d.closeSegments()
+		return errors.Wrap(err, "find segments")
+	}
+
+	for _, segment := range segments {
+		if _, err := d.file(segment); err != nil {
+			d.closeSegments()
+			return err
+		}
+		d.active = segment
+	}
+
+	return nil
+}
+
+// file returns the provided segment, opening it if it has not been opened
+// yet, e.g., when another process has rolled over to it.
+func (d *Datastore) file(segment int) (*os.File, error) {
+	if file, ok := d.segments[segment]; ok {
+		return file, nil
+	}
+
+	file, err := os.OpenFile(SegmentFilename(d.name, segment), d.mode.flag()&^os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open segment %d", segment)
+	}
+	d.segments[segment] = file
+
+	return file, nil
+}
+
+// rlockSegment read-locks d.mutex and returns the provided segment, opening
+// it first if it has not been opened yet, e.g., when another process has
+// rolled over to it. The caller must read-unlock d.mutex once it is done with
+// the segment.
+func (d *Datastore) rlockSegment(segment int) (*os.File, error) {
+	for {
+		d.mutex.RLock()
+		if file, ok := d.segments[segment]; ok {
+			return file, nil
+		}
+		d.mutex.RUnlock()
+
+		d.mutex.Lock()
+		_, err := d.file(segment)
+		d.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// statTail reads where the active segment ends, after it has been opened.
+func (d *Datastore) statTail() error {
+	info, err := d.segments[d.active].Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat active segment")
+	}
+	d.tail = info.Size()
+
+	return nil
+}
+
+func (d *Datastore) closeSegments() error {
+	var firstErr error
+	for segment, file := range d.segments {
+		if err := file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(d.segments, segment)
+	}
+	return firstErr
+}
+
+// SetSegmentSize sets how big the active segment gets before writes roll
+// over to a new one. Zero never rolls over.
+func (d *Datastore) SetSegmentSize(size int64) {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+
+	d.segmentSize = size
+}
+
+// Name returns the path of the data file, i.e., segment 0.
+func (d *Datastore) Name() string {
+	return d.name
+}
+
+func (d *Datastore) Close() error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.closeSegments()
+}
+
+// Size returns the number of bytes in every segment put together.
+func (d *Datastore) Size() (int64, error) {
+	total := int64(0)
+	for _, segment := range d.Segments() {
+		size, err := d.SegmentSize(segment)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+
+	return total, nil
+}
+
+// Segments returns the numbers of the open segments, in order.
+func (d *Datastore) Segments() []int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.sortedSegments()
+}
+
+// ActiveSegment returns the number of the segment being appended to.
+func (d *Datastore) ActiveSegment() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.active
+}
+
+// SegmentSize returns the number of bytes in the provided segment.
+func (d *Datastore) SegmentSize(segment int) (int64, error) {
+	file, err := d.rlockSegment(segment)
+	if err != nil {
+		return 0, err
+	}
+	defer d.mutex.RUnlock()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "stat")
 	}
+
+	return info.Size(), nil
 }
 
+// Sync flushes the active segment to disk. Segments are synced when they
+// are rolled over, so it is the only one that can have unsynced writes.
+func (d *Datastore) Sync() error {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.segments[d.active].Sync()
+}
+
+// Truncate throws away everything in the active segment past the provided
+// size.
+func (d *Datastore) Truncate(size int64) error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	if d.mode == ReadOnly {
+		return errReadOnly
+	}
+
+	file := d.segments[d.active]
+	if err := file.Truncate(size); err != nil {
+		return errors.Wrap(err, "truncate")
+	}
+	d.tail = size
+	d.activeHint.truncate(size)
+
+	return file.Sync()
+}
+
+// Reopen closes the underlying files and opens whatever segments are now
+// at their paths, in the same mode, e.g., after a compacted segment has been
+// renamed over one. Unlike Open, it never creates the data file.
+func (d *Datastore) Reopen() error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	old, active := d.segments, d.active
+	d.segments = map[int]*os.File{}
+	if err := d.openSegments(); err != nil {
+		d.segments, d.active = old, active
+		return err
+	}
+	if err := d.statTail(); err != nil {
+		d.closeSegments()
+		d.segments, d.active = old, active
+		return err
+	}
+
+	for _, file := range old {
+		if err := file.Close(); err != nil {
+			log.Warnf("close replaced data file: %s", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Roll closes the active segment and starts appending to a new one.
+func (d *Datastore) Roll() error {
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
+
+	if d.mode == ReadOnly {
+		return errReadOnly
+	}
+
+	d.mutex.Lock()
+	closed, h, err := d.roll()
+	d.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return d.writeClosedHint(closed, h)
+}
+
+// roll syncs the active segment and creates the next one, and returns the
+// hint entries for the old one, so that the active segment never has a hint
+// file. It must be called with both d.writeMutex and d.mutex held, and the
+// caller writes the hint file with writeClosedHint once it has let go of
+// d.mutex.
+func (d *Datastore) roll() (int, *hint, error) {
+	closed := d.active
+	if err := d.segments[closed].Sync(); err != nil {
+		return 0, nil, errors.Wrap(err, "sync segment")
+	}
+
+	next := closed + 1
+	file, err := os.OpenFile(SegmentFilename(d.name, next), d.mode.flag(), 0600)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "create segment")
+	}
+	d.segments[next], d.active, d.tail = file, next, 0
+
+	if err := fileutil.SyncDir(filepath.Dir(d.name)); err != nil {
+		return 0, nil, errors.Wrap(err, "sync dir")
+	}
+
+	log.Infof("rolled over from segment %d to segment %d", closed, next)
+
+	h := d.activeHint
+	d.activeHint = &hint{}
+	return closed, h, nil
+}
+
+// writeClosedHint writes the hint file for a segment that has just been
+// rolled over, reading the keys that were in it before it was opened first.
+func (d *Datastore) writeClosedHint(segment int, h *hint) error {
+	if h.unscanned > 0 {
+		before := &hint{}
+		if _, err := d.scan(segment, false, func(header RecordHeader, keyPosition int64, key, _ string) error {
+			if keyPosition-int64(RecordHeaderSize) >= h.unscanned {
+				return errScanDone
+			}
+			before.add(header, keyPosition, key)
+			return nil
+		}); err != nil && errors.Cause(err) != errScanDone {
+			return errors.Wrap(err, "scan segment")
+		}
+
+		h.entries = append(before.entries, h.entries...)
+		h.keys = append(before.keys, h.keys...)
+		h.unscanned = 0
+	}
+
+	return errors.Wrap(
+		writeHint(HintFilename(SegmentFilename(d.name, segment)), h),
+		"write hint",
+	)
+}
+
+// WriteHint rewrites the hint file of the provided closed segment, e.g.,
+// after it has been compacted. It reads the segment's keys to do so.
+func (d *Datastore) WriteHint(segment int) error {
+	if d.mode == ReadOnly {
+		return errReadOnly
+	}
+
+	if segment == d.ActiveSegment() {
+		return fmt.Errorf("segment %d is active", segment)
+	}
+
+	h := &hint{}
+	if _, err := d.scan(segment, false, func(header RecordHeader, keyPosition int64, key, _ string) error {
+		h.add(header, keyPosition, key)
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "scan segment")
+	}
+
+	return d.writeClosedHint(segment, h)
+}
+
+// RemoveSegment removes a closed segment, along with its hint file, once
+// nothing points into it anymore. Segment 0 is never removed.
+func (d *Datastore) RemoveSegment(segment int) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.mode == ReadOnly {
+		return errReadOnly
+	}
+
+	if segment == 0 || segment == d.active {
+		return fmt.Errorf("cannot remove segment %d", segment)
+	}
+
+	filename := SegmentFilename(d.name, segment)
+	if err := os.Remove(HintFilename(filename)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "remove hint file")
+	}
+
+	if file, ok := d.segments[segment]; ok {
+		file.Close()
+		delete(d.segments, segment)
+	}
+	if err := os.Remove(filename); err != nil {
+		return errors.Wrap(err, "remove segment")
+	}
+
+	return errors.Wrap(fileutil.SyncDir(filepath.Dir(d.name)), "sync dir")
+}
+
+// WriteKeyValue appends a record holding the key and value to the active
+// segment, rolling over to a new one first if it is big enough. The
+// addresses passed to onSuccess point past the record's header.
 func (d *Datastore) WriteKeyValue(
+	op Op,
+	seq uint64,
 	key, value string,
-	onSuccess func(key, value string, keyOffset, valueOffset uint32),
+	onSuccess func(key, value string, keyOffset, valueOffset uint64),
 	onError func(error),
 ) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+	d.writeMutex.Lock()
+	defer d.writeMutex.Unlock()
 
 	log.Debugf("begin write key/value data: %s => %s", key, value)
 	defer log.Debugf("end write key/value data: %s => %s", key, value)
 
-	_, err := d.file.Seek(0, 2)
-	if err != nil {
-		onError(errors.Wrap(err, "seek to end"))
+	if d.mode == ReadOnly {
+		onError(errReadOnly)
 		return
 	}
 
-	keyOffset, err := d.file.Seek(0, 1)
-	if err != nil {
-		onError(errors.Wrap(err, "seek (key)"))
+	if d.segmentSize > 0 && d.tail >= d.segmentSize {
+		d.mutex.Lock()
+		closed, closedHint, err := d.roll()
+		d.mutex.Unlock()
+		if err == nil {
+			err = d.writeClosedHint(closed, closedHint)
+		}
+		if err != nil {
+			onError(errors.Wrap(err, "roll segment"))
+			return
+		}
+	}
+
+	h := newRecordHeader(op, seq, key, value)
+	buf := bytes.NewBuffer(make([]byte, 0, h.Size()))
+	if err := binary.Write(buf, recordByteOrder, &h); err != nil {
+		onError(errors.Wrap(err, "encode header"))
 		return
 	}
+	buf.WriteString(key)
+	buf.WriteString(value)
 
-	_, err = d.file.Write([]byte(key))
+	// Readers only ever look at records that have been written, so they can
+	// keep reading while this one is. If it fails, the tail stays put, and
+	// the next record is written over whatever part of this one made it.
+	offset := d.tail
+	d.mutex.RLock()
+	segment := d.active
+	_, err := d.segments[segment].WriteAt(buf.Bytes(), offset)
+	d.mutex.RUnlock()
 	if err != nil {
-		onError(errors.Wrap(err, "write (key)"))
+		onError(errors.Wrap(err, "write record"))
 		return
 	}
+	d.tail += h.Size()
+
+	d.activeHint.add(h, offset+int64(RecordHeaderSize), key)
 
-	valueOffset, err := d.file.Seek(0, 1)
+	keyOffset := Address(segment, offset+int64(RecordHeaderSize))
+	valueOffset := keyOffset + uint64(len(key))
+	onSuccess(key, value, keyOffset, valueOffset)
+}
+
+// ReadHeader returns the header of the record whose key is at the provided
+// address.
+func (d *Datastore) ReadHeader(keyOffset uint64) (RecordHeader, error) {
+	if _, position := SplitAddress(keyOffset); position < int64(RecordHeaderSize) {
+		return RecordHeader{}, fmt.Errorf("incorrect key offset (%d) for record header", keyOffset)
+	}
+
+	data, err := d.ReadData(keyOffset-uint64(RecordHeaderSize), uint32(RecordHeaderSize))
 	if err != nil {
-		onError(errors.Wrap(err, "seek (value)"))
-		return
+		return RecordHeader{}, errors.Wrap(err, "read data")
+	}
+
+	h := RecordHeader{}
+	if err := h.decode([]byte(data)); err != nil {
+		return RecordHeader{}, err
 	}
 
-	_, err = d.file.Write([]byte(value))
+	return h, nil
+}
+
+// ForEachRecord calls the provided handler with every intact record in
+// every segment, in order, along with the address of its key. It skips over
+// anything that is not an intact record, and returns how many bytes it
+// skipped. Reads and writes carry on while it runs, but the handler must not
+// call back into the datastore.
+func (d *Datastore) ForEachRecord(
+	recordHandler func(h RecordHeader, keyOffset uint64, key, value string) error,
+) (int64, error) {
+	skipped := int64(0)
+	for _, segment := range d.Segments() {
+		n, err := d.scan(segment, true, func(h RecordHeader, keyPosition int64, key, value string) error {
+			return recordHandler(h, Address(segment, keyPosition), key, value)
+		})
+		skipped += n
+		if err != nil {
+			return skipped, err
+		}
+	}
+
+	return skipped, nil
+}
+
+// ForEachKey is like ForEachRecord, but it never reads values: closed
+// segments are read from their hint files, if they are intact, and the rest
+// only have their headers and keys read.
+func (d *Datastore) ForEachKey(
+	keyHandler func(h RecordHeader, keyOffset uint64, key string) error,
+) (int64, error) {
+	skipped := int64(0)
+	for _, segment := range d.Segments() {
+		n, err := d.ForEachKeyIn(segment, keyHandler)
+		skipped += n
+		if err != nil {
+			return skipped, err
+		}
+	}
+
+	return skipped, nil
+}
+
+// ForEachKeyIn is ForEachKey for a single segment.
+func (d *Datastore) ForEachKeyIn(
+	segment int,
+	keyHandler func(h RecordHeader, keyOffset uint64, key string) error,
+) (int64, error) {
+	if segment != d.ActiveSegment() {
+		hintFilename := HintFilename(SegmentFilename(d.name, segment))
+		entries, keys, err := readHint(hintFilename)
+		if err == nil {
+			for i, e := range entries {
+				if err := keyHandler(e.Header, Address(segment, e.KeyPosition), keys[i]); err != nil {
+					return 0, errors.Wrap(err, "key handler")
+				}
+			}
+			return 0, nil
+		}
+		log.Warnf("reading segment %d instead of its hint file %s: %s", segment, hintFilename, err.Error())
+	}
+
+	return d.scan(segment, false, func(h RecordHeader, keyPosition int64, key, _ string) error {
+		return keyHandler(h, Address(segment, keyPosition), key)
+	})
+}
+
+func (d *Datastore) sortedSegments() []int {
+	segments := make([]int, 0, len(d.segments))
+	for segment := range d.segments {
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	return segments
+}
+
+// scan calls the provided handler with every intact record in the provided
+// segment, along with the position of its key. Values are only read (and
+// checked) if withValues is set. It returns how many bytes it skipped. The
+// handler is called with d.mutex read-locked.
+func (d *Datastore) scan(
+	segment int,
+	withValues bool,
+	recordHandler func(h RecordHeader, keyPosition int64, key, value string) error,
+) (int64, error) {
+	file, err := d.rlockSegment(segment)
 	if err != nil {
-		onError(errors.Wrap(err, "write (value)"))
-		return
+		return 0, err
 	}
+	defer d.mutex.RUnlock()
 
-	if err := d.file.Sync(); err != nil {
-		onError(errors.Wrap(err, "sync"))
-		return
+	info, err := file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "stat")
+	}
+
+	var offset, skipped int64
+	for offset+int64(RecordHeaderSize) <= info.Size() {
+		h, key, value, err := readRecordAt(file, offset, info.Size(), withValues)
+		if err != nil {
+			log.Tracef("skipping byte at offset %d of segment %d: %s", offset, segment, err.Error())
+			offset++
+			skipped++
+			continue
+		}
+
+		if err := recordHandler(h, offset+int64(RecordHeaderSize), key, value); err != nil {
+			return skipped, errors.Wrap(err, "record handler")
+		}
+
+		offset += h.Size()
 	}
 
-	onSuccess(key, value, uint32(keyOffset), uint32(valueOffset))
+	return skipped + info.Size() - offset, nil
 }
 
-func (d *Datastore) ReadData(offset, length uint32) (string, error) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
+func readRecordAt(file *os.File, offset, size int64, withValue bool) (RecordHeader, string, string, error) {
+	data := make([]byte, RecordHeaderSize)
+	if _, err := file.ReadAt(data, offset); err != nil {
+		return RecordHeader{}, "", "", errors.Wrap(err, "read header")
+	}
+
+	h := RecordHeader{}
+	if err := h.decode(data); err != nil {
+		return RecordHeader{}, "", "", err
+	}
 
-	if _, err := d.file.Seek(int64(offset), 0); err != nil {
-		return "", errors.Wrap(err, "seek")
+	if offset+h.Size() > size {
+		return RecordHeader{}, "", "", io.ErrUnexpectedEOF
+	}
+
+	length := h.KeyLength
+	if withValue {
+		length += h.ValueLength
+	}
+	data = make([]byte, length)
+	if _, err := file.ReadAt(data, offset+int64(RecordHeaderSize)); err != nil {
+		return RecordHeader{}, "", "", errors.Wrap(err, "read key/value")
+	}
+
+	key, value := string(data[:h.KeyLength]), string(data[h.KeyLength:])
+	if crc32.ChecksumIEEE([]byte(key)) != h.KeyCRC32 {
+		return RecordHeader{}, "", "", errors.New("incorrect key crc32")
+	}
+	if withValue && crc32.ChecksumIEEE([]byte(value)) != h.ValueCRC32 {
+		return RecordHeader{}, "", "", errors.New("incorrect value crc32")
+	}
+
+	return h, key, value, nil
+}
+
+// ReadData returns the provided number of bytes at the provided address.
+// Any number of reads can run at once, and alongside a write.
+func (d *Datastore) ReadData(offset uint64, length uint32) (string, error) {
+	segment, position := SplitAddress(offset)
+
+	file, err := d.rlockSegment(segment)
+	if err != nil {
+		return "", err
 	}
+	defer d.mutex.RUnlock()
 
 	data := make([]byte, length)
-	if _, err := io.ReadFull(d.file, data); err != nil {
-		return "", errors.Wrap(err, "read full")
+	if _, err := file.ReadAt(data, position); err != nil {
+		return "", errors.Wrap(err, "read at")
 	}
 
 	return string(data), nil
@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+type Op uint32
+
+const (
+	OpSet Op = iota
+	OpDelete
+)
+
+// RecordMagic starts every record in the data file ("ANDB").
+const RecordMagic = 0x414E4442
+
+// RecordHeader precedes every key and value in the data file, so that the
+// data file can be read (and the meta file rebuilt) without the meta file.
+// Its CRC32 covers the rest of the header.
+type RecordHeader struct {
+	Magic                   uint32
+	Op                      Op
+	Seq                     uint64
+	KeyLength, KeyCRC32     uint32
+	ValueLength, ValueCRC32 uint32
+	CRC32                   uint32
+}
+
+// RecordHeaderSize is the number of bytes that a RecordHeader takes up on
+// disk.
+var RecordHeaderSize = binary.Size(&RecordHeader{})
+
+var recordByteOrder = binary.BigEndian
+
+func newRecordHeader(op Op, seq uint64, key, value string) RecordHeader {
+	h := RecordHeader{
+		Magic:       RecordMagic,
+		Op:          op,
+		Seq:         seq,
+		KeyLength:   uint32(len(key)),
+		KeyCRC32:    crc32.ChecksumIEEE([]byte(key)),
+		ValueLength: uint32(len(value)),
+		ValueCRC32:  crc32.ChecksumIEEE([]byte(value)),
+	}
+	h.CRC32 = h.calculateCRC32()
+	return h
+}
+
+func (h RecordHeader) calculateCRC32() uint32 {
+	h.CRC32 = 0
+
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, recordByteOrder, &h)
+
+	return crc32.ChecksumIEEE(buf.Bytes())
+}
+
+func (h *RecordHeader) decode(data []byte) error {
+	if err := binary.Read(bytes.NewReader(data), recordByteOrder, h); err != nil {
+		return err
+	}
+
+	if h.Magic != RecordMagic {
+		return fmt.Errorf("incorrect record magic (0x%08X)", h.Magic)
+	}
+
+	if crc := h.calculateCRC32(); crc != h.CRC32 {
+		return fmt.Errorf("incorrect record crc32 (0x%08X != 0x%08X)", h.CRC32, crc)
+	}
+
+	return nil
+}
+
+// Size returns the number of bytes that the whole record takes up on disk.
+func (h RecordHeader) Size() int64 {
+	return int64(RecordHeaderSize) + int64(h.KeyLength) + int64(h.ValueLength)
+}
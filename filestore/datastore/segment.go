@@ -0,0 +1,207 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+)
+
+// DefaultSegmentSize is how big the active segment gets before writes roll
+// over to a new one.
+const DefaultSegmentSize = 1 << 30
+
+// Offsets handed out by the datastore are addresses: the segment number in
+// the top bits, and the position in that segment in the rest. Segment 0 is
+// the data file itself, so the offsets in a store written before there were
+// segments are still valid addresses.
+const (
+	segmentShift = 48
+	positionMask = 1<<segmentShift - 1
+)
+
+// Address returns the address of the provided position in the provided
+// segment.
+func Address(segment int, position int64) uint64 {
+	return uint64(segment)<<segmentShift | uint64(position)
+}
+
+// SplitAddress returns the segment and position that the provided address
+// points to.
+func SplitAddress(address uint64) (int, int64) {
+	return int(address >> segmentShift), int64(address & positionMask)
+}
+
+// SegmentFilename returns the path of the provided segment of the data file
+// at the provided path, e.g., andbdata.000001.bin for segment 1 of
+// andbdata.bin.
+func SegmentFilename(filename string, segment int) string {
+	if segment == 0 {
+		return filename
+	}
+
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s.%06d%s", strings.TrimSuffix(filename, ext), segment, ext)
+}
+
+// HintFilename returns the path of the hint file for the segment at the
+// provided path.
+func HintFilename(segmentFilename string) string {
+	return strings.TrimSuffix(segmentFilename, filepath.Ext(segmentFilename)) + ".hint"
+}
+
+// findSegments returns the numbers of the segments after segment 0 that
+// exist next to the data file at the provided path, in order.
+func findSegments(filename string) ([]int, error) {
+	ext := filepath.Ext(filename)
+	prefix := strings.TrimSuffix(filename, ext) + "."
+	matches, err := filepath.Glob(prefix + "[0-9][0-9][0-9][0-9][0-9][0-9]" + ext)
+	if err != nil {
+		return nil, errors.Wrap(err, "glob")
+	}
+
+	segments := []int{}
+	for _, match := range matches {
+		segment, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, prefix), ext))
+		if err != nil || segment == 0 {
+			continue
+		}
+		segments = append(segments, segment)
+	}
+	sort.Ints(segments)
+
+	return segments, nil
+}
+
+// SegmentFiles returns the paths of the files that go along with the data
+// file at the provided path, i.e., the segments after it and every hint
+// file, that exist.
+func SegmentFiles(filename string) ([]string, error) {
+	segments, err := findSegments(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	filenames := []string{}
+	for _, segment := range append([]int{0}, segments...) {
+		segmentFilename := SegmentFilename(filename, segment)
+		if segment != 0 {
+			filenames = append(filenames, segmentFilename)
+		}
+
+		hintFilename := HintFilename(segmentFilename)
+		if _, err := os.Stat(hintFilename); err == nil {
+			filenames = append(filenames, hintFilename)
+		} else if !os.IsNotExist(err) {
+			return nil, errors.Wrap(err, "stat hint file")
+		}
+	}
+
+	return filenames, nil
+}
+
+// A hint file lists the record headers and keys in a closed segment, so that
+// its keys can be read without reading its values. Each entry is a hintEntry
+// followed by the key, and the file ends with the crc32 of everything
+// before it.
+type hintEntry struct {
+	KeyPosition int64
+	Header      RecordHeader
+}
+
+// hint collects the entries of a segment's hint file as its records are
+// written (or scanned), so that it can be written out without reading the
+// segment back. The entries for the first unscanned bytes of the segment,
+// which were written before it was opened, are missing.
+type hint struct {
+	entries   []hintEntry
+	keys      []string
+	unscanned int64
+}
+
+func (h *hint) add(header RecordHeader, keyPosition int64, key string) {
+	h.entries = append(h.entries, hintEntry{KeyPosition: keyPosition, Header: header})
+	h.keys = append(h.keys, key)
+}
+
+// truncate drops the entries for records that do not fit in the provided
+// number of bytes.
+func (h *hint) truncate(size int64) {
+	n := len(h.entries)
+	for n > 0 {
+		e := h.entries[n-1]
+		if e.KeyPosition-int64(RecordHeaderSize)+e.Header.Size() <= size {
+			break
+		}
+		n--
+	}
+	h.entries, h.keys = h.entries[:n], h.keys[:n]
+
+	if h.unscanned > size {
+		h.unscanned = size
+	}
+}
+
+func writeHint(filename string, h *hint) error {
+	buf := bytes.NewBuffer([]byte{})
+	for i := range h.entries {
+		if err := binary.Write(buf, recordByteOrder, &h.entries[i]); err != nil {
+			return errors.Wrap(err, "encode entry")
+		}
+		buf.WriteString(h.keys[i])
+	}
+	if err := binary.Write(buf, recordByteOrder, crc32.ChecksumIEEE(buf.Bytes())); err != nil {
+		return errors.Wrap(err, "encode crc32")
+	}
+
+	return fileutil.ReplaceFile(filename, func(file *os.File) error {
+		_, err := file.Write(buf.Bytes())
+		return err
+	})
+}
+
+// readHint returns the entries in the hint file at the provided path, or an
+// error if it is missing or corrupt.
+func readHint(filename string) ([]hintEntry, []string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(data) < 4 {
+		return nil, nil, errors.New("hint file is too short")
+	}
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != recordByteOrder.Uint32(trailer) {
+		return nil, nil, errors.New("incorrect hint file crc32")
+	}
+
+	entries, keys := []hintEntry{}, []string{}
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		e := hintEntry{}
+		if err := binary.Read(r, recordByteOrder, &e); err != nil {
+			return nil, nil, errors.Wrap(err, "decode entry")
+		}
+
+		key := make([]byte, e.Header.KeyLength)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, nil, errors.Wrap(err, "read key")
+		}
+
+		entries = append(entries, e)
+		keys = append(keys, string(key))
+	}
+
+	return entries, keys, nil
+}
@@ -1,51 +1,204 @@
 package filestore
 
 import (
+	"bytes"
 	"fmt"
 	"hash/crc32"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/manifest"
 	"github.com/ankeesler/andb/filestore/metastore"
-	"github.com/ankeesler/andb/memstore"
+	api "github.com/ankeesler/andb/server"
+	"github.com/ankeesler/andb/wal"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+// Cache holds values in memory in front of the data file. It must be
+// goroutine-safe, since readers call it without any lock that is shared
+// across keys.
+type Cache interface {
+	Get(string) (string, error)
+	Set(string, string) error
+	Delete(string) error
+}
+
+type Mode int
+
+const (
+	// ModeFull loads every value into the cache on startup.
+	ModeFull Mode = iota
+	// ModeIndexOnly only loads the index on startup, and reads values from
+	// the data file as they are asked for.
+	ModeIndexOnly
+)
+
 type Filestore struct {
-	cache memstore.Memstore
+	// seq numbers the writes. It is updated atomically, so it comes first,
+	// where it is 64-bit aligned.
+	seq uint64
+
+	cache Cache
+	mode  Mode
 	data  *datastore.Datastore
 	meta  *metastore.Metastore
-	mutex *sync.Mutex
-	// TODO: this shouldn't be global
-	// esp when there is locking below
+	wal   *wal.WAL
+
+	// writeLocks are striped over the keys. Writers hold the stripe for their
+	// key while they hand their write to the committer, so that writes to a
+	// key are queued in the order that they become pending. Nothing holds
+	// them across disk I/O, and readers do not take them at all.
+	writeLocks []*sync.Mutex
+
+	// files is held for reading while the data and meta files are being
+	// read together, and for writing while compaction swaps them out.
+	files *sync.RWMutex
+
+	// shards map each key to its latest block in the meta file, and hold
+	// the writes that the committer has not applied yet. They are striped
+	// over the keys like writeLocks, each with its own mutex, since the
+	// committer updates them. Readers only fill the cache from disk with
+	// their key's shard locked, and only if the block that they read is
+	// still the key's latest.
+	shards []*indexShard
+
+	// loadErr is set if the store could not be loaded from disk on startup,
+	// in which case the committer never starts, so that nothing is written
+	// over a store that was not loaded and the wal is never truncated before
+	// it has been replayed. Followers clear it once they manage to load the
+	// store, so it is guarded by statusMutex.
+	loadErr error
+
+	// readOnly is set for followers, which serve reads from a store that
+	// another process writes to. followOffset is how far into the meta file
+	// they have read; it is only touched by the follower goroutine.
+	readOnly     bool
+	followOffset int64
+
+	// queue holds the commits waiting for the committer, which queueC wakes
+	// up.
+	queue      []*commit
+	queueMutex *sync.Mutex
+	queueC     chan struct{}
+
+	// failures holds the errors from commits since the last barrier. It is
+	// only touched by the committer.
+	failures []string
+
+	// manifest is set for stores opened with Open, and lists the data file's
+	// segments, which were recordedSegments when they were last listed. Both
+	// are only touched by the committer once it has started.
+	manifest         *manifest.Manifest
+	recordedSegments []int
+
+	// degraded is set once a write has failed, after which the store is
+	// read-only. It is guarded by statusMutex.
+	degraded    error
+	statusMutex *sync.Mutex
+}
+
+// FailuresFile records every write that has failed, one per line, in the
+// store dir. While it exists, the store is degraded and read-only; it should
+// be removed once the failures have been dealt with.
+const FailuresFile = "andbfailures.log"
+
+const writeLockStripes = 64
 
-	workC chan *work
+// indexShard holds the index and the pending writes for one stripe of keys.
+type indexShard struct {
+	mutex   *sync.Mutex
+	index   map[string]metastore.Block
+	pending map[string]pendingWrite
+}
+
+type pendingWrite struct {
+	seq     uint64
+	value   string
+	deleted bool
 }
 
 func New(
-	cache memstore.Memstore,
+	cache Cache,
 	data *datastore.Datastore,
 	meta *metastore.Metastore,
+	wal *wal.WAL,
+	mode Mode,
 ) *Filestore {
-	f := &Filestore{
+	f := newFilestore(cache, data, meta, wal, mode)
+	f.start()
+	return f
+}
+
+// start loads the store, and starts the committer if it could.
+func (f *Filestore) start() {
+	if err := f.loadFailures(); err != nil {
+		f.degrade(err)
+	}
+
+	if err := f.recoverTornTail(); err != nil {
+		log.Errorf("recover torn tail: %s", err.Error())
+		f.loadErr = errors.Wrap(err, "recover torn tail")
+	} else if err := f.loadStore(); err != nil {
+		log.Errorf("load store: %s", err.Error())
+		f.loadErr = err
+	} else if err := f.replay(); err != nil {
+		log.Errorf("replay wal: %s", err.Error())
+		f.loadErr = errors.Wrap(err, "replay wal")
+	}
+
+	if f.loadErr != nil {
+		return
+	}
+
+	if err := f.recordSegments(); err != nil {
+		log.Warnf("record segments: %s", err.Error())
+	}
+	f.startCommitter()
+}
+
+func newFilestore(
+	cache Cache,
+	data *datastore.Datastore,
+	meta *metastore.Metastore,
+	wal *wal.WAL,
+	mode Mode,
+) *Filestore {
+	writeLocks := make([]*sync.Mutex, writeLockStripes)
+	shards := make([]*indexShard, writeLockStripes)
+	for i := range writeLocks {
+		writeLocks[i] = &sync.Mutex{}
+		shards[i] = &indexShard{
+			mutex:   &sync.Mutex{},
+			index:   make(map[string]metastore.Block),
+			pending: make(map[string]pendingWrite),
+		}
+	}
+
+	return &Filestore{
 		cache: cache,
+		mode:  mode,
 		data:  data,
 		meta:  meta,
-		mutex: &sync.Mutex{},
-	}
+		wal:   wal,
+		files: &sync.RWMutex{},
 
-	f.workC = make(chan *work)
-	newWorker(f.workC).start()
+		writeLocks: writeLocks,
+		shards:     shards,
 
-	return f
+		queueMutex: &sync.Mutex{},
+		queueC:     make(chan struct{}, 1),
+
+		statusMutex: &sync.Mutex{},
+	}
 }
 
 func (f *Filestore) Get(key string) (string, error) {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
 	log.Debugf("begin get %s", key)
 	defer log.Debugf("end get %s", key)
 
@@ -53,127 +206,386 @@ func (f *Filestore) Get(key string) (string, error) {
 		return value, nil
 	}
 
-	if err := f.loadStore(); err != nil {
-		return "", errors.Wrap(err, "load store")
+	if err := f.loadError(); err != nil {
+		return "", err
 	}
 
-	if value, err := f.cache.Get(key); err != nil {
+	f.files.RLock()
+	defer f.files.RUnlock()
+
+	sh := f.shard(key)
+	sh.mutex.Lock()
+	p, pending := sh.pending[key]
+	b, indexed := sh.index[key]
+	sh.mutex.Unlock()
+
+	if pending {
+		if p.deleted {
+			return "", errors.New("not found")
+		}
+		return p.value, nil
+	}
+
+	if !indexed {
 		return "", errors.New("not found")
-	} else {
-		return value, nil
 	}
+
+	value, err := f.readValue(b)
+	if err != nil {
+		return "", errors.Wrap(err, "read value")
+	}
+
+	if err := f.cacheIfLatest(key, b, value); err != nil {
+		return "", err
+	}
+
+	return value, nil
 }
 
-func (f *Filestore) Set(key, value string) error {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
-
-	log.Debugf("begin set %s => %s", key, value)
-	defer log.Debugf("end set %s => %s", key, value)
-
-	f.workC <- &work{
-		description: fmt.Sprintf("set %s => %s", key, value),
-		action: func() error {
-			var err error
-			f.data.WriteKeyValue(
-				key,
-				value,
-				func(key, value string, keyOffset, valueOffset uint32) {
-					err = f.meta.Write(key, value, keyOffset, valueOffset)
-				},
-				func(err0 error) {
-					err = errors.Wrap(err0, "write key/value data")
-				},
-			)
-			return err
-		},
+// cacheIfLatest caches a value that was read from disk, unless a write to
+// its key has come in since its block was looked up.
+func (f *Filestore) cacheIfLatest(key string, b metastore.Block, value string) error {
+	sh := f.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if _, pending := sh.pending[key]; pending {
+		return nil
+	}
+	if latest, indexed := sh.index[key]; !indexed || latest != b {
+		return nil
+	}
+
+	return errors.Wrap(f.cache.Set(key, value), "cache set")
+}
+
+func (f *Filestore) Set(key, value string, durability api.Durability) error {
+	log.Debugf("begin set %s => %s (%s)", key, value, durability)
+	defer log.Debugf("end set %s => %s (%s)", key, value, durability)
+
+	return f.write(
+		fmt.Sprintf("set %s => %s", key, value),
+		wal.Record{Op: wal.OpSet, Key: key, Value: value},
+		durability,
+	)
+}
+
+func (f *Filestore) Delete(key string, durability api.Durability) error {
+	log.Debugf("begin delete %s (%s)", key, durability)
+	defer log.Debugf("end delete %s (%s)", key, durability)
+
+	return f.write(
+		fmt.Sprintf("delete %s", key),
+		wal.Record{Op: wal.OpDelete, Key: key},
+		durability,
+	)
+}
+
+// write hands the record off to the committer, updates the cache, and then
+// waits for the record to become as durable as was asked for.
+func (f *Filestore) write(
+	description string,
+	r wal.Record,
+	durability api.Durability,
+) error {
+	if f.readOnly {
+		return errors.New("store is read-only")
 	}
 
-	if err := f.cache.Set(key, value); err != nil {
-		return errors.Wrap(err, "cache set")
+	c, err := f.enqueueWrite(description, r, durability)
+	if err != nil {
+		return err
 	}
 
-	return nil
+	if durability == api.Durability_ASYNC {
+		return nil
+	}
+
+	return <-c.done
 }
 
-func (f *Filestore) Delete(key string) error {
-	f.mutex.Lock()
-	defer f.mutex.Unlock()
+func (f *Filestore) enqueueWrite(
+	description string,
+	r wal.Record,
+	durability api.Durability,
+) (*commit, error) {
+	writeLock := f.writeLock(r.Key)
+	writeLock.Lock()
+	defer writeLock.Unlock()
+
+	if err := f.loadError(); err != nil {
+		return nil, err
+	}
+	if err := f.Status(); err != nil {
+		return nil, errors.Wrap(err, "store is degraded")
+	}
 
-	log.Debugf("begin delete %s", key)
-	defer log.Debugf("end delete %s", key)
+	c := newCommit(commitWrite, description)
+	c.record = r
+	c.durability = durability
+	c.seq = f.addPending(r.Key, pendingWrite{
+		value:   r.Value,
+		deleted: r.Op == wal.OpDelete,
+	})
+	f.enqueue(c)
+
+	if r.Op == wal.OpDelete {
+		if err := f.cache.Delete(r.Key); err != nil {
+			return nil, errors.Wrap(err, "cache delete")
+		}
+	} else {
+		if err := f.cache.Set(r.Key, r.Value); err != nil {
+			return nil, errors.Wrap(err, "cache set")
+		}
+	}
 
-	f.workC <- &work{
-		description: fmt.Sprintf("delete %s", key),
-		action: func() error {
-			if err := f.meta.DeleteBlock(key); err != nil {
-				return errors.Wrap(err, "delete meta block")
-			}
+	return c, nil
+}
 
-			return nil
-		},
+// stripe returns which of the write locks and index shards the key belongs
+// to.
+func stripe(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % writeLockStripes
+}
+
+// writeLock returns the stripe of f.writeLocks that the key belongs to.
+func (f *Filestore) writeLock(key string) *sync.Mutex {
+	return f.writeLocks[stripe(key)]
+}
+
+// shard returns the index shard that the key belongs to.
+func (f *Filestore) shard(key string) *indexShard {
+	return f.shards[stripe(key)]
+}
+
+// addPending records a write that has been handed to the committer, and
+// returns its sequence number. It must be called with the key's write lock
+// held.
+func (f *Filestore) addPending(key string, p pendingWrite) uint64 {
+	sh := f.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	p.seq = atomic.AddUint64(&f.seq, 1)
+	sh.pending[key] = p
+
+	return p.seq
+}
+
+// applyPending updates the index with a block that the committer has
+// written, and forgets about the pending write if nothing newer has come in
+// since.
+func (f *Filestore) applyPending(key string, seq uint64, b metastore.Block) {
+	sh := f.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.indexBlock(key, b)
+
+	if p, ok := sh.pending[key]; ok && p.seq == seq {
+		delete(sh.pending, key)
 	}
+}
+
+// dropPending forgets about a pending write that failed, so that reads go
+// back to whatever is on disk.
+func (f *Filestore) dropPending(key string, seq uint64) {
+	writeLock := f.writeLock(key)
+	writeLock.Lock()
+	defer writeLock.Unlock()
 
 	if err := f.cache.Delete(key); err != nil {
-		return errors.Wrap(err, "cache delete")
+		log.Warnf("cache delete: %s", err.Error())
 	}
 
-	return nil
+	sh := f.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if p, ok := sh.pending[key]; ok && p.seq == seq {
+		delete(sh.pending, key)
+	}
+}
+
+// indexBlock makes the provided block the key's latest.
+func (f *Filestore) indexBlock(key string, b metastore.Block) {
+	sh := f.shard(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.indexBlock(key, b)
 }
 
+// indexBlock must be called with sh.mutex held.
+func (sh *indexShard) indexBlock(key string, b metastore.Block) {
+	if b.Kind == metastore.BlockKindDelete {
+		delete(sh.index, key)
+	} else {
+		sh.index[key] = b
+	}
+}
+
+// setIndex replaces the index, one shard at a time, and returns the keys
+// that it used to have but the new one does not. Callers hold f.files for
+// writing, so that no reader sees some shards replaced and not others.
+func (f *Filestore) setIndex(index map[string]metastore.Block) []string {
+	shardIndexes := make([]map[string]metastore.Block, len(f.shards))
+	for i := range shardIndexes {
+		shardIndexes[i] = make(map[string]metastore.Block)
+	}
+	for key, b := range index {
+		shardIndexes[stripe(key)][key] = b
+	}
+
+	dropped := []string{}
+	for i, sh := range f.shards {
+		sh.mutex.Lock()
+		for key := range sh.index {
+			if _, ok := index[key]; !ok {
+				dropped = append(dropped, key)
+			}
+		}
+		sh.index = shardIndexes[i]
+		sh.mutex.Unlock()
+	}
+
+	return dropped
+}
+
+// Sync waits for all of the writes before it to make it to disk, and
+// returns any errors that they ran into. Followers have no writes to wait
+// for.
 func (f *Filestore) Sync() error {
-	for {
-		if len(f.workC) == 0 {
-			break
-		} else {
-			time.Sleep(time.Second * 3)
+	if f.readOnly {
+		return nil
+	}
+	if err := f.loadError(); err != nil {
+		return err
+	}
+
+	c := newCommit(commitBarrier, "sync")
+	f.enqueue(c)
+	return <-c.done
+}
+
+// Status returns the error that degraded the store, or that kept it from
+// loading, if there is one.
+func (f *Filestore) Status() error {
+	if err := f.loadError(); err != nil {
+		return err
+	}
+
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+
+	return f.degraded
+}
+
+// loadError returns the error that kept the store from loading, if there is
+// one.
+func (f *Filestore) loadError() error {
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+
+	if f.loadErr == nil {
+		return nil
+	}
+	return errors.Wrap(f.loadErr, "load store")
+}
+
+func (f *Filestore) setLoadError(err error) {
+	f.statusMutex.Lock()
+	defer f.statusMutex.Unlock()
+
+	f.loadErr = err
+}
+
+// loadFailures returns an error if the failures file has anything in it.
+func (f *Filestore) loadFailures() error {
+	filename := f.failuresFilename()
+	failures, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrap(err, "read failures file")
+	}
+
+	count := bytes.Count(failures, []byte("\n"))
+	if count == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("%d failed write(s) recorded in %s", count, filename)
+}
+
+func (f *Filestore) failuresFilename() string {
+	return filepath.Join(filepath.Dir(f.data.Name()), FailuresFile)
+}
+
+// replay applies the records left in the wal by the last run, e.g., if it
+// crashed before checkpointing them.
+func (f *Filestore) replay() error {
+	count := 0
+	if err := f.wal.ForEachRecord(func(r wal.Record) error {
+		f.seq++
+		b, err := f.apply(r, f.seq)
+		if err != nil {
+			return errors.Wrap(err, "apply")
 		}
+
+		f.indexBlock(r.Key, b)
+
+		if err := f.cache.Delete(r.Key); err != nil {
+			return errors.Wrap(err, "cache delete")
+		}
+
+		count++
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "for each record")
 	}
-	return nil
+
+	if count > 0 {
+		log.Infof("replayed %d wal record(s)", count)
+	}
+
+	return f.checkpoint()
 }
 
 func (f *Filestore) loadStore() error {
+	f.files.RLock()
+	defer f.files.RUnlock()
+
 	log.Tracef("loading store")
 	if err := f.meta.ForEachBlock(func(b metastore.Block) error {
-		expectedBlockCRC32, err := b.CalculateCRC32()
+		key, h, err := f.readKey(b)
 		if err != nil {
-			return errors.Wrap(err, "calculate block crc32")
+			return err
 		}
 
-		if b.CRC32 != expectedBlockCRC32 {
-			return fmt.Errorf(
-				"incorrect block crc32 (0x%08X != 0x%08X)",
-				b.CRC32,
-				expectedBlockCRC32,
-			)
+		if h.Seq > f.seq {
+			f.seq = h.Seq
 		}
 
-		key, err := f.data.ReadData(b.KeyOffset, b.KeyLength)
-		if err != nil {
-			return errors.Wrap(err, "read key data")
-		}
+		f.indexBlock(key, b)
 
-		actualKeyCRC32 := crc32.ChecksumIEEE([]byte(key))
-		if actualKeyCRC32 != b.KeyCRC32 {
-			return fmt.Errorf(
-				"incorrect key crc32 (0x%08X != 0x%08X)",
-				actualKeyCRC32,
-				b.KeyCRC32,
-			)
+		if f.mode == ModeIndexOnly {
+			return nil
 		}
 
-		value, err := f.data.ReadData(b.ValueOffset, b.ValueLength)
-		if err != nil {
-			return errors.Wrap(err, "read value data")
+		if b.Kind == metastore.BlockKindDelete {
+			log.Tracef("loading tombstone for %s", key)
+			if err := f.cache.Delete(key); err != nil {
+				return errors.Wrap(err, "cache delete")
+			}
+			return nil
 		}
 
-		actualValueCRC32 := crc32.ChecksumIEEE([]byte(value))
-		if actualValueCRC32 != b.ValueCRC32 {
-			return fmt.Errorf(
-				"incorrect value crc32 (0x%08X != 0x%08X)",
-				actualValueCRC32,
-				b.ValueCRC32,
-			)
+		value, err := f.readValue(b)
+		if err != nil {
+			return err
 		}
 
 		log.Tracef("loading %s => %s", key, value)
@@ -188,3 +600,95 @@ func (f *Filestore) loadStore() error {
 
 	return nil
 }
+
+// readKey validates the provided block and returns the key that it points
+// to in the data file, along with its record header. Blocks from before
+// records had headers get a zero header.
+func (f *Filestore) readKey(b metastore.Block) (string, datastore.RecordHeader, error) {
+	h, hasHeader := datastore.RecordHeader{}, false
+	switch b.Version {
+	case metastore.BlockVersion1, metastore.BlockVersion2:
+	case metastore.BlockVersion3, metastore.BlockVersion4:
+		hasHeader = true
+	default:
+		return "", h, fmt.Errorf("incorrect block version (0x%08X)", b.Version)
+	}
+
+	expectedBlockCRC32, err := b.CalculateCRC32()
+	if err != nil {
+		return "", h, errors.Wrap(err, "calculate block crc32")
+	}
+
+	if b.CRC32 != expectedBlockCRC32 {
+		return "", h, fmt.Errorf(
+			"incorrect block crc32 (0x%08X != 0x%08X)",
+			b.CRC32,
+			expectedBlockCRC32,
+		)
+	}
+
+	if hasHeader {
+		if h, err = f.data.ReadHeader(b.KeyOffset); err != nil {
+			return "", h, err
+		}
+
+		if err := checkHeader(b, h); err != nil {
+			return "", h, err
+		}
+	}
+
+	key, err := f.data.ReadData(b.KeyOffset, b.KeyLength)
+	if err != nil {
+		return "", h, errors.Wrap(err, "read key data")
+	}
+
+	actualKeyCRC32 := crc32.ChecksumIEEE([]byte(key))
+	if actualKeyCRC32 != b.KeyCRC32 {
+		return "", h, fmt.Errorf(
+			"incorrect key crc32 (0x%08X != 0x%08X)",
+			actualKeyCRC32,
+			b.KeyCRC32,
+		)
+	}
+
+	return key, h, nil
+}
+
+// checkHeader makes sure that the block and the record header that it points
+// to describe the same record.
+func checkHeader(b metastore.Block, h datastore.RecordHeader) error {
+	op := datastore.OpSet
+	if b.Kind == metastore.BlockKindDelete {
+		op = datastore.OpDelete
+	}
+
+	if h.Op != op ||
+		h.KeyLength != b.KeyLength ||
+		h.KeyCRC32 != b.KeyCRC32 ||
+		h.ValueLength != b.ValueLength ||
+		h.ValueCRC32 != b.ValueCRC32 {
+		return fmt.Errorf("incorrect record header (%+v) for block (%+v)", h, b)
+	}
+
+	return nil
+}
+
+// readValue returns the value that the provided block points to in the
+// data file.
+func (f *Filestore) readValue(b metastore.Block) (string, error) {
+	value, err := f.data.ReadData(b.ValueOffset, b.ValueLength)
+	if err != nil {
+		return "", errors.Wrap(err, "read value data")
+	}
+
+	actualValueCRC32 := crc32.ChecksumIEEE([]byte(value))
+	if actualValueCRC32 != b.ValueCRC32 {
+		return "", fmt.Errorf(
+			"incorrect value crc32 (0x%08X != 0x%08X)",
+			actualValueCRC32,
+			b.ValueCRC32,
+		)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,206 @@
+package filestore
+
+import (
+	"time"
+
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// FollowInterval is how often followers check the meta file for new blocks.
+const FollowInterval = 100 * time.Millisecond
+
+// NewFollower returns a read-only store over data and meta files that
+// another process writes to. It serves reads from the blocks that the writer
+// has applied to them, and keeps following along as the writer applies more
+// (or compacts them). Writes that are still in the writer's wal are not
+// visible until they are applied.
+func NewFollower(
+	cache Cache,
+	data *datastore.Datastore,
+	meta *metastore.Metastore,
+	mode Mode,
+) *Filestore {
+	f := newFilestore(cache, data, meta, nil, mode)
+	f.readOnly = true
+
+	// Until the first follow succeeds, e.g., once the writer has finished
+	// writing whatever the follower tripped over, the store is not loaded.
+	if err := f.follow(); err != nil {
+		log.Errorf("load store: %s", err.Error())
+		f.setLoadError(err)
+	}
+
+	go func() {
+		log.Debugf("follower starting (interval %s)", FollowInterval)
+		for range time.Tick(FollowInterval) {
+			err := f.follow()
+			if err != nil {
+				log.Warnf("follow: %s", err.Error())
+				continue
+			}
+
+			if f.loadError() != nil {
+				log.Infof("loaded store")
+				f.setLoadError(nil)
+			}
+		}
+	}()
+
+	return f
+}
+
+// Close closes the data and meta files that a follower has open, which it
+// may have swapped in itself.
+func (f *Filestore) Close() error {
+	f.files.Lock()
+	defer f.files.Unlock()
+
+	if err := f.data.Close(); err != nil {
+		return errors.Wrap(err, "close data file")
+	}
+
+	return errors.Wrap(f.meta.Close(), "close meta file")
+}
+
+// follow reads whatever blocks have been appended to the meta file since it
+// was last called. Once the writer has replaced the meta file (or truncated
+// it after a crash), it starts over with the files that are now in place.
+func (f *Filestore) follow() error {
+	if err := f.followBlocks(); err != nil {
+		// The blocks may point into a data segment that compaction has
+		// since rewritten or removed, in which case starting over with the
+		// new files takes care of it.
+		if replaced, _ := f.meta.Replaced(); !replaced {
+			return errors.Wrap(err, "follow blocks")
+		}
+		log.Infof("meta file has been replaced while following it: %s", err.Error())
+		return errors.Wrap(f.refollow(), "refollow")
+	}
+
+	replaced, err := f.meta.Replaced()
+	if err != nil {
+		return errors.Wrap(err, "check for replaced meta file")
+	}
+
+	size, err := f.meta.Size()
+	if err != nil {
+		return errors.Wrap(err, "meta size")
+	}
+
+	if replaced || size < f.followOffset {
+		log.Infof("meta file has been replaced, following the new one")
+		return errors.Wrap(f.refollow(), "refollow")
+	}
+
+	return nil
+}
+
+func (f *Filestore) followBlocks() error {
+	f.files.RLock()
+	defer f.files.RUnlock()
+
+	offset, err := f.meta.ForEachBlockFrom(f.followOffset, func(b metastore.Block) error {
+		key, _, err := f.readKey(b)
+		if err != nil {
+			return err
+		}
+
+		f.indexBlock(key, b)
+
+		return f.cacheBlock(key, b)
+	})
+	f.followOffset = offset
+
+	return err
+}
+
+// cacheBlock brings the cache up to date with a block that another process
+// has written, once the index has it.
+func (f *Filestore) cacheBlock(key string, b metastore.Block) error {
+	if f.mode == ModeIndexOnly || b.Kind == metastore.BlockKindDelete {
+		return errors.Wrap(f.cache.Delete(key), "cache delete")
+	}
+
+	value, err := f.readValue(b)
+	if err != nil {
+		return err
+	}
+
+	return errors.Wrap(f.cache.Set(key, value), "cache set")
+}
+
+// refollow opens the data and meta files that are now in place, indexes
+// them, and swaps them in. Compaction keeps the latest block for each key
+// unless it is a tombstone that is no longer needed, so the cache only needs
+// the blocks in the new files brought into it, and the keys that have
+// dropped out of the index evicted from it.
+func (f *Filestore) refollow() error {
+	data, err := datastore.Open(f.data.Name(), datastore.ReadOnly)
+	if err != nil {
+		return errors.Wrap(err, "open data file")
+	}
+
+	meta, err := metastore.Open(f.meta.Name(), metastore.ReadOnly)
+	if err != nil {
+		data.Close()
+		return errors.Wrap(err, "open meta file")
+	}
+
+	// Only the files of the new store are used, to read its blocks.
+	next := &Filestore{data: data, meta: meta}
+	blocks := []liveBlock{}
+	index := make(map[string]metastore.Block)
+	offset, err := next.meta.ForEachBlockFrom(0, func(b metastore.Block) error {
+		key, _, err := next.readKey(b)
+		if err != nil {
+			return err
+		}
+
+		blocks = append(blocks, liveBlock{key: key, block: b})
+		if b.Kind == metastore.BlockKindDelete {
+			delete(index, key)
+		} else {
+			index[key] = b
+		}
+
+		return nil
+	})
+	if err != nil {
+		data.Close()
+		meta.Close()
+		return errors.Wrap(err, "index")
+	}
+
+	f.files.Lock()
+	defer f.files.Unlock()
+
+	old := &Filestore{data: f.data, meta: f.meta}
+	f.data, f.meta = next.data, next.meta
+	f.followOffset = offset
+
+	dropped := f.setIndex(index)
+
+	if err := old.data.Close(); err != nil {
+		log.Warnf("close replaced data file: %s", err.Error())
+	}
+	if err := old.meta.Close(); err != nil {
+		log.Warnf("close replaced meta file: %s", err.Error())
+	}
+
+	for _, key := range dropped {
+		if err := f.cache.Delete(key); err != nil {
+			return errors.Wrap(err, "cache delete")
+		}
+	}
+
+	for _, lb := range blocks {
+		if err := f.cacheBlock(lb.key, lb.block); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
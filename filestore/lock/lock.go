@@ -0,0 +1,97 @@
+package lock
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// Filename is the name of the lock file in the store dir. While a process
+// holds the exclusive lock, the file holds its pid.
+const Filename = "LOCK"
+
+// Lock is an advisory (flock) lock on a store dir. Only one process can hold
+// it exclusively, to write to the store, and no process can hold it shared,
+// to read the store, at the same time.
+type Lock struct {
+	file *os.File
+}
+
+// Exclusive locks the store dir for writing. It fails right away if any
+// other process holds the lock.
+func Exclusive(dir string) (*Lock, error) {
+	l, err := take(dir, os.O_RDWR|os.O_CREATE, syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := l.file.Truncate(0); err != nil {
+		l.Release()
+		return nil, errors.Wrap(err, "truncate")
+	}
+
+	if _, err := l.file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+		l.Release()
+		return nil, errors.Wrap(err, "write pid")
+	}
+
+	return l, nil
+}
+
+// Shared locks the store dir for reading. It fails right away if another
+// process holds the lock exclusively. It never creates the lock file.
+func Shared(dir string) (*Lock, error) {
+	return take(dir, os.O_RDONLY, syscall.LOCK_SH)
+}
+
+func take(dir string, flag, how int) (*Lock, error) {
+	filename := filepath.Join(dir, Filename)
+	file, err := os.OpenFile(filename, flag, 0600)
+	if os.IsNotExist(err) && flag == os.O_RDONLY {
+		// Nobody has ever written to the store, so there is nobody to keep
+		// out.
+		return &Lock{}, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "open lock file")
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, fmt.Errorf("store dir %s is locked by another process (%s)", dir, holder(filename))
+	} else if err != nil {
+		file.Close()
+		return nil, errors.Wrap(err, "flock")
+	}
+
+	return &Lock{file: file}, nil
+}
+
+// holder describes who last held the lock exclusively.
+func holder(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil || len(strings.TrimSpace(string(data))) == 0 {
+		return "unknown pid"
+	}
+	return "pid " + strings.TrimSpace(string(data))
+}
+
+// Release unlocks the store dir. The lock file is left behind, since
+// removing it could race with another process taking the lock.
+func (l *Lock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return errors.Wrap(err, "unlock")
+	}
+
+	return l.file.Close()
+}
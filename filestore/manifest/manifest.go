@@ -0,0 +1,182 @@
+package manifest
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+)
+
+// Filename is the name of the manifest in the store dir.
+const Filename = "MANIFEST"
+
+// FormatVersion is the newest on-disk format that this code understands.
+// Stores in a newer format are refused. Version 2 rolls the data file over
+// into segments, with hint files, and puts the segment number in the top
+// bits of every offset. Version 1 stores are version 2 stores that have never
+// rolled over, so they are upgraded in place when they are opened.
+const FormatVersion = 2
+
+// Manifest describes a store dir: which format it is in, and which files in
+// it belong to the store.
+type Manifest struct {
+	FormatVersion int       `json:"formatVersion"`
+	StoreID       string    `json:"storeID"`
+	CreatedAt     time.Time `json:"createdAt"`
+
+	DataFile string `json:"dataFile"`
+	MetaFile string `json:"metaFile"`
+	WALFile  string `json:"walFile"`
+
+	// SegmentFiles lists the data file's segments after the data file
+	// itself, along with every hint file, as of the last checkpoint or
+	// compaction. A crash can leave it behind, so it is brought up to date
+	// whenever the store is opened.
+	SegmentFiles []string `json:"segmentFiles,omitempty"`
+
+	// LastCheckpoint is when the data and meta files were last made durable
+	// and writes were truncated out of the wal.
+	LastCheckpoint time.Time `json:"lastCheckpoint"`
+
+	dir string
+}
+
+// Load reads the manifest in the provided store dir. It fails if there is
+// none, or if the store is in a format that this code does not understand.
+func Load(dir string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, Filename))
+	if err != nil {
+		return nil, errors.Wrap(err, "read file")
+	}
+
+	m := &Manifest{dir: dir}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.Wrap(err, "unmarshal")
+	}
+
+	if m.FormatVersion < 1 || m.FormatVersion > FormatVersion {
+		return nil, fmt.Errorf(
+			"unsupported store format version %d (newest supported is %d)",
+			m.FormatVersion,
+			FormatVersion,
+		)
+	}
+
+	return m, nil
+}
+
+// Open loads the manifest in the provided store dir, or writes a new one if
+// there is none yet, and upgrades the store to FormatVersion. Store dirs from
+// before manifests existed get one that names the files they have always
+// used.
+func Open(dir string) (*Manifest, error) {
+	m, err := Load(dir)
+	if err == nil {
+		if m.FormatVersion < FormatVersion {
+			m.FormatVersion = FormatVersion
+			if err := m.Write(); err != nil {
+				return nil, errors.Wrap(err, "upgrade")
+			}
+		}
+		return m, nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return nil, err
+	}
+
+	storeID, err := newStoreID()
+	if err != nil {
+		return nil, errors.Wrap(err, "new store id")
+	}
+
+	m = &Manifest{
+		FormatVersion: FormatVersion,
+		StoreID:       storeID,
+		CreatedAt:     time.Now().UTC(),
+
+		DataFile: "andbdata.bin",
+		MetaFile: "andbmeta.bin",
+		WALFile:  "andbwal.log",
+
+		dir: dir,
+	}
+	if err := m.Write(); err != nil {
+		return nil, errors.Wrap(err, "write")
+	}
+
+	return m, nil
+}
+
+// Path returns the path of a file in the manifest's store dir.
+func (m *Manifest) Path(filename string) string {
+	return filepath.Join(m.dir, filename)
+}
+
+// SetSegmentFiles records the provided segment and hint files, which are
+// names in the store dir, and writes the manifest if that changed it.
+func (m *Manifest) SetSegmentFiles(filenames []string) error {
+	if len(filenames) == len(m.SegmentFiles) {
+		changed := false
+		for i := range filenames {
+			if filenames[i] != m.SegmentFiles[i] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return nil
+		}
+	}
+
+	recorded := m.SegmentFiles
+	m.SegmentFiles = filenames
+	if err := m.Write(); err != nil {
+		m.SegmentFiles = recorded
+		return err
+	}
+
+	return nil
+}
+
+// Checkpointed records a checkpoint at the provided time, and writes the
+// manifest.
+func (m *Manifest) Checkpointed(at time.Time) error {
+	recorded := m.LastCheckpoint
+	m.LastCheckpoint = at.UTC()
+	if err := m.Write(); err != nil {
+		m.LastCheckpoint = recorded
+		return err
+	}
+
+	return nil
+}
+
+// Write atomically replaces the manifest on disk.
+func (m *Manifest) Write() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+
+	return fileutil.ReplaceFile(m.Path(Filename), func(file *os.File) error {
+		_, err := file.Write(data)
+		return err
+	})
+}
+
+// newStoreID returns a random (version 4) UUID.
+func newStoreID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0F) | 0x40
+	b[8] = (b[8] & 0x3F) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -4,19 +4,63 @@ import (
 	"bytes"
 	"encoding/binary"
 	"hash/crc32"
+	"io"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
+type BlockKind uint32
+
+const (
+	// BlockKindSet blocks point to a key and its value.
+	BlockKindSet BlockKind = iota
+	// BlockKindDelete blocks (tombstones) point to a key that has been
+	// deleted. Their value fields are zero.
+	BlockKindDelete
+)
+
+// Block points to a key (and maybe its value) in the data file. Its CRC32s
+// only guard against corruption: different keys can share a KeyCRC32, so
+// blocks must be matched to keys by the key bytes in the data file.
 type Block struct {
+	Version                 uint32
+	KeyOffset               uint64
+	KeyLength, KeyCRC32     uint32
+	ValueOffset             uint64
+	ValueLength, ValueCRC32 uint32
+	Kind                    BlockKind
+	CRC32                   uint32
+}
+
+const (
+	// BlockVersion1 blocks have no Kind; they are all BlockKindSet.
+	BlockVersion1 = 0x01020304
+	BlockVersion2 = 0x01020305
+	// BlockVersion3 blocks have the same layout as BlockVersion2 blocks,
+	// but their key is preceded by a datastore.RecordHeader.
+	BlockVersion3 = 0x01020306
+	// BlockVersion4 blocks are BlockVersion3 blocks with 64-bit offsets.
+	BlockVersion4 = 0x01020307
+
+	BlockVersion = BlockVersion4
+)
+
+type blockV1 struct {
 	Version                              uint32
 	KeyOffset, KeyLength, KeyCRC32       uint32
 	ValueOffset, ValueLength, ValueCRC32 uint32
 	CRC32                                uint32
 }
 
-const BlockVersion = 0x01020304
+// blockV2 is the layout of BlockVersion2 and BlockVersion3 blocks.
+type blockV2 struct {
+	Version                              uint32
+	KeyOffset, KeyLength, KeyCRC32       uint32
+	ValueOffset, ValueLength, ValueCRC32 uint32
+	Kind                                 BlockKind
+	CRC32                                uint32
+}
 
 var blockByteOrder = binary.BigEndian
 
@@ -27,9 +71,114 @@ func (b Block) CalculateCRC32() (uint32, error) {
 	log.Tracef("calc crc32 of %+v", b)
 
 	buf := bytes.NewBuffer([]byte{})
-	if err := binary.Write(buf, blockByteOrder, &b); err != nil {
-		return 0, errors.Wrap(err, "write block")
+	if err := b.encode(buf); err != nil {
+		return 0, errors.Wrap(err, "encode block")
 	}
 
 	return crc32.ChecksumIEEE(buf.Bytes()), nil
 }
+
+func (b *Block) encode(w io.Writer) error {
+	switch b.Version {
+	case BlockVersion1:
+		return binary.Write(w, blockByteOrder, &blockV1{
+			Version:     b.Version,
+			KeyOffset:   uint32(b.KeyOffset),
+			KeyLength:   b.KeyLength,
+			KeyCRC32:    b.KeyCRC32,
+			ValueOffset: uint32(b.ValueOffset),
+			ValueLength: b.ValueLength,
+			ValueCRC32:  b.ValueCRC32,
+			CRC32:       b.CRC32,
+		})
+	case BlockVersion2, BlockVersion3:
+		return binary.Write(w, blockByteOrder, &blockV2{
+			Version:     b.Version,
+			KeyOffset:   uint32(b.KeyOffset),
+			KeyLength:   b.KeyLength,
+			KeyCRC32:    b.KeyCRC32,
+			ValueOffset: uint32(b.ValueOffset),
+			ValueLength: b.ValueLength,
+			ValueCRC32:  b.ValueCRC32,
+			Kind:        b.Kind,
+			CRC32:       b.CRC32,
+		})
+	default:
+		return binary.Write(w, blockByteOrder, b)
+	}
+}
+
+// size returns the number of bytes that the block takes up on disk.
+func (b *Block) size() int64 {
+	switch b.Version {
+	case BlockVersion1:
+		return int64(binary.Size(&blockV1{}))
+	case BlockVersion2, BlockVersion3:
+		return int64(binary.Size(&blockV2{}))
+	default:
+		return int64(binary.Size(b))
+	}
+}
+
+// decode reads a block in whatever format its version says it is in. Blocks
+// with an unknown version are read in the current format, so that the
+// caller's crc32 check catches them.
+func (b *Block) decode(r io.Reader) error {
+	if err := binary.Read(r, blockByteOrder, &b.Version); err != nil {
+		return err
+	}
+
+	data := make([]byte, b.size())
+	blockByteOrder.PutUint32(data, b.Version)
+	if _, err := io.ReadFull(r, data[4:]); err != nil {
+		return noEOF(err)
+	}
+	buf := bytes.NewReader(data)
+
+	switch b.Version {
+	case BlockVersion1:
+		old := blockV1{}
+		if err := binary.Read(buf, blockByteOrder, &old); err != nil {
+			return err
+		}
+		*b = Block{
+			Version:     old.Version,
+			KeyOffset:   uint64(old.KeyOffset),
+			KeyLength:   old.KeyLength,
+			KeyCRC32:    old.KeyCRC32,
+			ValueOffset: uint64(old.ValueOffset),
+			ValueLength: old.ValueLength,
+			ValueCRC32:  old.ValueCRC32,
+			Kind:        BlockKindSet,
+			CRC32:       old.CRC32,
+		}
+		return nil
+	case BlockVersion2, BlockVersion3:
+		old := blockV2{}
+		if err := binary.Read(buf, blockByteOrder, &old); err != nil {
+			return err
+		}
+		*b = Block{
+			Version:     old.Version,
+			KeyOffset:   uint64(old.KeyOffset),
+			KeyLength:   old.KeyLength,
+			KeyCRC32:    old.KeyCRC32,
+			ValueOffset: uint64(old.ValueOffset),
+			ValueLength: old.ValueLength,
+			ValueCRC32:  old.ValueCRC32,
+			Kind:        old.Kind,
+			CRC32:       old.CRC32,
+		}
+		return nil
+	default:
+		return binary.Read(buf, blockByteOrder, b)
+	}
+}
+
+// noEOF turns an EOF partway through a block into an unexpected one.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -1,10 +1,8 @@
 package metastore
 
 import (
-	"encoding/binary"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
 	"sync"
 
@@ -14,30 +12,135 @@ import (
 
 type Metastore struct {
 	file  *os.File
-	mutex *sync.Mutex // TODO: this should be a file lock
+	mode  OpenMode
+	mutex *sync.Mutex // other processes are kept out by the store dir lock
 }
 
+type OpenMode int
+
+const (
+	// ReadWrite opens the meta file for appending, creating it if it does not
+	// exist yet.
+	ReadWrite OpenMode = iota
+	// ReadOnly opens an existing meta file, and never creates or changes it.
+	ReadOnly
+)
+
+var errReadOnly = errors.New("meta file is open read-only")
+
+// New wraps a meta file that has already been opened for reading and
+// writing.
 func New(file *os.File) *Metastore {
 	return &Metastore{
 		file:  file,
+		mode:  ReadWrite,
 		mutex: &sync.Mutex{},
 	}
 }
 
-func (m *Metastore) Write(
-	key, value string,
-	keyOffset, valueOffset uint32,
-) error {
+// Open opens the meta file at the provided path in the provided mode.
+func Open(filename string, mode OpenMode) (*Metastore, error) {
+	file, err := os.OpenFile(filename, mode.flag(), 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file")
+	}
+
+	return &Metastore{
+		file:  file,
+		mode:  mode,
+		mutex: &sync.Mutex{},
+	}, nil
+}
+
+func (mode OpenMode) flag() int {
+	if mode == ReadOnly {
+		return os.O_RDONLY
+	}
+	return os.O_RDWR | os.O_CREATE
+}
+
+func (m *Metastore) Name() string {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	_, err := m.file.Seek(0, 2)
+	return m.file.Name()
+}
+
+func (m *Metastore) Size() (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	info, err := m.file.Stat()
 	if err != nil {
-		return errors.Wrap(err, "seek to end")
+		return 0, errors.Wrap(err, "stat")
 	}
 
-	b := Block{
+	return info.Size(), nil
+}
+
+// Replaced returns whether the file at the meta file's path is no longer the
+// one that it has open, e.g., because compaction has renamed a new one over
+// it.
+func (m *Metastore) Replaced() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	info, err := m.file.Stat()
+	if err != nil {
+		return false, errors.Wrap(err, "stat")
+	}
+
+	pathInfo, err := os.Stat(m.file.Name())
+	if os.IsNotExist(err) {
+		return true, nil
+	} else if err != nil {
+		return false, errors.Wrap(err, "stat path")
+	}
+
+	return !os.SameFile(info, pathInfo), nil
+}
+
+func (m *Metastore) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.file.Close()
+}
+
+func (m *Metastore) Sync() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.file.Sync()
+}
+
+// Reopen closes the underlying file and opens whatever is now at its path,
+// in the same mode, e.g., after a compacted meta file has been renamed over
+// it. Unlike Open, it never creates the file.
+func (m *Metastore) Reopen() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	file, err := os.OpenFile(m.file.Name(), m.mode.flag()&^os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open file")
+	}
+
+	if err := m.file.Close(); err != nil {
+		log.Warnf("close replaced meta file: %s", err.Error())
+	}
+	m.file = file
+
+	return nil
+}
+
+func (m *Metastore) Write(
+	key, value string,
+	keyOffset, valueOffset uint64,
+) (Block, error) {
+	return m.write(Block{
 		Version: BlockVersion,
+		Kind:    BlockKindSet,
 
 		KeyOffset: keyOffset,
 		KeyLength: uint32(len(key)),
@@ -46,18 +149,55 @@ func (m *Metastore) Write(
 		ValueOffset: valueOffset,
 		ValueLength: uint32(len(value)),
 		ValueCRC32:  crc32.ChecksumIEEE([]byte(value)),
+	})
+}
+
+// WriteTombstone appends a block recording that the key at the provided
+// offset has been deleted.
+func (m *Metastore) WriteTombstone(key string, keyOffset uint64) (Block, error) {
+	return m.write(Block{
+		Version: BlockVersion,
+		Kind:    BlockKindDelete,
+
+		KeyOffset: keyOffset,
+		KeyLength: uint32(len(key)),
+		KeyCRC32:  crc32.ChecksumIEEE([]byte(key)),
+	})
+}
+
+// WriteBlock appends a block with the provided fields, e.g., one built from
+// a record header, filling in its crc32 (and its version, if it has none).
+func (m *Metastore) WriteBlock(b Block) (Block, error) {
+	if b.Version == 0 {
+		b.Version = BlockVersion
+	}
+	return m.write(b)
+}
+
+func (m *Metastore) write(b Block) (Block, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.mode == ReadOnly {
+		return Block{}, errReadOnly
+	}
+
+	_, err := m.file.Seek(0, 2)
+	if err != nil {
+		return Block{}, errors.Wrap(err, "seek to end")
 	}
+
 	blockCRC32, err := b.CalculateCRC32()
 	if err != nil {
-		return errors.Wrap(err, "calculate crc32")
+		return Block{}, errors.Wrap(err, "calculate crc32")
 	}
 	b.CRC32 = blockCRC32
 
-	if err := binary.Write(m.file, blockByteOrder, &b); err != nil {
-		return errors.Wrap(err, "write block")
+	if err := b.encode(m.file); err != nil {
+		return Block{}, errors.Wrap(err, "write block")
 	}
 
-	return nil
+	return b, nil
 }
 
 func (m *Metastore) ForEachBlock(blockHandler func(b Block) error) error {
@@ -73,7 +213,7 @@ func (m *Metastore) ForEachBlock(blockHandler func(b Block) error) error {
 	b := Block{}
 	i := 0
 	for {
-		if err := binary.Read(cursorFile, blockByteOrder, &b); err != nil {
+		if err := b.decode(cursorFile); err != nil {
 			if err == io.EOF {
 				break
 			} else {
@@ -94,40 +234,92 @@ func (m *Metastore) ForEachBlock(blockHandler func(b Block) error) error {
 	return nil
 }
 
-func (m *Metastore) DeleteBlock(key string) error {
-	newFile, err := ioutil.TempFile("", "andbmetastore")
+// ForEachBlockFrom calls the provided handler with each complete block after
+// the provided offset in the open meta file, and returns the offset after
+// the last block that it handled. A partial block at the end of the file is
+// left for the next call, once the rest of it has been written.
+func (m *Metastore) ForEachBlockFrom(
+	offset int64,
+	blockHandler func(b Block) error,
+) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	info, err := m.file.Stat()
 	if err != nil {
-		return errors.Wrap(err, "temp file")
+		return offset, errors.Wrap(err, "stat")
 	}
-	defer newFile.Close()
 
-	if err := m.ForEachBlock(
-		func(b Block) error {
-			if b.KeyCRC32 != crc32.ChecksumIEEE([]byte(key)) {
-				if err := binary.Write(newFile, blockByteOrder, &b); err != nil {
-					return errors.Wrap(err, "write block")
-				}
-			} else {
-				log.Tracef("dropping block %x", b.KeyCRC32)
-			}
-			return nil
-		},
-	); err != nil {
-		return errors.Wrap(err, "for each block")
+	r := io.NewSectionReader(m.file, offset, info.Size()-offset)
+	b := Block{}
+	for {
+		if err := b.decode(r); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, errors.Wrap(err, "read block")
+		}
+
+		if err := blockHandler(b); err != nil {
+			return offset, errors.Wrap(err, "block handler")
+		}
+
+		offset += b.size()
 	}
+}
 
-	if err := os.Rename(newFile.Name(), m.file.Name()); err != nil {
-		return errors.Wrap(err, "rename")
+// Recover truncates the meta file after its last complete block, and throws
+// that block away too if lastBlockValid says it is bad. It returns the
+// number of bytes that it threw away.
+func (m *Metastore) Recover(lastBlockValid func(b Block) bool) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.mode == ReadOnly {
+		return 0, errReadOnly
 	}
 
-	if err := m.file.Close(); err != nil {
-		return errors.Wrap(err, "close")
+	info, err := m.file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "stat")
 	}
 
-	m.file, err = os.Open(m.file.Name())
+	cursorFile, err := os.Open(m.file.Name())
 	if err != nil {
-		return errors.Wrap(err, "(re)open file")
+		return 0, errors.Wrap(err, "open cursor file")
+	}
+	defer cursorFile.Close()
+
+	var (
+		b, last            Block
+		offset, lastOffset int64
+	)
+	for {
+		if err := b.decode(cursorFile); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return 0, errors.Wrap(err, "read block")
+		}
+
+		last, lastOffset = b, offset
+		offset += b.size()
 	}
 
-	return nil
+	end := offset
+	if end > 0 && !lastBlockValid(last) {
+		end = lastOffset
+	}
+
+	if end == info.Size() {
+		return 0, nil
+	}
+
+	if err := m.file.Truncate(end); err != nil {
+		return 0, errors.Wrap(err, "truncate")
+	}
+
+	if err := m.file.Sync(); err != nil {
+		return 0, errors.Wrap(err, "sync")
+	}
+
+	return info.Size() - end, nil
 }
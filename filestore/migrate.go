@@ -0,0 +1,205 @@
+package filestore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// BackupSuffix is appended to the data and meta files (and the data file's
+// segments and hint files) that Migrate replaces. They stay around until
+// RollbackMigration puts them back, or somebody removes them.
+const BackupSuffix = ".bak"
+
+const migrateSuffix = ".migrate"
+
+// Migrate rewrites the data and meta files so that every block is in the
+// current metastore.BlockVersion, and every record has a header. It returns
+// how many blocks it rewrote, which is 0 if the files were already up to
+// date. The store must not be running while it does so.
+func Migrate(dataFilename, metaFilename string) (int, error) {
+	for _, filename := range []string{dataFilename, metaFilename} {
+		if _, err := os.Stat(filename + BackupSuffix); err == nil {
+			return 0, fmt.Errorf("backup from an earlier migration exists: %s", filename+BackupSuffix)
+		} else if !os.IsNotExist(err) {
+			return 0, errors.Wrap(err, "stat backup file")
+		}
+	}
+
+	if err := RecoverCompaction(dataFilename, metaFilename); err != nil {
+		return 0, errors.Wrap(err, "recover compaction")
+	}
+
+	data, err := datastore.Open(dataFilename, datastore.ReadOnly)
+	if err != nil {
+		return 0, errors.Wrap(err, "open data file")
+	}
+	defer data.Close()
+
+	meta, err := metastore.Open(metaFilename, metastore.ReadOnly)
+	if err != nil {
+		return 0, errors.Wrap(err, "open meta file")
+	}
+	defer meta.Close()
+
+	// Only the files of the old store are used, to read its blocks.
+	old := &Filestore{data: data, meta: meta}
+
+	current := true
+	if err := old.meta.ForEachBlock(func(b metastore.Block) error {
+		current = current && b.Version == metastore.BlockVersion
+		return nil
+	}); err != nil {
+		return 0, errors.Wrap(err, "for each block")
+	}
+	if current {
+		return 0, nil
+	}
+
+	count, err := old.writeMigrated(dataFilename+migrateSuffix, metaFilename+migrateSuffix)
+	if err != nil {
+		return 0, errors.Wrap(err, "write migrated files")
+	}
+
+	// The migrated data file holds every record, so the old segments and
+	// hint files are backed up without being replaced.
+	extras, err := datastore.SegmentFiles(dataFilename)
+	if err != nil {
+		return 0, errors.Wrap(err, "segment files")
+	}
+	for _, filename := range extras {
+		if err := os.Rename(filename, filename+BackupSuffix); err != nil {
+			return 0, errors.Wrap(err, "back up")
+		}
+	}
+
+	for _, filename := range []string{dataFilename, metaFilename} {
+		if err := os.Rename(filename, filename+BackupSuffix); err != nil {
+			return 0, errors.Wrap(err, "back up")
+		}
+		if err := os.Rename(filename+migrateSuffix, filename); err != nil {
+			return 0, errors.Wrap(err, "rename migrated file")
+		}
+	}
+
+	return count, errors.Wrap(fileutil.SyncDir(filepath.Dir(dataFilename)), "sync dir")
+}
+
+// RollbackMigration puts back the data and meta files that Migrate backed
+// up, along with the data file's segments and hint files.
+func RollbackMigration(dataFilename, metaFilename string) error {
+	dir := filepath.Dir(dataFilename)
+	if _, err := os.Stat(dataFilename + BackupSuffix); err == nil {
+		extras, err := datastore.SegmentFiles(dataFilename)
+		if err != nil {
+			return errors.Wrap(err, "segment files")
+		}
+		for _, filename := range extras {
+			if err := os.Remove(filename); err != nil {
+				return errors.Wrap(err, "remove migrated segment file")
+			}
+		}
+	}
+
+	for _, filename := range []string{dataFilename, metaFilename} {
+		if err := os.Remove(filename + migrateSuffix); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "remove migrated file")
+		}
+
+		if _, err := os.Stat(filename + BackupSuffix); os.IsNotExist(err) {
+			log.Infof("no backup of %s to roll back to", filename)
+			continue
+		}
+
+		if err := os.Rename(filename+BackupSuffix, filename); err != nil {
+			return errors.Wrap(err, "rename backup file")
+		}
+	}
+
+	// Only Migrate leaves backups in the store dir, so whatever is left are
+	// the data file's segments and hint files.
+	backups, err := filepath.Glob(filepath.Join(dir, "*"+BackupSuffix))
+	if err != nil {
+		return errors.Wrap(err, "glob backup files")
+	}
+	for _, filename := range backups {
+		if err := os.Rename(filename, strings.TrimSuffix(filename, BackupSuffix)); err != nil {
+			return errors.Wrap(err, "rename backup file")
+		}
+	}
+
+	return errors.Wrap(fileutil.SyncDir(dir), "sync dir")
+}
+
+// writeMigrated copies every block, tombstones included, in the order that
+// they were written. The records are given new sequence numbers in that
+// same order, since blocks from before records had headers have none.
+func (f *Filestore) writeMigrated(dataFilename, metaFilename string) (int, error) {
+	dataFile, err := os.OpenFile(dataFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "open data file")
+	}
+	defer dataFile.Close()
+
+	metaFile, err := os.OpenFile(metaFilename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, errors.Wrap(err, "open meta file")
+	}
+	defer metaFile.Close()
+
+	data := datastore.New(dataFile)
+	meta := metastore.New(metaFile)
+	count := 0
+	if err := f.meta.ForEachBlock(func(b metastore.Block) error {
+		key, _, err := f.readKey(b)
+		if err != nil {
+			return err
+		}
+
+		op, value := datastore.OpDelete, ""
+		if b.Kind == metastore.BlockKindSet {
+			op = datastore.OpSet
+			if value, err = f.readValue(b); err != nil {
+				return err
+			}
+		}
+
+		count++
+		data.WriteKeyValue(
+			op,
+			uint64(count),
+			key,
+			value,
+			func(key, value string, keyOffset, valueOffset uint64) {
+				if op == datastore.OpDelete {
+					_, err = meta.WriteTombstone(key, keyOffset)
+				} else {
+					_, err = meta.Write(key, value, keyOffset, valueOffset)
+				}
+			},
+			func(err0 error) {
+				err = errors.Wrap(err0, "write key/value data")
+			},
+		)
+		return err
+	}); err != nil {
+		return 0, errors.Wrap(err, "for each block")
+	}
+
+	if err := data.Sync(); err != nil {
+		return 0, errors.Wrap(err, "sync data file")
+	}
+
+	if err := meta.Sync(); err != nil {
+		return 0, errors.Wrap(err, "sync meta file")
+	}
+
+	return count, nil
+}
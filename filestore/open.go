@@ -0,0 +1,150 @@
+package filestore
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/ankeesler/andb/btreestore"
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/lock"
+	"github.com/ankeesler/andb/filestore/manifest"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/ankeesler/andb/lsmstore"
+	"github.com/ankeesler/andb/memstore"
+	"github.com/ankeesler/andb/wal"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dir is a store dir that has been locked for writing, with its manifest
+// opened and any compaction that a crash interrupted finished (or thrown
+// away), which is everything that has to happen before its files are opened.
+type Dir struct {
+	*manifest.Manifest
+
+	lock *lock.Lock
+}
+
+// otherEngineFiles are the files that the other engines keep in their store
+// dirs, along with the stores that they mean the store dir holds.
+var otherEngineFiles = map[string]string{
+	lsmstore.LevelsFile:   "an lsm engine store",
+	lsmstore.WALFile:      "an lsm engine store",
+	btreestore.Filename:   "a btree engine store",
+	memstore.SnapshotFile: "a memory engine snapshot",
+}
+
+// OpenDir gets the store dir ready for its files to be opened. It fails if
+// any other process has the store dir locked, or if another engine's store
+// is in it.
+func OpenDir(dir string) (*Dir, error) {
+	l, err := lock.Exclusive(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "lock store dir")
+	}
+
+	for filename, store := range otherEngineFiles {
+		if _, err := os.Stat(filepath.Join(dir, filename)); err == nil {
+			l.Release()
+			return nil, errors.Errorf("store dir %s holds %s", dir, store)
+		}
+	}
+
+	m, err := manifest.Open(dir)
+	if err != nil {
+		l.Release()
+		return nil, errors.Wrap(err, "open manifest")
+	}
+	log.Debugf("store %s (format version %d)", m.StoreID, m.FormatVersion)
+
+	d := &Dir{Manifest: m, lock: l}
+	if err := RecoverCompaction(d.DataFilename(), d.MetaFilename()); err != nil {
+		l.Release()
+		return nil, errors.Wrap(err, "recover compaction")
+	}
+
+	return d, nil
+}
+
+// DataFilename returns the path of the store's data file.
+func (d *Dir) DataFilename() string {
+	return d.Path(d.DataFile)
+}
+
+// MetaFilename returns the path of the store's meta file.
+func (d *Dir) MetaFilename() string {
+	return d.Path(d.MetaFile)
+}
+
+// WALFilename returns the path of the store's wal.
+func (d *Dir) WALFilename() string {
+	return d.Path(d.WALFile)
+}
+
+// Close unlocks the store dir.
+func (d *Dir) Close() error {
+	return d.lock.Release()
+}
+
+// Options say how Open sets up the store.
+type Options struct {
+	Cache Cache
+	Mode  Mode
+
+	// SegmentBytes is how big the active data segment gets before writes
+	// roll over to a new one. Zero uses datastore.DefaultSegmentSize.
+	SegmentBytes int64
+}
+
+// Open opens the store in the provided store dir for writing, which only one
+// process can do at a time, and loads it. The returned function closes the
+// store's files and unlocks the store dir.
+func Open(dir string, options Options) (fs *Filestore, closeStore func(), err error) {
+	closers := []func() error{}
+	closeAll := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeAll()
+		}
+	}()
+
+	d, err := OpenDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	closers = append(closers, d.Close)
+
+	ds, err := datastore.Open(d.DataFilename(), datastore.ReadWrite)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open data file")
+	}
+	closers = append(closers, ds.Close)
+	log.Debugf("data file: %s", ds.Name())
+	if options.SegmentBytes > 0 {
+		log.Debugf("segment bytes: %d", options.SegmentBytes)
+		ds.SetSegmentSize(options.SegmentBytes)
+	}
+
+	ms, err := metastore.Open(d.MetaFilename(), metastore.ReadWrite)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open meta file")
+	}
+	closers = append(closers, ms.Close)
+	log.Debugf("meta file: %s", ms.Name())
+
+	walFile, err := os.OpenFile(d.WALFilename(), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "open wal file")
+	}
+	closers = append(closers, walFile.Close)
+	log.Debugf("wal file: %s", walFile.Name())
+
+	fs = newFilestore(options.Cache, ds, ms, wal.New(walFile), options.Mode)
+	fs.manifest = d.Manifest
+	fs.start()
+	return fs, closeAll, nil
+}
@@ -0,0 +1,89 @@
+package filestore
+
+import (
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// recoverTornTail throws away whatever was left half-written at the end of
+// the meta file and the active data segment when the last run died.
+// Anything thrown away was never checkpointed, so it is either still in the
+// wal or was never acknowledged.
+func (f *Filestore) recoverTornTail() error {
+	metaFilename, dataFilename := f.meta.Name(), f.data.Name()
+
+	discarded, err := f.meta.Recover(func(b metastore.Block) bool {
+		if err := f.validateBlock(b); err != nil {
+			log.Warnf("discarding torn block at the end of %s: %s", metaFilename, err.Error())
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Wrap(err, "recover meta file")
+	}
+	if discarded > 0 {
+		log.Warnf("discarded %d torn byte(s) from the end of %s", discarded, metaFilename)
+	}
+
+	// Only trust the meta file to say where the active segment ends if every
+	// block in it is intact. Closed segments were synced when they were
+	// rolled over, so they cannot be torn.
+	active := f.data.ActiveSegment()
+	end, intact := int64(0), true
+	if err := f.meta.ForEachBlock(func(b metastore.Block) error {
+		if crc, err := b.CalculateCRC32(); err != nil || crc != b.CRC32 {
+			intact = false
+		}
+
+		for _, blockEnd := range []uint64{
+			b.KeyOffset + uint64(b.KeyLength),
+			b.ValueOffset + uint64(b.ValueLength),
+		} {
+			if segment, position := datastore.SplitAddress(blockEnd); segment == active && position > end {
+				end = position
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return errors.Wrap(err, "for each block")
+	}
+
+	if !intact {
+		log.Warnf("not recovering %s since %s is corrupt", dataFilename, metaFilename)
+		return nil
+	}
+
+	size, err := f.data.SegmentSize(active)
+	if err != nil {
+		return errors.Wrap(err, "data size")
+	}
+
+	if size > end {
+		log.Warnf("discarding %d torn byte(s) from the end of %s", size-end, datastore.SegmentFilename(dataFilename, active))
+		if err := f.data.Truncate(end); err != nil {
+			return errors.Wrap(err, "truncate data file")
+		}
+	}
+
+	return nil
+}
+
+// validateBlock makes sure that the block and the data it points to are
+// intact.
+func (f *Filestore) validateBlock(b metastore.Block) error {
+	if _, _, err := f.readKey(b); err != nil {
+		return err
+	}
+
+	if b.Kind == metastore.BlockKindSet {
+		if _, err := f.readValue(b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,52 @@
+// Package fileutil holds the file system steps that every andb store takes
+// to make its files durable.
+package fileutil
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// SyncDir flushes the provided directory to disk, so that files created in,
+// renamed into, or removed from it stay that way after a crash.
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrap(err, "open")
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
+
+// ReplaceFile atomically replaces the file at the provided path with what
+// the provided function writes. It writes to a temporary file next to it,
+// fsyncs that, renames it into place, and then syncs the directory.
+func ReplaceFile(filename string, write func(file *os.File) error) error {
+	file, err := os.OpenFile(filename+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "open temp file")
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		return errors.Wrap(err, "write temp file")
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return errors.Wrap(err, "sync temp file")
+	}
+
+	if err := file.Close(); err != nil {
+		return errors.Wrap(err, "close temp file")
+	}
+
+	if err := os.Rename(file.Name(), filename); err != nil {
+		return errors.Wrap(err, "rename temp file")
+	}
+
+	return errors.Wrap(SyncDir(filepath.Dir(filename)), "sync dir")
+}
@@ -0,0 +1,71 @@
+package lsmstore
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// bloom is a bloom filter over the keys in a table, so that most lookups of
+// keys that are not in it never read a block.
+type bloom struct {
+	bits []byte
+}
+
+func newBloom(keys int) *bloom {
+	bits := keys * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	return &bloom{bits: make([]byte, (bits+7)/8)}
+}
+
+// bloomHashPair returns the two hashes that every bit position is derived from.
+func bloomHashPair(key string) (uint32, uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func (b *bloom) add(key string) {
+	h1, h2 := bloomHashPair(key)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		b.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// mayContain returns false if the key is definitely not in the table.
+func (b *bloom) mayContain(key string) bool {
+	h1, h2 := bloomHashPair(key)
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if b.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) encode() []byte {
+	data := make([]byte, 4+len(b.bits))
+	binary.BigEndian.PutUint32(data, uint32(len(b.bits)))
+	copy(data[4:], b.bits)
+	return data
+}
+
+func decodeBloom(data []byte) (*bloom, error) {
+	if len(data) < 4 || int(binary.BigEndian.Uint32(data)) != len(data)-4 || len(data) == 4 {
+		return nil, errors.New("incorrect bloom filter length")
+	}
+	return &bloom{bits: data[4:]}, nil
+}
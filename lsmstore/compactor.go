@@ -0,0 +1,309 @@
+package lsmstore
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// compaction merges some tables in one level with the tables that they
+// overlap in the next one.
+type compaction struct {
+	level       int
+	inputs      []*table
+	overlapping []*table
+
+	// bottom is set if no level below the next one has any tables, in which
+	// case tombstones have nothing left to hide.
+	bottom bool
+}
+
+func (s *Store) triggerCompaction() {
+	select {
+	case s.compactC <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Store) compactor() {
+	defer close(s.doneC)
+
+	for {
+		select {
+		case <-s.closeC:
+			return
+		case <-s.compactC:
+		}
+
+		for {
+			select {
+			case <-s.closeC:
+				return
+			default:
+			}
+
+			compacted, err := s.compact()
+			if err != nil {
+				log.Warnf("compaction failed: %s", err.Error())
+				break
+			}
+			if !compacted {
+				break
+			}
+		}
+	}
+}
+
+// compact runs one compaction, if any level needs it, and returns whether
+// it did.
+func (s *Store) compact() (bool, error) {
+	s.mutex.RLock()
+	c := s.pickCompaction()
+	s.mutex.RUnlock()
+
+	if c == nil {
+		return false, nil
+	}
+
+	log.Infof(
+		"compacting %d table(s) in level %d with %d table(s) in level %d",
+		len(c.inputs),
+		c.level,
+		len(c.overlapping),
+		c.level+1,
+	)
+
+	// Level 0 tables are newest first, and the rest do not overlap each
+	// other, so this puts the newest entry for each key first.
+	iterators := []iterator{}
+	for _, t := range append(append([]*table{}, c.inputs...), c.overlapping...) {
+		iterators = append(iterators, t.iterator(""))
+	}
+	outputs, err := s.writeTables(&mergeIterator{iterators: iterators}, c.bottom, s.options.TableBytes)
+	if err != nil {
+		return false, errors.Wrap(err, "write tables")
+	}
+
+	s.mutex.Lock()
+	levels := s.copyLevels()
+	levels[c.level] = without(levels[c.level], c.inputs)
+	if len(levels) == c.level+1 {
+		levels = append(levels, []*table{})
+	}
+	next := append(without(levels[c.level+1], c.overlapping), outputs...)
+	sort.Slice(next, func(i, j int) bool {
+		return next[i].smallest < next[j].smallest
+	})
+	levels[c.level+1] = next
+	if err := s.saveLevels(levels); err != nil {
+		s.mutex.Unlock()
+		for _, t := range outputs {
+			t.close()
+			os.Remove(t.name())
+		}
+		return false, errors.Wrap(err, "save levels")
+	}
+	s.levels = levels
+	s.mutex.Unlock()
+
+	// Nothing can be reading the old tables anymore, since readers hold
+	// s.mutex while they do.
+	for _, t := range append(c.inputs, c.overlapping...) {
+		if err := t.close(); err != nil {
+			log.Warnf("close table %s: %s", t.name(), err.Error())
+		}
+		if err := os.Remove(t.name()); err != nil {
+			log.Warnf("remove table %s: %s", t.name(), err.Error())
+		}
+	}
+
+	return true, errors.Wrap(fileutil.SyncDir(s.dir), "sync dir")
+}
+
+// pickCompaction returns the compaction that is needed most, if any: level
+// 0 once it has too many tables, or else the first level that has gotten too
+// big. It must be called with s.mutex held.
+func (s *Store) pickCompaction() *compaction {
+	c := &compaction{}
+	if len(s.levels[0]) >= s.options.L0Tables {
+		c.inputs = append([]*table{}, s.levels[0]...)
+	} else {
+		for level := 1; level < len(s.levels); level++ {
+			if levelBytes(s.levels[level]) <= s.maxLevelBytes(level) {
+				continue
+			}
+
+			// Pick up where the last compaction of this level left off.
+			tables := s.levels[level]
+			t := tables[0]
+			for _, candidate := range tables {
+				if candidate.smallest > s.compactPointers[level] {
+					t = candidate
+					break
+				}
+			}
+			s.compactPointers[level] = t.largest
+
+			c.level = level
+			c.inputs = []*table{t}
+			break
+		}
+	}
+	if len(c.inputs) == 0 {
+		return nil
+	}
+
+	smallest, largest := c.inputs[0].smallest, c.inputs[0].largest
+	for _, t := range c.inputs {
+		if t.smallest < smallest {
+			smallest = t.smallest
+		}
+		if t.largest > largest {
+			largest = t.largest
+		}
+	}
+
+	if c.level+1 < len(s.levels) {
+		for _, t := range s.levels[c.level+1] {
+			if t.overlaps(smallest, largest) {
+				c.overlapping = append(c.overlapping, t)
+			}
+		}
+	}
+
+	c.bottom = true
+	for _, level := range s.levels[min(c.level+2, len(s.levels)):] {
+		if len(level) > 0 {
+			c.bottom = false
+		}
+	}
+
+	return c
+}
+
+func (s *Store) maxLevelBytes(level int) int64 {
+	return s.options.LevelBytes * int64(math.Pow10(level-1))
+}
+
+func levelBytes(level []*table) int64 {
+	total := int64(0)
+	for _, t := range level {
+		total += t.size
+	}
+	return total
+}
+
+func without(tables, remove []*table) []*table {
+	kept := []*table{}
+	for _, t := range tables {
+		removed := false
+		for _, r := range remove {
+			removed = removed || t == r
+		}
+		if !removed {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// writeTables writes the entries from the provided iterator out to new
+// tables, starting a new one whenever one reaches splitBytes (if it is not
+// zero), and opens them.
+func (s *Store) writeTables(
+	it iterator,
+	dropTombstones bool,
+	splitBytes int64,
+) ([]*table, error) {
+	tables := []*table{}
+	var w *tableWriter
+	abort := func() {
+		if w != nil {
+			w.abort()
+		}
+		for _, t := range tables {
+			t.close()
+			os.Remove(t.name())
+		}
+	}
+
+	finish := func() error {
+		if w == nil {
+			return nil
+		}
+		defer func() { w = nil }()
+
+		if w.empty() {
+			w.abort()
+			return nil
+		}
+
+		if err := w.finish(); err != nil {
+			return errors.Wrap(err, "finish table")
+		}
+		t, err := openTable(w.file.Name())
+		if err != nil {
+			return errors.Wrap(err, "open table")
+		}
+		tables = append(tables, t)
+
+		return nil
+	}
+
+	for {
+		e, ok, err := it.next()
+		if err != nil {
+			abort()
+			return nil, errors.Wrap(err, "next entry")
+		}
+		if !ok {
+			break
+		}
+		if e.deleted && dropTombstones {
+			continue
+		}
+
+		if w == nil {
+			s.mutex.Lock()
+			number := s.nextTable
+			s.nextTable++
+			s.mutex.Unlock()
+
+			if w, err = createTable(filepath.Join(s.dir, tableFilename(number)), s.options.BlockBytes); err != nil {
+				abort()
+				return nil, errors.Wrap(err, "create table")
+			}
+		}
+
+		if err := w.add(e); err != nil {
+			abort()
+			return nil, errors.Wrap(err, "add entry")
+		}
+
+		if splitBytes > 0 && w.size() >= splitBytes {
+			if err := finish(); err != nil {
+				abort()
+				return nil, err
+			}
+		}
+	}
+
+	if err := finish(); err != nil {
+		abort()
+		return nil, err
+	}
+
+	return tables, errors.Wrap(fileutil.SyncDir(s.dir), "sync dir")
+}
@@ -0,0 +1,83 @@
+package lsmstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ankeesler/andb/fileutil"
+	"github.com/pkg/errors"
+)
+
+// LevelsFile lists the tables in each level of the store, in the store dir.
+// It is replaced atomically whenever the tables change, so a crash leaves
+// either the old tables or the new ones in place, along with some table
+// files that nothing lists, which are removed on startup.
+const LevelsFile = "lsmlevels.json"
+
+const tableSuffix = ".sst"
+
+type levelsFile struct {
+	NextTable uint64     `json:"nextTable"`
+	Levels    [][]string `json:"levels"`
+}
+
+func tableFilename(number uint64) string {
+	return fmt.Sprintf("%06d%s", number, tableSuffix)
+}
+
+func loadLevels(dir string) (levelsFile, error) {
+	lf := levelsFile{NextTable: 1}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, LevelsFile))
+	if os.IsNotExist(err) {
+		return lf, nil
+	} else if err != nil {
+		return lf, errors.Wrap(err, "read file")
+	}
+
+	if err := json.Unmarshal(data, &lf); err != nil {
+		return lf, errors.Wrap(err, "unmarshal")
+	}
+
+	return lf, nil
+}
+
+func writeLevels(dir string, lf levelsFile) error {
+	data, err := json.MarshalIndent(&lf, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal")
+	}
+
+	return fileutil.ReplaceFile(filepath.Join(dir, LevelsFile), func(file *os.File) error {
+		_, err := file.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// removeUnlistedTables removes the table files that the crash of a flush or
+// compaction left behind.
+func removeUnlistedTables(dir string, lf levelsFile) error {
+	listed := make(map[string]bool)
+	for _, level := range lf.Levels {
+		for _, name := range level {
+			listed[name] = true
+		}
+	}
+
+	filenames, err := filepath.Glob(filepath.Join(dir, "*"+tableSuffix))
+	if err != nil {
+		return errors.Wrap(err, "glob")
+	}
+	for _, filename := range filenames {
+		if !listed[filepath.Base(filename)] {
+			if err := os.Remove(filename); err != nil {
+				return errors.Wrap(err, "remove")
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,514 @@
+// Package lsmstore is a log-structured merge-tree store. Writes go to a wal
+// and a memtable, which is flushed to an immutable, sorted table once it
+// gets big enough. Tables start out in level 0, and are merged down into
+// bigger, non-overlapping levels in the background.
+package lsmstore
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/ankeesler/andb/filestore/manifest"
+	"github.com/ankeesler/andb/fileutil"
+	api "github.com/ankeesler/andb/server"
+	"github.com/ankeesler/andb/wal"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// WALFile is the wal in the store dir. It has the same format as the file
+// engine's, but not the same name, so that neither engine mistakes the
+// other's store dir for its own.
+const WALFile = "lsmwal.log"
+
+// FlushingWALFile is the wal of the memtable that is being flushed. The wal
+// is renamed to it when the memtable fills up, and removed once the memtable
+// is in a table.
+const FlushingWALFile = "lsmwal.flushing.log"
+
+// Options tune the store. Zero values use the defaults.
+type Options struct {
+	// MemtableBytes is how big the memtable gets before it is flushed.
+	MemtableBytes int
+	// BlockBytes is how big each block in a table is.
+	BlockBytes int
+	// TableBytes is how big compaction lets each table get.
+	TableBytes int64
+	// L0Tables is how many tables level 0 holds before they are merged into
+	// level 1.
+	L0Tables int
+	// LevelBytes is how big level 1 gets before it is merged into level 2.
+	// Each level after it holds 10 times as much as the one before it.
+	LevelBytes int64
+}
+
+func (o *Options) setDefaults() {
+	if o.MemtableBytes <= 0 {
+		o.MemtableBytes = 4 << 20
+	}
+	if o.BlockBytes <= 0 {
+		o.BlockBytes = 4 << 10
+	}
+	if o.TableBytes <= 0 {
+		o.TableBytes = 2 << 20
+	}
+	if o.L0Tables <= 0 {
+		o.L0Tables = 4
+	}
+	if o.LevelBytes <= 0 {
+		o.LevelBytes = 10 << 20
+	}
+}
+
+type Store struct {
+	dir     string
+	options Options
+
+	walFile *os.File
+	wal     *wal.WAL
+
+	// writeMutex is held by writers, and guards walFile and wal, so that the
+	// wal and the memtable see writes in the same order, and so that only
+	// one of them swaps in a new memtable at a time.
+	writeMutex *sync.Mutex
+
+	// mutex guards the memtable, the memtable that is being flushed in the
+	// background (if there is one), and the levels of tables. Readers hold
+	// it for reading while they read tables, so tables are only closed once
+	// nothing can be reading them. flushed is closed once the last flush is
+	// done, and flushes counts the ones that are running.
+	mutex     *sync.RWMutex
+	memtable  *memtable
+	flushing  *memtable
+	flushed   chan struct{}
+	flushes   *sync.WaitGroup
+	levels    [][]*table
+	nextTable uint64
+
+	// compactPointers says where in each level compaction picks up from, so
+	// that it works its way through the level. It is only touched by the
+	// compactor.
+	compactPointers map[int]string
+
+	compactC chan struct{}
+	closeC   chan struct{}
+	doneC    chan struct{}
+
+	degraded    error
+	statusMutex *sync.Mutex
+}
+
+// Open opens the store in the provided dir, creating it if it does not
+// exist yet, and replays whatever writes are left in its wal.
+func Open(dir string, options Options) (*Store, error) {
+	options.setDefaults()
+
+	if _, err := os.Stat(filepath.Join(dir, manifest.Filename)); err == nil {
+		return nil, errors.Errorf("store dir %s holds a file engine store", dir)
+	}
+
+	lf, err := loadLevels(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "load levels")
+	}
+	if err := removeUnlistedTables(dir, lf); err != nil {
+		return nil, errors.Wrap(err, "remove unlisted tables")
+	}
+
+	s := &Store{
+		dir:        dir,
+		options:    options,
+		writeMutex: &sync.Mutex{},
+
+		mutex:     &sync.RWMutex{},
+		memtable:  newMemtable(),
+		flushed:   make(chan struct{}),
+		flushes:   &sync.WaitGroup{},
+		levels:    [][]*table{{}},
+		nextTable: lf.NextTable,
+
+		compactPointers: make(map[int]string),
+
+		compactC: make(chan struct{}, 1),
+		closeC:   make(chan struct{}),
+		doneC:    make(chan struct{}),
+
+		statusMutex: &sync.Mutex{},
+	}
+
+	for i, level := range lf.Levels {
+		if i >= len(s.levels) {
+			s.levels = append(s.levels, []*table{})
+		}
+		for _, name := range level {
+			t, err := openTable(filepath.Join(dir, name))
+			if err != nil {
+				s.closeTables()
+				return nil, errors.Wrap(err, "open table")
+			}
+			s.levels[i] = append(s.levels[i], t)
+		}
+	}
+
+	// A memtable that was being flushed when the last run died is flushed
+	// again, before anything is written on top of it.
+	flushing := newMemtable()
+	if err := replay(filepath.Join(dir, FlushingWALFile), flushing); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		s.closeTables()
+		return nil, errors.Wrap(err, "replay flushing wal")
+	}
+
+	if s.walFile, err = os.OpenFile(filepath.Join(dir, WALFile), os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		s.closeTables()
+		return nil, errors.Wrap(err, "open wal file")
+	}
+	s.wal = wal.New(s.walFile)
+	if err := replay(s.walFile.Name(), s.memtable); err != nil {
+		s.closeTables()
+		s.walFile.Close()
+		return nil, errors.Wrap(err, "replay wal")
+	}
+
+	if len(flushing.entries) > 0 {
+		s.flushing = flushing
+		s.flushes.Add(1)
+		go s.flush(flushing, s.flushed)
+	} else {
+		close(s.flushed)
+	}
+
+	go s.compactor()
+	s.triggerCompaction()
+
+	return s, nil
+}
+
+// replay puts the records in the wal at the provided path into the provided
+// memtable.
+func replay(filename string, m *memtable) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count := 0
+	if err := wal.New(file).ForEachRecord(func(r wal.Record) error {
+		m.put(entryOf(r))
+		count++
+		return nil
+	}); err != nil {
+		return err
+	}
+	if count > 0 {
+		log.Infof("replayed %d record(s) from %s", count, filename)
+	}
+
+	return nil
+}
+
+func entryOf(r wal.Record) entry {
+	return entry{key: r.Key, value: r.Value, deleted: r.Op == wal.OpDelete}
+}
+
+// Close stops the compactor, waits for any flush to finish, and closes every
+// file. The memtable is not flushed; it is rebuilt from the wal when the
+// store is opened again.
+func (s *Store) Close() error {
+	close(s.closeC)
+	<-s.doneC
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	s.flushes.Wait()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closeTables()
+	return s.walFile.Close()
+}
+
+func (s *Store) closeTables() {
+	for _, level := range s.levels {
+		for _, t := range level {
+			if err := t.close(); err != nil {
+				log.Warnf("close table %s: %s", t.name(), err.Error())
+			}
+		}
+	}
+}
+
+func (s *Store) Get(key string) (string, error) {
+	log.Debugf("begin get %s", key)
+	defer log.Debugf("end get %s", key)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	e, ok, err := s.get(key)
+	if err != nil {
+		return "", err
+	}
+	if !ok || e.deleted {
+		return "", errors.New("not found")
+	}
+
+	return e.value, nil
+}
+
+// get must be called with s.mutex held.
+func (s *Store) get(key string) (entry, bool, error) {
+	if e, ok := s.memtable.get(key); ok {
+		return e, true, nil
+	}
+	if s.flushing != nil {
+		if e, ok := s.flushing.get(key); ok {
+			return e, true, nil
+		}
+	}
+
+	for _, t := range s.levels[0] {
+		if e, ok, err := t.get(key); err != nil || ok {
+			return e, ok, errors.Wrapf(err, "get from table %s", t.name())
+		}
+	}
+
+	for _, level := range s.levels[1:] {
+		i := sort.Search(len(level), func(i int) bool {
+			return level[i].largest >= key
+		})
+		if i == len(level) {
+			continue
+		}
+
+		t := level[i]
+		if e, ok, err := t.get(key); err != nil || ok {
+			return e, ok, errors.Wrapf(err, "get from table %s", t.name())
+		}
+	}
+
+	return entry{}, false, nil
+}
+
+func (s *Store) Set(key, value string, durability api.Durability) error {
+	log.Debugf("begin set %s => %s (%s)", key, value, durability)
+	defer log.Debugf("end set %s => %s (%s)", key, value, durability)
+
+	return s.write(wal.Record{Op: wal.OpSet, Key: key, Value: value}, durability)
+}
+
+func (s *Store) Delete(key string, durability api.Durability) error {
+	log.Debugf("begin delete %s (%s)", key, durability)
+	defer log.Debugf("end delete %s (%s)", key, durability)
+
+	return s.write(wal.Record{Op: wal.OpDelete, Key: key}, durability)
+}
+
+// write appends the record to the wal before applying it to the memtable,
+// so every write is handed to the OS before it is acknowledged, whatever
+// durability was asked for.
+func (s *Store) write(r wal.Record, durability api.Durability) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.Status(); err != nil {
+		return errors.Wrap(err, "store is degraded")
+	}
+
+	if err := s.wal.Append([]wal.Record{r}); err != nil {
+		return s.degrade(errors.Wrap(err, "append to wal"))
+	}
+	if durability == api.Durability_FSYNCED {
+		if err := s.wal.Sync(); err != nil {
+			return s.degrade(errors.Wrap(err, "sync wal"))
+		}
+	}
+
+	s.mutex.Lock()
+	s.memtable.put(entryOf(r))
+	full := s.memtable.bytes >= s.options.MemtableBytes
+	s.mutex.Unlock()
+
+	if full {
+		if err := s.rotate(); err != nil {
+			return s.degrade(errors.Wrap(err, "rotate memtable"))
+		}
+	}
+
+	return nil
+}
+
+// rotate swaps in a new memtable and wal for the full ones, and flushes the
+// full memtable in the background. If the last one is still being flushed,
+// it waits for that first. It must be called with s.writeMutex held.
+func (s *Store) rotate() error {
+	s.mutex.RLock()
+	flushed := s.flushed
+	s.mutex.RUnlock()
+	<-flushed
+	if err := s.Status(); err != nil {
+		return errors.Wrap(err, "last flush failed")
+	}
+
+	// The full wal is synced, so that Sync only ever has to sync the new one.
+	if err := s.wal.Sync(); err != nil {
+		return errors.Wrap(err, "sync wal")
+	}
+	walFilename := filepath.Join(s.dir, WALFile)
+	if err := os.Rename(walFilename, filepath.Join(s.dir, FlushingWALFile)); err != nil {
+		return errors.Wrap(err, "rename wal")
+	}
+	walFile, err := os.OpenFile(walFilename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "create wal")
+	}
+	if err := fileutil.SyncDir(s.dir); err != nil {
+		walFile.Close()
+		return errors.Wrap(err, "sync dir")
+	}
+	if err := s.walFile.Close(); err != nil {
+		log.Warnf("close flushing wal: %s", err.Error())
+	}
+	s.walFile, s.wal = walFile, wal.New(walFile)
+
+	s.mutex.Lock()
+	m := s.memtable
+	s.flushing, s.memtable, s.flushed = m, newMemtable(), make(chan struct{})
+	flushed = s.flushed
+	s.mutex.Unlock()
+
+	s.flushes.Add(1)
+	go s.flush(m, flushed)
+
+	return nil
+}
+
+// flush writes the provided memtable out to a new level 0 table, throws
+// away the wal that it came from, and then closes flushed. If it fails, the
+// store is degraded, and the memtable is left for readers to read.
+func (s *Store) flush(m *memtable, flushed chan struct{}) {
+	defer s.flushes.Done()
+	defer close(flushed)
+
+	log.Debugf("flushing %d memtable entries", len(m.entries))
+
+	tables, err := s.writeTables(&sliceIterator{entries: m.sorted()}, false, 0)
+	if err != nil {
+		s.degrade(errors.Wrap(err, "flush memtable: write table"))
+		return
+	}
+
+	s.mutex.Lock()
+	levels := s.copyLevels()
+	levels[0] = append(tables, levels[0]...)
+	if err := s.saveLevels(levels); err != nil {
+		s.mutex.Unlock()
+		s.degrade(errors.Wrap(err, "flush memtable: save levels"))
+		return
+	}
+	s.levels, s.flushing = levels, nil
+	s.mutex.Unlock()
+
+	if err := os.Remove(filepath.Join(s.dir, FlushingWALFile)); err != nil {
+		s.degrade(errors.Wrap(err, "flush memtable: remove flushing wal"))
+		return
+	}
+	if err := fileutil.SyncDir(s.dir); err != nil {
+		s.degrade(errors.Wrap(err, "flush memtable: sync dir"))
+		return
+	}
+
+	s.triggerCompaction()
+}
+
+// copyLevels must be called with s.mutex held.
+func (s *Store) copyLevels() [][]*table {
+	levels := make([][]*table, len(s.levels))
+	for i, level := range s.levels {
+		levels[i] = append([]*table{}, level...)
+	}
+	return levels
+}
+
+// saveLevels writes out the levels file for the provided levels. It must be
+// called with s.mutex held.
+func (s *Store) saveLevels(levels [][]*table) error {
+	lf := levelsFile{NextTable: s.nextTable, Levels: make([][]string, len(levels))}
+	for i, level := range levels {
+		lf.Levels[i] = []string{}
+		for _, t := range level {
+			lf.Levels[i] = append(lf.Levels[i], filepath.Base(t.name()))
+		}
+	}
+
+	return writeLevels(s.dir, lf)
+}
+
+// Sync makes every write before it durable.
+func (s *Store) Sync() error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.Status(); err != nil {
+		return errors.Wrap(err, "store is degraded")
+	}
+
+	return errors.Wrap(s.wal.Sync(), "sync wal")
+}
+
+// Status returns the error that degraded the store, if there is one.
+func (s *Store) Status() error {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	return s.degraded
+}
+
+// degrade stops the store from taking any more writes, and returns the
+// error that made it do so.
+func (s *Store) degrade(err error) error {
+	s.statusMutex.Lock()
+	defer s.statusMutex.Unlock()
+
+	log.Errorf("degrading store: %s", err.Error())
+	if s.degraded == nil {
+		s.degraded = err
+	}
+
+	return err
+}
+
+// ForEach calls the provided handler with every key from the provided one
+// onward, in order, along with its value.
+func (s *Store) ForEach(from string, handler func(key, value string) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	iterators := []iterator{memtableIterator(s.memtable, from)}
+	if s.flushing != nil {
+		iterators = append(iterators, memtableIterator(s.flushing, from))
+	}
+	for _, level := range s.levels {
+		for _, t := range level {
+			iterators = append(iterators, t.iterator(from))
+		}
+	}
+
+	return merge(iterators, func(e entry) error {
+		if e.deleted {
+			return nil
+		}
+		return handler(e.key, e.value)
+	})
+}
+
+func memtableIterator(m *memtable, from string) iterator {
+	entries := m.sorted()
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].key >= from
+	})
+	return &sliceIterator{entries: entries[i:]}
+}
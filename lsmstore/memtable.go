@@ -0,0 +1,50 @@
+package lsmstore
+
+import "sort"
+
+// entry is a key and its value, or a tombstone if the key has been deleted.
+type entry struct {
+	key, value string
+	deleted    bool
+}
+
+// size returns roughly how many bytes the entry takes up in a table.
+func (e *entry) size() int {
+	return entryHeaderSize + len(e.key) + len(e.value)
+}
+
+// memtable holds the writes that have not been flushed to a table yet. It is
+// guarded by the store's mutex.
+type memtable struct {
+	entries map[string]entry
+	bytes   int
+}
+
+func newMemtable() *memtable {
+	return &memtable{entries: make(map[string]entry)}
+}
+
+func (m *memtable) put(e entry) {
+	if old, ok := m.entries[e.key]; ok {
+		m.bytes -= old.size()
+	}
+	m.entries[e.key] = e
+	m.bytes += e.size()
+}
+
+func (m *memtable) get(key string) (entry, bool) {
+	e, ok := m.entries[key]
+	return e, ok
+}
+
+// sorted returns the entries in key order.
+func (m *memtable) sorted() []entry {
+	entries := make([]entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries
+}
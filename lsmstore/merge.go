@@ -0,0 +1,93 @@
+package lsmstore
+
+// iterator returns entries in key order.
+type iterator interface {
+	// next returns the next entry, or false once there are none left.
+	next() (entry, bool, error)
+}
+
+type sliceIterator struct {
+	entries []entry
+}
+
+func (it *sliceIterator) next() (entry, bool, error) {
+	if len(it.entries) == 0 {
+		return entry{}, false, nil
+	}
+
+	e := it.entries[0]
+	it.entries = it.entries[1:]
+	return e, true, nil
+}
+
+// mergeIterator returns every key in its iterators, in order, along with its
+// entry from the first iterator that has it. Iterators must be passed newest
+// first.
+type mergeIterator struct {
+	iterators []iterator
+
+	heads   []entry
+	live    []bool
+	started bool
+}
+
+func (it *mergeIterator) advance(i int) error {
+	e, ok, err := it.iterators[i].next()
+	if err != nil {
+		return err
+	}
+	it.heads[i], it.live[i] = e, ok
+	return nil
+}
+
+func (it *mergeIterator) next() (entry, bool, error) {
+	if !it.started {
+		it.heads = make([]entry, len(it.iterators))
+		it.live = make([]bool, len(it.iterators))
+		for i := range it.iterators {
+			if err := it.advance(i); err != nil {
+				return entry{}, false, err
+			}
+		}
+		it.started = true
+	}
+
+	newest := -1
+	for i := range it.iterators {
+		if it.live[i] && (newest == -1 || it.heads[i].key < it.heads[newest].key) {
+			newest = i
+		}
+	}
+	if newest == -1 {
+		return entry{}, false, nil
+	}
+
+	e := it.heads[newest]
+	for i := range it.iterators {
+		if it.live[i] && it.heads[i].key == e.key {
+			if err := it.advance(i); err != nil {
+				return entry{}, false, err
+			}
+		}
+	}
+
+	return e, true, nil
+}
+
+// merge calls the provided handler with every entry from a mergeIterator
+// over the provided iterators.
+func merge(iterators []iterator, handler func(e entry) error) error {
+	it := &mergeIterator{iterators: iterators}
+	for {
+		e, ok, err := it.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := handler(e); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,446 @@
+package lsmstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// A table is an immutable, sorted file of entries. It is laid out as:
+//
+//   - data blocks, each a run of entries followed by their crc32
+//   - an index block, holding the table's smallest key and then the last key,
+//     offset, and length of each data block, followed by its crc32
+//   - a bloom filter over every key, followed by its crc32
+//   - a tableFooter
+//
+// Each entry is an entryHeader followed by the key and the value.
+type entryHeader struct {
+	Deleted     bool
+	KeyLength   uint32
+	ValueLength uint32
+}
+
+type tableFooter struct {
+	IndexOffset uint64
+	IndexLength uint32
+	BloomOffset uint64
+	BloomLength uint32
+	Entries     uint64
+	Magic       uint32
+	CRC32       uint32
+}
+
+const tableMagic = 0x4C534D54
+
+var (
+	entryHeaderSize = binary.Size(&entryHeader{})
+	tableFooterSize = binary.Size(&tableFooter{})
+
+	tableByteOrder = binary.BigEndian
+)
+
+type blockHandle struct {
+	lastKey string
+	offset  int64
+	length  int
+}
+
+// tableWriter writes a new table, which must be given its entries in key
+// order.
+type tableWriter struct {
+	file       *os.File
+	blockBytes int
+
+	block   *bytes.Buffer
+	offset  int64
+	index   []blockHandle
+	keys    []string
+	lastKey string
+}
+
+func createTable(filename string, blockBytes int) (*tableWriter, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "create file")
+	}
+
+	return &tableWriter{
+		file:       file,
+		blockBytes: blockBytes,
+		block:      bytes.NewBuffer([]byte{}),
+	}, nil
+}
+
+func (w *tableWriter) add(e entry) error {
+	if len(w.keys) > 0 && e.key <= w.lastKey {
+		return fmt.Errorf("key %q is out of order after %q", e.key, w.lastKey)
+	}
+
+	if err := binary.Write(w.block, tableByteOrder, &entryHeader{
+		Deleted:     e.deleted,
+		KeyLength:   uint32(len(e.key)),
+		ValueLength: uint32(len(e.value)),
+	}); err != nil {
+		return errors.Wrap(err, "encode entry header")
+	}
+	w.block.WriteString(e.key)
+	w.block.WriteString(e.value)
+	w.keys = append(w.keys, e.key)
+	w.lastKey = e.key
+
+	if w.block.Len() >= w.blockBytes {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// size returns how many bytes the table takes up so far.
+func (w *tableWriter) size() int64 {
+	return w.offset + int64(w.block.Len())
+}
+
+func (w *tableWriter) empty() bool {
+	return len(w.keys) == 0
+}
+
+func (w *tableWriter) flushBlock() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+
+	length := w.block.Len()
+	if err := w.writeChecksummed(w.block.Bytes()); err != nil {
+		return errors.Wrap(err, "write block")
+	}
+	w.index = append(w.index, blockHandle{lastKey: w.lastKey, offset: w.offset, length: length})
+	w.offset += int64(length) + 4
+	w.block.Reset()
+
+	return nil
+}
+
+// writeChecksummed writes the data followed by its crc32.
+func (w *tableWriter) writeChecksummed(data []byte) error {
+	crc := make([]byte, 4)
+	tableByteOrder.PutUint32(crc, crc32.ChecksumIEEE(data))
+	if _, err := w.file.Write(append(data, crc...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// finish writes out the rest of the table and syncs it.
+func (w *tableWriter) finish() error {
+	defer w.file.Close()
+
+	if err := w.flushBlock(); err != nil {
+		return err
+	}
+
+	index := bytes.NewBuffer([]byte{})
+	smallest := ""
+	if len(w.keys) > 0 {
+		smallest = w.keys[0]
+	}
+	writeString(index, smallest)
+	for _, h := range w.index {
+		writeString(index, h.lastKey)
+		binary.Write(index, tableByteOrder, uint64(h.offset))
+		binary.Write(index, tableByteOrder, uint32(h.length))
+	}
+
+	bloom := newBloom(len(w.keys))
+	for _, key := range w.keys {
+		bloom.add(key)
+	}
+	bloomData := bloom.encode()
+
+	footer := tableFooter{
+		IndexOffset: uint64(w.offset),
+		IndexLength: uint32(index.Len()),
+		BloomOffset: uint64(w.offset) + uint64(index.Len()) + 4,
+		BloomLength: uint32(len(bloomData)),
+		Entries:     uint64(len(w.keys)),
+		Magic:       tableMagic,
+	}
+	footer.CRC32 = footer.calculateCRC32()
+
+	if err := w.writeChecksummed(index.Bytes()); err != nil {
+		return errors.Wrap(err, "write index")
+	}
+	if err := w.writeChecksummed(bloomData); err != nil {
+		return errors.Wrap(err, "write bloom filter")
+	}
+	if err := binary.Write(w.file, tableByteOrder, &footer); err != nil {
+		return errors.Wrap(err, "write footer")
+	}
+
+	return errors.Wrap(w.file.Sync(), "sync")
+}
+
+// abort throws away a table that will never be finished.
+func (w *tableWriter) abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (f tableFooter) calculateCRC32() uint32 {
+	f.CRC32 = 0
+
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, tableByteOrder, &f)
+
+	return crc32.ChecksumIEEE(buf.Bytes())
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, tableByteOrder, uint32(len(s)))
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	var length uint32
+	if err := binary.Read(r, tableByteOrder, &length); err != nil {
+		return "", err
+	}
+	if int64(length) > int64(r.Len()) {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// table is an open table, with its index and bloom filter in memory. Its
+// blocks are read with ReadAt, so it can be read from concurrently.
+type table struct {
+	file              *os.File
+	size              int64
+	entries           uint64
+	smallest, largest string
+	index             []blockHandle
+	bloom             *bloom
+}
+
+func openTable(filename string) (*table, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "open file")
+	}
+
+	t, err := loadTable(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "load table %s", filename)
+	}
+
+	return t, nil
+}
+
+func loadTable(file *os.File) (*table, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, errors.Wrap(err, "stat")
+	}
+	if info.Size() < int64(tableFooterSize) {
+		return nil, errors.New("table is too short")
+	}
+
+	data := make([]byte, tableFooterSize)
+	if _, err := file.ReadAt(data, info.Size()-int64(tableFooterSize)); err != nil {
+		return nil, errors.Wrap(err, "read footer")
+	}
+	footer := tableFooter{}
+	if err := binary.Read(bytes.NewReader(data), tableByteOrder, &footer); err != nil {
+		return nil, errors.Wrap(err, "decode footer")
+	}
+	if footer.Magic != tableMagic {
+		return nil, fmt.Errorf("incorrect table magic (0x%08X)", footer.Magic)
+	}
+	if crc := footer.calculateCRC32(); crc != footer.CRC32 {
+		return nil, fmt.Errorf("incorrect footer crc32 (0x%08X != 0x%08X)", footer.CRC32, crc)
+	}
+
+	t := &table{file: file, size: info.Size(), entries: footer.Entries}
+
+	indexData, err := t.readChecksummed(int64(footer.IndexOffset), int(footer.IndexLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "read index")
+	}
+	r := bytes.NewReader(indexData)
+	if t.smallest, err = readString(r); err != nil {
+		return nil, errors.Wrap(err, "decode smallest key")
+	}
+	for r.Len() > 0 {
+		h := blockHandle{}
+		if h.lastKey, err = readString(r); err != nil {
+			return nil, errors.Wrap(err, "decode index")
+		}
+		var offset uint64
+		var length uint32
+		if err := binary.Read(r, tableByteOrder, &offset); err != nil {
+			return nil, errors.Wrap(err, "decode index")
+		}
+		if err := binary.Read(r, tableByteOrder, &length); err != nil {
+			return nil, errors.Wrap(err, "decode index")
+		}
+		h.offset, h.length = int64(offset), int(length)
+		t.index = append(t.index, h)
+	}
+	if len(t.index) > 0 {
+		t.largest = t.index[len(t.index)-1].lastKey
+	}
+
+	bloomData, err := t.readChecksummed(int64(footer.BloomOffset), int(footer.BloomLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "read bloom filter")
+	}
+	if t.bloom, err = decodeBloom(bloomData); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *table) name() string {
+	return t.file.Name()
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+// overlaps returns true if any of the table's keys could be between the
+// provided keys, inclusive.
+func (t *table) overlaps(smallest, largest string) bool {
+	return t.smallest <= largest && smallest <= t.largest
+}
+
+// readChecksummed reads the data at the provided offset and checks it
+// against the crc32 that follows it.
+func (t *table) readChecksummed(offset int64, length int) ([]byte, error) {
+	if offset < 0 || offset+int64(length)+4 > t.size {
+		return nil, fmt.Errorf("incorrect offset (%d) and length (%d)", offset, length)
+	}
+
+	data := make([]byte, length+4)
+	if _, err := t.file.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+
+	data, crc := data[:length], tableByteOrder.Uint32(data[length:])
+	if actual := crc32.ChecksumIEEE(data); actual != crc {
+		return nil, fmt.Errorf("incorrect crc32 (0x%08X != 0x%08X)", crc, actual)
+	}
+
+	return data, nil
+}
+
+func (t *table) readBlock(i int) ([]entry, error) {
+	h := t.index[i]
+	data, err := t.readChecksummed(h.offset, h.length)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read block %d", i)
+	}
+
+	entries := []entry{}
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		eh := entryHeader{}
+		if err := binary.Read(r, tableByteOrder, &eh); err != nil {
+			return nil, errors.Wrapf(err, "decode entry in block %d", i)
+		}
+		if int64(eh.KeyLength)+int64(eh.ValueLength) > int64(r.Len()) {
+			return nil, fmt.Errorf("entry in block %d is too long", i)
+		}
+
+		data := make([]byte, eh.KeyLength+eh.ValueLength)
+		io.ReadFull(r, data)
+		entries = append(entries, entry{
+			key:     string(data[:eh.KeyLength]),
+			value:   string(data[eh.KeyLength:]),
+			deleted: eh.Deleted,
+		})
+	}
+
+	return entries, nil
+}
+
+// get returns the table's entry for the provided key, if it has one.
+func (t *table) get(key string) (entry, bool, error) {
+	if key < t.smallest || key > t.largest || !t.bloom.mayContain(key) {
+		return entry{}, false, nil
+	}
+
+	i := t.findBlock(key)
+	if i == len(t.index) {
+		return entry{}, false, nil
+	}
+
+	entries, err := t.readBlock(i)
+	if err != nil {
+		return entry{}, false, err
+	}
+
+	j := sort.Search(len(entries), func(j int) bool {
+		return entries[j].key >= key
+	})
+	if j == len(entries) || entries[j].key != key {
+		return entry{}, false, nil
+	}
+
+	return entries[j], true, nil
+}
+
+// findBlock returns the first block that could hold the provided key.
+func (t *table) findBlock(key string) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return t.index[i].lastKey >= key
+	})
+}
+
+// iterator returns an iterator over the table's entries, starting at the
+// provided key.
+func (t *table) iterator(from string) iterator {
+	return &tableIterator{t: t, block: t.findBlock(from), from: from}
+}
+
+type tableIterator struct {
+	t       *table
+	block   int
+	from    string
+	entries []entry
+}
+
+func (it *tableIterator) next() (entry, bool, error) {
+	for len(it.entries) == 0 {
+		if it.block >= len(it.t.index) {
+			return entry{}, false, nil
+		}
+
+		entries, err := it.t.readBlock(it.block)
+		if err != nil {
+			return entry{}, false, err
+		}
+		it.block++
+
+		for len(entries) > 0 && entries[0].key < it.from {
+			entries = entries[1:]
+		}
+		it.entries = entries
+	}
+
+	e := it.entries[0]
+	it.entries = it.entries[1:]
+	return e, true, nil
+}
@@ -0,0 +1,161 @@
+package memstore
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+)
+
+// minLRUShardBytes is the smallest budget that an LRU gives a shard, so that
+// a small cache is not split so thin that nothing fits in it.
+const minLRUShardBytes = 64 << 10
+
+// LRU is a goroutine-safe cache that holds at most a fixed number of bytes of
+// keys and values, evicting the least recently used entries to make room for
+// new ones. The bytes are split across shards, each with its own lock, so
+// callers working on different keys rarely wait on each other; each shard
+// evicts its own least recently used entries. An entry bigger than a shard's
+// share of the bytes is never cached; see MaxEntryBytes.
+type LRU struct {
+	shards []*lruShard
+}
+
+type lruShard struct {
+	mutex    *sync.Mutex
+	maxBytes int64
+	entries  map[string]*list.Element
+	order    *list.List
+	stats    Stats
+}
+
+// Stats describes how well an LRU has been doing.
+type Stats struct {
+	Hits, Misses, Evictions uint64
+
+	// TooBig counts the entries that were not cached because they were
+	// bigger than MaxEntryBytes.
+	TooBig uint64
+
+	Entries int
+	Bytes   int64
+}
+
+type lruEntry struct {
+	key, value string
+}
+
+func (e *lruEntry) size() int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+func NewLRU(maxBytes int64) *LRU {
+	count := maxBytes / minLRUShardBytes
+	if count < 1 {
+		count = 1
+	} else if count > shardCount {
+		count = shardCount
+	}
+
+	l := &LRU{}
+	for i := int64(0); i < count; i++ {
+		l.shards = append(l.shards, &lruShard{
+			mutex:    &sync.Mutex{},
+			maxBytes: maxBytes / count,
+			entries:  make(map[string]*list.Element),
+			order:    list.New(),
+		})
+	}
+	return l
+}
+
+// MaxEntryBytes returns the most bytes of key and value that an entry can
+// have and still be cached, which is a shard's share of the cache: 1/32 of
+// it for caches of 2 MiB and up.
+func (l *LRU) MaxEntryBytes() int64 {
+	return l.shards[0].maxBytes
+}
+
+func (l *LRU) shardFor(key string) *lruShard {
+	return l.shards[hash(key)%uint32(len(l.shards))]
+}
+
+func (l *LRU) Get(key string) (string, error) {
+	sh := l.shardFor(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	element, ok := sh.entries[key]
+	if !ok {
+		sh.stats.Misses++
+		return "", errors.New("not found")
+	}
+
+	sh.stats.Hits++
+	sh.order.MoveToFront(element)
+	return element.Value.(*lruEntry).value, nil
+}
+
+func (l *LRU) Set(key, value string) error {
+	sh := l.shardFor(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.delete(key)
+
+	entry := &lruEntry{key: key, value: value}
+	if entry.size() > sh.maxBytes {
+		// This would evict everything else and still not fit.
+		sh.stats.TooBig++
+		return nil
+	}
+
+	for sh.stats.Bytes+entry.size() > sh.maxBytes {
+		sh.remove(sh.order.Back())
+		sh.stats.Evictions++
+	}
+
+	sh.entries[key] = sh.order.PushFront(entry)
+	sh.stats.Entries++
+	sh.stats.Bytes += entry.size()
+
+	return nil
+}
+
+func (l *LRU) Delete(key string) error {
+	sh := l.shardFor(key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.delete(key)
+	return nil
+}
+
+// Stats adds up the stats of every shard.
+func (l *LRU) Stats() Stats {
+	stats := Stats{}
+	for _, sh := range l.shards {
+		sh.mutex.Lock()
+		stats.Hits += sh.stats.Hits
+		stats.Misses += sh.stats.Misses
+		stats.Evictions += sh.stats.Evictions
+		stats.TooBig += sh.stats.TooBig
+		stats.Entries += sh.stats.Entries
+		stats.Bytes += sh.stats.Bytes
+		sh.mutex.Unlock()
+	}
+	return stats
+}
+
+func (sh *lruShard) delete(key string) {
+	if element, ok := sh.entries[key]; ok {
+		sh.remove(element)
+	}
+}
+
+func (sh *lruShard) remove(element *list.Element) {
+	entry := element.Value.(*lruEntry)
+	sh.order.Remove(element)
+	delete(sh.entries, entry.key)
+	sh.stats.Entries--
+	sh.stats.Bytes -= entry.size()
+}
@@ -1,28 +1,77 @@
 package memstore
 
-import "errors"
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+)
 
-type Memstore map[string]string
+// Memstore is a goroutine-safe map from keys to values. Its keys are spread
+// across shards, each with its own lock, so callers working on different
+// keys rarely wait on each other.
+type Memstore struct {
+	shards []*shard
+}
 
-func New() Memstore {
-	return make(map[string]string)
+type shard struct {
+	mutex   *sync.RWMutex
+	entries map[string]string
 }
 
-func (m Memstore) Get(key string) (string, error) {
-	value, ok := m[key]
-	if !ok {
-		return "", errors.New("not found")
-	} else {
-		return value, nil
-	}
+func New() *Memstore {
+	return &Memstore{shards: newShards()}
+}
+
+func (m *Memstore) Get(key string) (string, error) {
+	return shardFor(m.shards, key).get(key)
 }
 
-func (m Memstore) Set(key, value string) error {
-	m[key] = value
+func (m *Memstore) Set(key, value string) error {
+	sh := shardFor(m.shards, key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	sh.entries[key] = value
 	return nil
 }
 
-func (m Memstore) Delete(key string) error {
-	delete(m, key)
+func (m *Memstore) Delete(key string) error {
+	sh := shardFor(m.shards, key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	delete(sh.entries, key)
 	return nil
 }
+
+func newShards() []*shard {
+	shards := make([]*shard, shardCount)
+	for i := range shards {
+		shards[i] = &shard{
+			mutex:   &sync.RWMutex{},
+			entries: make(map[string]string),
+		}
+	}
+	return shards
+}
+
+func shardFor(shards []*shard, key string) *shard {
+	return shards[hash(key)%uint32(len(shards))]
+}
+
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (sh *shard) get(key string) (string, error) {
+	sh.mutex.RLock()
+	defer sh.mutex.RUnlock()
+
+	value, ok := sh.entries[key]
+	if !ok {
+		return "", errors.New("not found")
+	}
+	return value, nil
+}
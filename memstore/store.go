@@ -0,0 +1,242 @@
+package memstore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ankeesler/andb/fileutil"
+	api "github.com/ankeesler/andb/server"
+	"github.com/ankeesler/andb/wal"
+	pkgerrors "github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// SnapshotFile is where a Store snapshots itself, in the store dir.
+const SnapshotFile = "andbsnapshot.log"
+
+const shardCount = 32
+
+// snapshotLogBytes is how many bytes of fsynced writes get appended to the
+// snapshot before it is rewritten with just the latest value of each key.
+const snapshotLogBytes = 4 << 20
+
+// Store is a goroutine-safe in-memory store. Its keys are spread across
+// shards, each with its own lock, so writes to different keys rarely wait on
+// each other.
+//
+// A Store with a snapshot file writes every key out to it on Sync, on Close,
+// and once enough fsynced writes have been appended to it, and loads it back
+// in when it is opened. The snapshot is a log in the wal's record format,
+// replaced atomically; each fsynced write is appended to it and fsynced.
+type Store struct {
+	shards []*shard
+
+	// snapshotMutex is held by fsynced writes and by snapshots, so that the
+	// snapshot log has fsynced writes in the order that they were made, and
+	// so that each is either in a snapshot or appended after it. size is
+	// where the next write goes in the snapshot, and logBytes is how many
+	// bytes of writes have been appended since it was written.
+	snapshot      string
+	snapshotMutex *sync.Mutex
+	file          *os.File
+	log           *wal.WAL
+	size          int64
+	logBytes      int64
+}
+
+// NewStore returns an empty Store that never touches the disk.
+func NewStore() *Store {
+	return &Store{shards: newShards(), snapshotMutex: &sync.Mutex{}}
+}
+
+// OpenStore returns a Store that snapshots itself to the provided file,
+// starting with whatever is in it already.
+func OpenStore(snapshot string) (*Store, error) {
+	s := NewStore()
+	s.snapshot = snapshot
+
+	if err := s.openLog(); err != nil {
+		return nil, pkgerrors.Wrap(err, "open snapshot")
+	}
+
+	count, end := 0, int64(0)
+	if err := s.log.ForEachRecord(func(r wal.Record) error {
+		s.apply(r)
+		count++
+		end += wal.RecordSize(r)
+		return nil
+	}); err != nil {
+		s.file.Close()
+		return nil, pkgerrors.Wrap(err, "read snapshot")
+	}
+	log.Infof("loaded %d record(s) from snapshot %s", count, snapshot)
+
+	// A torn write at the end was never acknowledged, and the writes after
+	// it go where it was.
+	if s.size > end {
+		log.Warnf("discarding %d torn byte(s) from the end of snapshot %s", s.size-end, snapshot)
+		if err := s.log.Rewind(end); err != nil {
+			s.file.Close()
+			return nil, pkgerrors.Wrap(err, "rewind snapshot")
+		}
+		s.size = end
+	}
+
+	return s, nil
+}
+
+// openLog opens the snapshot file, creating it if it does not exist yet, so
+// that fsynced writes can be appended to it.
+func (s *Store) openLog() error {
+	file, err := os.OpenFile(s.snapshot, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := fileutil.SyncDir(filepath.Dir(s.snapshot)); err != nil {
+		file.Close()
+		return pkgerrors.Wrap(err, "sync dir")
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return pkgerrors.Wrap(err, "stat")
+	}
+
+	s.file, s.log, s.size, s.logBytes = file, wal.New(file), info.Size(), 0
+	return nil
+}
+
+func (s *Store) shardFor(key string) *shard {
+	return shardFor(s.shards, key)
+}
+
+func (s *Store) Get(key string) (string, error) {
+	return s.shardFor(key).get(key)
+}
+
+func (s *Store) Set(key, value string, durability api.Durability) error {
+	return s.write(wal.Record{Op: wal.OpSet, Key: key, Value: value}, durability)
+}
+
+func (s *Store) Delete(key string, durability api.Durability) error {
+	return s.write(wal.Record{Op: wal.OpDelete, Key: key}, durability)
+}
+
+// write applies the record to the store, appending it to the snapshot first
+// if it asked to be fsynced. Other writes are only as durable as the next
+// snapshot.
+func (s *Store) write(r wal.Record, durability api.Durability) error {
+	if durability != api.Durability_FSYNCED || s.snapshot == "" {
+		s.apply(r)
+		return nil
+	}
+
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	if s.log == nil {
+		if err := s.openLog(); err != nil {
+			return pkgerrors.Wrap(err, "open snapshot")
+		}
+	}
+
+	if err := s.log.Append([]wal.Record{r}); err != nil {
+		return s.rewind(pkgerrors.Wrap(err, "append to snapshot"))
+	}
+	if err := s.log.Sync(); err != nil {
+		return s.rewind(pkgerrors.Wrap(err, "sync snapshot"))
+	}
+	s.size += wal.RecordSize(r)
+	s.logBytes += wal.RecordSize(r)
+	s.apply(r)
+
+	if s.logBytes >= snapshotLogBytes {
+		return pkgerrors.Wrap(s.writeSnapshot(), "write snapshot")
+	}
+	return nil
+}
+
+// rewind throws away whatever a failed append left at the end of the
+// snapshot, and returns the error that it failed with.
+func (s *Store) rewind(err error) error {
+	if rewindErr := s.log.Rewind(s.size); rewindErr != nil {
+		log.Warnf("rewind snapshot: %s", rewindErr.Error())
+	}
+	return err
+}
+
+func (s *Store) apply(r wal.Record) {
+	sh := s.shardFor(r.Key)
+	sh.mutex.Lock()
+	defer sh.mutex.Unlock()
+
+	if r.Op == wal.OpDelete {
+		delete(sh.entries, r.Key)
+	} else {
+		sh.entries[r.Key] = r.Value
+	}
+}
+
+// Sync snapshots the store, if it has a snapshot file, with every write
+// before it.
+func (s *Store) Sync() error {
+	if s.snapshot == "" {
+		return nil
+	}
+
+	s.snapshotMutex.Lock()
+	defer s.snapshotMutex.Unlock()
+
+	return pkgerrors.Wrap(s.writeSnapshot(), "write snapshot")
+}
+
+// writeSnapshot replaces the snapshot with the latest value of each key, and
+// then appends fsynced writes to the new one. It must be called with
+// s.snapshotMutex held.
+func (s *Store) writeSnapshot() error {
+	records := []wal.Record{}
+	for _, sh := range s.shards {
+		sh.mutex.RLock()
+		for key, value := range sh.entries {
+			records = append(records, wal.Record{Op: wal.OpSet, Key: key, Value: value})
+		}
+		sh.mutex.RUnlock()
+	}
+
+	if err := writeSnapshot(s.snapshot, records); err != nil {
+		return err
+	}
+
+	// The old file is gone, so nothing can be appended to it.
+	if s.file != nil {
+		if err := s.file.Close(); err != nil {
+			log.Warnf("close old snapshot: %s", err.Error())
+		}
+		s.file, s.log = nil, nil
+	}
+	return pkgerrors.Wrap(s.openLog(), "open snapshot")
+}
+
+// Status always returns nil, since nothing stops the store taking writes.
+func (s *Store) Status() error {
+	return nil
+}
+
+// Close snapshots the store, if it has a snapshot file, and closes it.
+func (s *Store) Close() error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+func writeSnapshot(filename string, records []wal.Record) error {
+	return fileutil.ReplaceFile(filename, func(file *os.File) error {
+		return pkgerrors.Wrap(wal.New(file).Append(records), "append records")
+	})
+}
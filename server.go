@@ -2,10 +2,11 @@ package andb
 
 import (
 	"os"
-	"path/filepath"
+	"time"
 
 	"github.com/ankeesler/andb/filestore"
 	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/manifest"
 	"github.com/ankeesler/andb/filestore/metastore"
 	"github.com/ankeesler/andb/memstore"
 	api "github.com/ankeesler/andb/server"
@@ -21,9 +22,45 @@ type Config struct {
 
 	StoreDir string
 
+	// Engine names the registered storage engine that keeps the store dir.
+	// Empty means EngineFile.
+	Engine string
+
+	// EngineOptions are options that only the engine understands, by name.
+	EngineOptions map[string]string
+
+	// CompactInterval, IndexOnly, CacheBytes, and SegmentBytes only apply to
+	// the file engine, and the other engines refuse them.
+
+	// CompactInterval is how often the store checks whether its data file
+	// needs compacting. Zero disables background compaction.
+	CompactInterval time.Duration
+
+	// IndexOnly keeps only the key index in memory, and reads values from
+	// disk on demand.
+	IndexOnly bool
+
+	// CacheBytes bounds the memory used to cache keys and values, evicting
+	// the least recently used ones past it. Zero means the default: unbounded
+	// when every value is loaded anyway, and DefaultCacheBytes with
+	// IndexOnly. Negative means unbounded.
+	CacheBytes int64
+
+	// SegmentBytes is how big the active data segment gets before writes roll
+	// over to a new one. Zero uses datastore.DefaultSegmentSize.
+	SegmentBytes int64
+
+	// ReadOnly serves reads from a store dir that another server writes to,
+	// following along as it writes, and rejects writes.
+	ReadOnly bool
+
 	Address string
 }
 
+// DefaultCacheBytes bounds the cache in index-only mode unless CacheBytes
+// says otherwise.
+const DefaultCacheBytes = 64 << 20
+
 type server struct {
 	config *Config
 }
@@ -53,42 +90,133 @@ func (s *server) Run(signals <-chan os.Signal, ready chan<- struct{}) error {
 
 	log.Debugf("store dir: %s", s.config.StoreDir)
 
-	dataFile, err := openFile(filepath.Join(s.config.StoreDir, "andbdata.bin"))
-	if err != nil {
-		return errors.Wrap(err, "open data file")
-	}
-	defer dataFile.Close()
-	log.Debugf("data file: %s", dataFile.Name())
-
-	metaFile, err := openFile(filepath.Join(s.config.StoreDir, "andbmeta.bin"))
+	store, closeStore, err := openEngine(s.config)
 	if err != nil {
-		return errors.Wrap(err, "open data file")
+		return errors.Wrap(err, "open store")
 	}
-	defer metaFile.Close()
-	log.Debugf("meta file: %s", metaFile.Name())
-
-	cache := memstore.New()
-	ds := datastore.New(dataFile)
-	ms := metastore.New(metaFile)
-	fs := filestore.New(cache, ds, ms)
+	defer closeStore()
 
 	log.Debugf("listening on address %s", s.config.Address)
 
 	return grpc_server.NewGRPCServer(
 		s.config.Address,
 		nil, // tlsConfig, TODO: make this secure
-		api.New(fs),
+		api.New(store),
 		api.RegisterANDBServer,
 	).Run(signals, ready)
 }
 
-func openFile(filename string) (*os.File, error) {
-	file, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+// openFileEngine opens the store dir with the file engine, as a writer or
+// as a follower. It takes "compactinterval", "indexonly", "cachebytes", and
+// "segmentbytes" options, which override the config fields of the same name.
+func openFileEngine(config *Config) (api.Store, func(), error) {
+	c := *config
+	config = &c
+	if err := parseEngineOptions(config, map[string]interface{}{
+		"compactinterval": &config.CompactInterval,
+		"indexonly":       &config.IndexOnly,
+		"cachebytes":      &config.CacheBytes,
+		"segmentbytes":    &config.SegmentBytes,
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	cacheBytes := config.CacheBytes
+	if cacheBytes == 0 && config.IndexOnly {
+		cacheBytes = DefaultCacheBytes
+	}
+
+	var cache filestore.Cache = memstore.New()
+	logStats := func() {}
+	if cacheBytes > 0 {
+		lru := memstore.NewLRU(cacheBytes)
+		log.Debugf("cache bytes: %d (at most %d per entry)", cacheBytes, lru.MaxEntryBytes())
+		logStats = func() {
+			log.Infof("cache stats: %+v", lru.Stats())
+		}
+		cache = lru
+	} else {
+		log.Debugf("cache bytes: unbounded")
+	}
+
+	mode := filestore.ModeFull
+	if config.IndexOnly {
+		log.Debugf("index-only mode")
+		mode = filestore.ModeIndexOnly
+	}
+
+	open := openStore
+	if config.ReadOnly {
+		log.Debugf("read-only mode")
+		open = openFollower
+	}
+	fs, closeStore, err := open(config, cache, mode)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return fs, func() {
+		closeStore()
+		logStats()
+	}, nil
+}
+
+// openStore opens the store dir for writing, which only one server can do
+// at a time.
+func openStore(
+	config *Config,
+	cache filestore.Cache,
+	mode filestore.Mode,
+) (*filestore.Filestore, func(), error) {
+	fs, closeStore, err := filestore.Open(config.StoreDir, filestore.Options{
+		Cache:        cache,
+		Mode:         mode,
+		SegmentBytes: config.SegmentBytes,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if config.CompactInterval > 0 {
+		fs.StartCompactor(config.CompactInterval)
+	}
+
+	return fs, closeStore, nil
+}
+
+// openFollower opens an existing store dir that another server writes to,
+// without locking it.
+func openFollower(
+	config *Config,
+	cache filestore.Cache,
+	mode filestore.Mode,
+) (*filestore.Filestore, func(), error) {
+	m, err := manifest.Load(config.StoreDir)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "load manifest")
+	}
+	log.Debugf("following store %s (format version %d)", m.StoreID, m.FormatVersion)
+
+	ds, err := datastore.Open(m.Path(m.DataFile), datastore.ReadOnly)
 	if err != nil {
-		return nil, errors.Wrap(err, "open file")
+		return nil, nil, errors.Wrap(err, "open data file")
 	}
+	log.Debugf("data file: %s", ds.Name())
 
-	return file, nil
+	ms, err := metastore.Open(m.Path(m.MetaFile), metastore.ReadOnly)
+	if err != nil {
+		ds.Close()
+		return nil, nil, errors.Wrap(err, "open meta file")
+	}
+	log.Debugf("meta file: %s", ms.Name())
+
+	fs := filestore.NewFollower(cache, ds, ms, mode)
+
+	return fs, func() {
+		if err := fs.Close(); err != nil {
+			log.Warnf("close follower: %s", err.Error())
+		}
+	}, nil
 }
 
 func setLogFile(logFile string) (error, func() error) {
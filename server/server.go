@@ -3,6 +3,7 @@ package server
 import (
 	"context"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -10,11 +11,33 @@ import (
 
 type Store interface {
 	Get(string) (string, error)
-	Set(string, string) error
-	Delete(string) error
+	Set(string, string, Durability) error
+	Delete(string, Durability) error
 	Sync() error
+
+	// Status returns the error that made the store stop taking writes, if
+	// there is one.
+	Status() error
+}
+
+// A Scanner is a Store that keeps its keys in order, so that it can serve
+// Scan.
+type Scanner interface {
+	// ForEach calls the provided handler with every key from the provided
+	// one onward, in order, along with its value. It stops at the first
+	// error that the handler returns, and returns it.
+	ForEach(from string, handler func(key, value string) error) error
 }
 
+// errScanDone stops a ForEach once a scan has every key that it wants, or
+// every key that fits in its response.
+var errScanDone = errors.New("scan done")
+
+// scanPageBytes caps the keys and values in a ScanResponse, so that it stays
+// well under gRPC's default 4 MiB message limit. A response always holds at
+// least one entry, though.
+const scanPageBytes = 1 << 20
+
 type server struct {
 	store Store
 }
@@ -41,10 +64,10 @@ func (s *server) Get(ctx context.Context, r *GetRequest) (*GetResponse, error) {
 }
 
 func (s *server) Set(ctx context.Context, r *SetRequest) (*SetResponse, error) {
-	log.Debugf("set %s => %s", r.Key, r.Value)
+	log.Debugf("set %s => %s (%s)", r.Key, r.Value, r.Durability)
 
 	var status string
-	if err := s.store.Set(r.Key, r.Value); err != nil {
+	if err := s.store.Set(r.Key, r.Value, r.Durability); err != nil {
 		status = err.Error()
 	} else {
 		status = "ok"
@@ -54,10 +77,10 @@ func (s *server) Set(ctx context.Context, r *SetRequest) (*SetResponse, error) {
 }
 
 func (s *server) Delete(ctx context.Context, r *DeleteRequest) (*DeleteResponse, error) {
-	log.Debugf("delete %s", r.Key)
+	log.Debugf("delete %s (%s)", r.Key, r.Durability)
 
 	var status string
-	if err := s.store.Delete(r.Key); err != nil {
+	if err := s.store.Delete(r.Key, r.Durability); err != nil {
 		status = err.Error()
 	} else {
 		status = "ok"
@@ -78,3 +101,47 @@ func (s *server) Sync(ctx context.Context, r *SyncRequest) (*SyncResponse, error
 
 	return &SyncResponse{Status: status}, nil
 }
+
+func (s *server) Status(ctx context.Context, r *StatusRequest) (*StatusResponse, error) {
+	log.Debugf("status")
+
+	rsp := StatusResponse{Status: "ok"}
+	if err := s.store.Status(); err != nil {
+		rsp.Degraded = true
+		rsp.Failure = err.Error()
+	}
+
+	return &rsp, nil
+}
+
+func (s *server) Scan(ctx context.Context, r *ScanRequest) (*ScanResponse, error) {
+	log.Debugf("scan %s to %s (limit %d)", r.Start, r.End, r.Limit)
+
+	scanner, ok := s.store.(Scanner)
+	if !ok {
+		return &ScanResponse{Status: "store cannot scan keys in order"}, nil
+	}
+
+	rsp := ScanResponse{Status: "ok", Entries: []*KeyValue{}}
+	size := 0
+	err := scanner.ForEach(r.Start, func(key, value string) error {
+		if r.End != "" && key >= r.End {
+			return errScanDone
+		}
+		if len(rsp.Entries) > 0 && size+len(key)+len(value) > scanPageBytes {
+			rsp.Next = key
+			return errScanDone
+		}
+		rsp.Entries = append(rsp.Entries, &KeyValue{Key: key, Value: value})
+		size += len(key) + len(value)
+		if r.Limit > 0 && len(rsp.Entries) >= int(r.Limit) {
+			return errScanDone
+		}
+		return nil
+	})
+	if err != nil && err != errScanDone {
+		return &ScanResponse{Status: err.Error()}, nil
+	}
+
+	return &rsp, nil
+}
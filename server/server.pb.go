@@ -22,6 +22,38 @@ var _ = math.Inf
 // proto package needs to be updated.
 const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
 
+// Durability says how far a write must get before it is acknowledged.
+type Durability int32
+
+const (
+	// ASYNC writes are acknowledged as soon as they are queued.
+	Durability_ASYNC Durability = 0
+	// WRITTEN writes are acknowledged once they have been handed to the OS.
+	Durability_WRITTEN Durability = 1
+	// FSYNCED writes are acknowledged once they have been fsynced to disk.
+	Durability_FSYNCED Durability = 2
+)
+
+var Durability_name = map[int32]string{
+	0: "ASYNC",
+	1: "WRITTEN",
+	2: "FSYNCED",
+}
+
+var Durability_value = map[string]int32{
+	"ASYNC":   0,
+	"WRITTEN": 1,
+	"FSYNCED": 2,
+}
+
+func (x Durability) String() string {
+	return proto.EnumName(Durability_name, int32(x))
+}
+
+func (Durability) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_ad098daeda4239f7, []int{0}
+}
+
 type GetRequest struct {
 	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -109,11 +141,12 @@ func (m *GetResponse) GetValue() string {
 }
 
 type SetRequest struct {
-	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
-	Value                string   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Key                  string     `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value                string     `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	Durability           Durability `protobuf:"varint,3,opt,name=durability,proto3,enum=server.Durability" json:"durability,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
 }
 
 func (m *SetRequest) Reset()         { *m = SetRequest{} }
@@ -155,6 +188,13 @@ func (m *SetRequest) GetValue() string {
 	return ""
 }
 
+func (m *SetRequest) GetDurability() Durability {
+	if m != nil {
+		return m.Durability
+	}
+	return Durability_ASYNC
+}
+
 type SetResponse struct {
 	Status               string   `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -195,10 +235,11 @@ func (m *SetResponse) GetStatus() string {
 }
 
 type DeleteRequest struct {
-	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
-	XXX_NoUnkeyedLiteral struct{} `json:"-"`
-	XXX_unrecognized     []byte   `json:"-"`
-	XXX_sizecache        int32    `json:"-"`
+	Key                  string     `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Durability           Durability `protobuf:"varint,2,opt,name=durability,proto3,enum=server.Durability" json:"durability,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
 }
 
 func (m *DeleteRequest) Reset()         { *m = DeleteRequest{} }
@@ -233,6 +274,13 @@ func (m *DeleteRequest) GetKey() string {
 	return ""
 }
 
+func (m *DeleteRequest) GetDurability() Durability {
+	if m != nil {
+		return m.Durability
+	}
+	return Durability_ASYNC
+}
+
 type DeleteResponse struct {
 	Status               string   `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
@@ -342,7 +390,259 @@ func (m *SyncResponse) GetStatus() string {
 	return ""
 }
 
+type StatusRequest struct {
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StatusRequest) Reset()         { *m = StatusRequest{} }
+func (m *StatusRequest) String() string { return proto.CompactTextString(m) }
+func (*StatusRequest) ProtoMessage()    {}
+func (*StatusRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ad098daeda4239f7, []int{8}
+}
+
+func (m *StatusRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatusRequest.Unmarshal(m, b)
+}
+func (m *StatusRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatusRequest.Marshal(b, m, deterministic)
+}
+func (m *StatusRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatusRequest.Merge(m, src)
+}
+func (m *StatusRequest) XXX_Size() int {
+	return xxx_messageInfo_StatusRequest.Size(m)
+}
+func (m *StatusRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatusRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatusRequest proto.InternalMessageInfo
+
+type StatusResponse struct {
+	Status string `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	// degraded is set when the store has stopped taking writes because one
+	// of them failed; failure says why.
+	Degraded             bool     `protobuf:"varint,2,opt,name=degraded,proto3" json:"degraded,omitempty"`
+	Failure              string   `protobuf:"bytes,3,opt,name=failure,proto3" json:"failure,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *StatusResponse) Reset()         { *m = StatusResponse{} }
+func (m *StatusResponse) String() string { return proto.CompactTextString(m) }
+func (*StatusResponse) ProtoMessage()    {}
+func (*StatusResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ad098daeda4239f7, []int{9}
+}
+
+func (m *StatusResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_StatusResponse.Unmarshal(m, b)
+}
+func (m *StatusResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_StatusResponse.Marshal(b, m, deterministic)
+}
+func (m *StatusResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_StatusResponse.Merge(m, src)
+}
+func (m *StatusResponse) XXX_Size() int {
+	return xxx_messageInfo_StatusResponse.Size(m)
+}
+func (m *StatusResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_StatusResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_StatusResponse proto.InternalMessageInfo
+
+func (m *StatusResponse) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *StatusResponse) GetDegraded() bool {
+	if m != nil {
+		return m.Degraded
+	}
+	return false
+}
+
+func (m *StatusResponse) GetFailure() string {
+	if m != nil {
+		return m.Failure
+	}
+	return ""
+}
+
+// ScanRequest asks for the keys from start up to (but not including) end, in
+// order. An empty end means every key from start onward, and a limit of zero
+// means no limit. The server may return fewer keys than were asked for, in
+// which case the response says where to carry on from.
+type ScanRequest struct {
+	Start                string   `protobuf:"bytes,1,opt,name=start,proto3" json:"start,omitempty"`
+	End                  string   `protobuf:"bytes,2,opt,name=end,proto3" json:"end,omitempty"`
+	Limit                int32    `protobuf:"varint,3,opt,name=limit,proto3" json:"limit,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ScanRequest) Reset()         { *m = ScanRequest{} }
+func (m *ScanRequest) String() string { return proto.CompactTextString(m) }
+func (*ScanRequest) ProtoMessage()    {}
+func (*ScanRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ad098daeda4239f7, []int{10}
+}
+
+func (m *ScanRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ScanRequest.Unmarshal(m, b)
+}
+func (m *ScanRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ScanRequest.Marshal(b, m, deterministic)
+}
+func (m *ScanRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ScanRequest.Merge(m, src)
+}
+func (m *ScanRequest) XXX_Size() int {
+	return xxx_messageInfo_ScanRequest.Size(m)
+}
+func (m *ScanRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_ScanRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ScanRequest proto.InternalMessageInfo
+
+func (m *ScanRequest) GetStart() string {
+	if m != nil {
+		return m.Start
+	}
+	return ""
+}
+
+func (m *ScanRequest) GetEnd() string {
+	if m != nil {
+		return m.End
+	}
+	return ""
+}
+
+func (m *ScanRequest) GetLimit() int32 {
+	if m != nil {
+		return m.Limit
+	}
+	return 0
+}
+
+type KeyValue struct {
+	Key                  string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Value                string   `protobuf:"bytes,2,opt,name=value,proto3" json:"value,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *KeyValue) Reset()         { *m = KeyValue{} }
+func (m *KeyValue) String() string { return proto.CompactTextString(m) }
+func (*KeyValue) ProtoMessage()    {}
+func (*KeyValue) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ad098daeda4239f7, []int{11}
+}
+
+func (m *KeyValue) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_KeyValue.Unmarshal(m, b)
+}
+func (m *KeyValue) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_KeyValue.Marshal(b, m, deterministic)
+}
+func (m *KeyValue) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_KeyValue.Merge(m, src)
+}
+func (m *KeyValue) XXX_Size() int {
+	return xxx_messageInfo_KeyValue.Size(m)
+}
+func (m *KeyValue) XXX_DiscardUnknown() {
+	xxx_messageInfo_KeyValue.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_KeyValue proto.InternalMessageInfo
+
+func (m *KeyValue) GetKey() string {
+	if m != nil {
+		return m.Key
+	}
+	return ""
+}
+
+func (m *KeyValue) GetValue() string {
+	if m != nil {
+		return m.Value
+	}
+	return ""
+}
+
+type ScanResponse struct {
+	Status  string      `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Entries []*KeyValue `protobuf:"bytes,2,rep,name=entries,proto3" json:"entries,omitempty"`
+	// next is set when the entries filled a page before the scan was done, to
+	// the key that the next page starts at.
+	Next                 string   `protobuf:"bytes,3,opt,name=next,proto3" json:"next,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *ScanResponse) Reset()         { *m = ScanResponse{} }
+func (m *ScanResponse) String() string { return proto.CompactTextString(m) }
+func (*ScanResponse) ProtoMessage()    {}
+func (*ScanResponse) Descriptor() ([]byte, []int) {
+	return fileDescriptor_ad098daeda4239f7, []int{12}
+}
+
+func (m *ScanResponse) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_ScanResponse.Unmarshal(m, b)
+}
+func (m *ScanResponse) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_ScanResponse.Marshal(b, m, deterministic)
+}
+func (m *ScanResponse) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_ScanResponse.Merge(m, src)
+}
+func (m *ScanResponse) XXX_Size() int {
+	return xxx_messageInfo_ScanResponse.Size(m)
+}
+func (m *ScanResponse) XXX_DiscardUnknown() {
+	xxx_messageInfo_ScanResponse.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_ScanResponse proto.InternalMessageInfo
+
+func (m *ScanResponse) GetStatus() string {
+	if m != nil {
+		return m.Status
+	}
+	return ""
+}
+
+func (m *ScanResponse) GetEntries() []*KeyValue {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+func (m *ScanResponse) GetNext() string {
+	if m != nil {
+		return m.Next
+	}
+	return ""
+}
+
 func init() {
+	proto.RegisterEnum("server.Durability", Durability_name, Durability_value)
 	proto.RegisterType((*GetRequest)(nil), "server.GetRequest")
 	proto.RegisterType((*GetResponse)(nil), "server.GetResponse")
 	proto.RegisterType((*SetRequest)(nil), "server.SetRequest")
@@ -351,28 +651,47 @@ func init() {
 	proto.RegisterType((*DeleteResponse)(nil), "server.DeleteResponse")
 	proto.RegisterType((*SyncRequest)(nil), "server.SyncRequest")
 	proto.RegisterType((*SyncResponse)(nil), "server.SyncResponse")
+	proto.RegisterType((*StatusRequest)(nil), "server.StatusRequest")
+	proto.RegisterType((*StatusResponse)(nil), "server.StatusResponse")
+	proto.RegisterType((*ScanRequest)(nil), "server.ScanRequest")
+	proto.RegisterType((*KeyValue)(nil), "server.KeyValue")
+	proto.RegisterType((*ScanResponse)(nil), "server.ScanResponse")
 }
 
 func init() { proto.RegisterFile("server.proto", fileDescriptor_ad098daeda4239f7) }
 
 var fileDescriptor_ad098daeda4239f7 = []byte{
-	// 248 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x29, 0x4e, 0x2d, 0x2a,
-	0x4b, 0x2d, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0x62, 0x83, 0xf0, 0x94, 0xe4, 0xb8, 0xb8,
-	0xdc, 0x53, 0x4b, 0x82, 0x52, 0x0b, 0x4b, 0x53, 0x8b, 0x4b, 0x84, 0x04, 0xb8, 0x98, 0xb3, 0x53,
-	0x2b, 0x25, 0x18, 0x15, 0x18, 0x35, 0x38, 0x83, 0x40, 0x4c, 0x25, 0x6b, 0x2e, 0x6e, 0xb0, 0x7c,
-	0x71, 0x41, 0x7e, 0x5e, 0x71, 0xaa, 0x90, 0x18, 0x17, 0x5b, 0x71, 0x49, 0x62, 0x49, 0x69, 0x31,
-	0x54, 0x0d, 0x94, 0x27, 0x24, 0xc2, 0xc5, 0x5a, 0x96, 0x98, 0x53, 0x9a, 0x2a, 0xc1, 0x04, 0x16,
-	0x86, 0x70, 0x94, 0x4c, 0xb8, 0xb8, 0x82, 0xf1, 0x18, 0x8e, 0x43, 0x97, 0x2a, 0x17, 0x77, 0x30,
-	0x61, 0x2b, 0x95, 0x14, 0xb9, 0x78, 0x5d, 0x52, 0x73, 0x52, 0x4b, 0x52, 0x71, 0x3b, 0x5e, 0x83,
-	0x8b, 0x0f, 0xa6, 0x84, 0x80, 0x61, 0xbc, 0x5c, 0xdc, 0xc1, 0x95, 0x79, 0xc9, 0x50, 0xa3, 0x94,
-	0xd4, 0xb8, 0x78, 0x20, 0x5c, 0xfc, 0xda, 0x8c, 0x6e, 0x31, 0x72, 0xb1, 0x38, 0xfa, 0xb9, 0x38,
-	0x09, 0x19, 0x70, 0x31, 0xbb, 0xa7, 0x96, 0x08, 0x09, 0xe9, 0x41, 0x03, 0x19, 0x11, 0xa6, 0x52,
-	0xc2, 0x28, 0x62, 0x10, 0x03, 0x95, 0x18, 0x40, 0x3a, 0x82, 0x91, 0x75, 0x04, 0x63, 0xd1, 0x11,
-	0x8c, 0xa2, 0xc3, 0x92, 0x8b, 0x0d, 0xe2, 0x1b, 0x21, 0x51, 0x98, 0x02, 0x94, 0x00, 0x90, 0x12,
-	0x43, 0x17, 0x86, 0x6b, 0x35, 0xe6, 0x62, 0x01, 0xf9, 0x47, 0x08, 0x61, 0x32, 0xc2, 0xb3, 0x52,
-	0x22, 0xa8, 0x82, 0x30, 0x4d, 0x49, 0x6c, 0xe0, 0x94, 0x62, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff,
-	0xff, 0x54, 0x58, 0x8b, 0x39, 0x02, 0x00, 0x00,
+	// 469 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x4d, 0x6f, 0xd3, 0x40,
+	0x14, 0x6c, 0x9c, 0xef, 0x71, 0x12, 0xac, 0x25, 0x44, 0x96, 0x0f, 0x28, 0x5a, 0x09, 0x14, 0xf5,
+	0x50, 0x81, 0x7b, 0x42, 0x9c, 0x0a, 0x29, 0x15, 0xaa, 0x94, 0x83, 0x5d, 0x40, 0x5c, 0x90, 0xdc,
+	0xf8, 0x15, 0x2c, 0x8c, 0x53, 0xec, 0x75, 0x45, 0xfe, 0x22, 0xbf, 0x0a, 0xd9, 0xeb, 0xf5, 0x47,
+	0x55, 0xea, 0xdc, 0x76, 0xc6, 0x3b, 0x6f, 0xde, 0xdb, 0x37, 0x09, 0x26, 0x09, 0xc5, 0x77, 0x14,
+	0x9f, 0xdc, 0xc6, 0x3b, 0xb1, 0x63, 0x03, 0x89, 0xf8, 0x73, 0xe0, 0x82, 0x84, 0x43, 0xbf, 0x53,
+	0x4a, 0x04, 0x33, 0xd0, 0xfd, 0x49, 0x7b, 0xb3, 0xb3, 0xec, 0xac, 0xc6, 0x4e, 0x76, 0xe4, 0x6f,
+	0xa1, 0xe7, 0xdf, 0x93, 0xdb, 0x5d, 0x94, 0x10, 0x5b, 0x60, 0x90, 0x08, 0x4f, 0xa4, 0x49, 0x71,
+	0xa7, 0x40, 0x6c, 0x8e, 0xfe, 0x9d, 0x17, 0xa6, 0x64, 0x6a, 0x39, 0x2d, 0x01, 0xff, 0x01, 0xb8,
+	0x8f, 0x14, 0x7f, 0x58, 0xc5, 0x6c, 0xc0, 0x4f, 0x63, 0xef, 0x3a, 0x08, 0x03, 0xb1, 0x37, 0xbb,
+	0xcb, 0xce, 0x6a, 0x66, 0xb3, 0x93, 0xa2, 0xfb, 0x75, 0xf9, 0xc5, 0xa9, 0xdd, 0xe2, 0x2f, 0xa0,
+	0xbb, 0xed, 0x6d, 0xf2, 0x4f, 0x98, 0xae, 0x29, 0x24, 0x41, 0xff, 0xef, 0xa9, 0xe9, 0xae, 0x1d,
+	0xe4, 0xbe, 0xc2, 0x4c, 0x95, 0x6d, 0x69, 0x60, 0x0a, 0xdd, 0xdd, 0x47, 0xdb, 0xc2, 0x9e, 0xbf,
+	0xc4, 0x44, 0xc2, 0x16, 0xd9, 0x13, 0x4c, 0xdd, 0xfc, 0xa4, 0x84, 0xdf, 0x30, 0x53, 0x44, 0xcb,
+	0x66, 0x2c, 0x8c, 0x7c, 0xfa, 0x1e, 0x7b, 0x3e, 0xf9, 0xf9, 0x34, 0x23, 0xa7, 0xc4, 0xcc, 0xc4,
+	0xf0, 0xc6, 0x0b, 0xc2, 0x34, 0xa6, 0xfc, 0x99, 0xc7, 0x8e, 0x82, 0xfc, 0x12, 0xba, 0xbb, 0xf5,
+	0x22, 0xf5, 0x4c, 0x73, 0xf4, 0x13, 0xe1, 0xc5, 0xa2, 0xa8, 0x2d, 0x41, 0xf6, 0x78, 0x14, 0xf9,
+	0xc5, 0xf2, 0xb2, 0x63, 0x76, 0x2f, 0x0c, 0x7e, 0x05, 0x22, 0x2f, 0xd7, 0x77, 0x24, 0xe0, 0x36,
+	0x46, 0x97, 0xb4, 0xff, 0x9c, 0x2f, 0xf7, 0xc0, 0x10, 0xf0, 0x1b, 0x4c, 0x64, 0x03, 0x2d, 0xe3,
+	0x1d, 0x63, 0x48, 0x91, 0x88, 0x03, 0x4a, 0x4c, 0x6d, 0xd9, 0x5d, 0xe9, 0xb6, 0xa1, 0x76, 0xa5,
+	0x2c, 0x1d, 0x75, 0x81, 0x31, 0xf4, 0x22, 0xfa, 0x23, 0x8a, 0x59, 0xf3, 0xf3, 0xf1, 0x6b, 0xa0,
+	0x5a, 0x2a, 0x1b, 0xa3, 0x7f, 0xe6, 0x7e, 0xdd, 0xbc, 0x37, 0x8e, 0x98, 0x8e, 0xe1, 0x17, 0xe7,
+	0xe3, 0xd5, 0xd5, 0xf9, 0xc6, 0xe8, 0x64, 0xe0, 0x43, 0xc6, 0x9f, 0xaf, 0x0d, 0xcd, 0xfe, 0xab,
+	0xa1, 0x77, 0xb6, 0x59, 0xbf, 0x63, 0xaf, 0xd0, 0xbd, 0x20, 0xc1, 0xca, 0x74, 0x54, 0x3f, 0x24,
+	0xeb, 0x69, 0x83, 0x93, 0x33, 0xf0, 0xa3, 0x4c, 0xe1, 0xd6, 0x15, 0xee, 0x03, 0x0a, 0xb7, 0xa1,
+	0x78, 0x83, 0x81, 0x8c, 0x16, 0x7b, 0x56, 0x86, 0xb0, 0x9e, 0x60, 0x6b, 0x71, 0x9f, 0x2e, 0xa5,
+	0xa7, 0xe8, 0x65, 0xe1, 0x62, 0x55, 0xe5, 0x2a, 0x79, 0xd6, 0xbc, 0x49, 0xd6, 0xfd, 0x64, 0xb0,
+	0x2a, 0xbf, 0x46, 0xf2, 0xac, 0xc5, 0x7d, 0xba, 0xe1, 0xb7, 0xf5, 0xa2, 0x9a, 0x5f, 0x95, 0x20,
+	0x6b, 0xde, 0x24, 0x95, 0xe8, 0x7a, 0x90, 0xff, 0x1d, 0x9d, 0xfe, 0x1b, 0x00, 0x04, 0xe1, 0x6e,
+	0x30, 0x9e, 0x04, 0x00, 0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -391,6 +710,8 @@ type ANDBClient interface {
 	Set(ctx context.Context, in *SetRequest, opts ...grpc.CallOption) (*SetResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
 	Sync(ctx context.Context, in *SyncRequest, opts ...grpc.CallOption) (*SyncResponse, error)
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error)
 }
 
 type aNDBClient struct {
@@ -437,12 +758,32 @@ func (c *aNDBClient) Sync(ctx context.Context, in *SyncRequest, opts ...grpc.Cal
 	return out, nil
 }
 
+func (c *aNDBClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, "/server.ANDB/Status", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *aNDBClient) Scan(ctx context.Context, in *ScanRequest, opts ...grpc.CallOption) (*ScanResponse, error) {
+	out := new(ScanResponse)
+	err := c.cc.Invoke(ctx, "/server.ANDB/Scan", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ANDBServer is the server API for ANDB service.
 type ANDBServer interface {
 	Get(context.Context, *GetRequest) (*GetResponse, error)
 	Set(context.Context, *SetRequest) (*SetResponse, error)
 	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
 	Sync(context.Context, *SyncRequest) (*SyncResponse, error)
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	Scan(context.Context, *ScanRequest) (*ScanResponse, error)
 }
 
 func RegisterANDBServer(s *grpc.Server, srv ANDBServer) {
@@ -521,6 +862,42 @@ func _ANDB_Sync_Handler(srv interface{}, ctx context.Context, dec func(interface
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ANDB_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ANDBServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/server.ANDB/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ANDBServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ANDB_Scan_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ScanRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ANDBServer).Scan(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/server.ANDB/Scan",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ANDBServer).Scan(ctx, req.(*ScanRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _ANDB_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "server.ANDB",
 	HandlerType: (*ANDBServer)(nil),
@@ -541,6 +918,14 @@ var _ANDB_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Sync",
 			Handler:    _ANDB_Sync_Handler,
 		},
+		{
+			MethodName: "Status",
+			Handler:    _ANDB_Status_Handler,
+		},
+		{
+			MethodName: "Scan",
+			Handler:    _ANDB_Scan_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "server.proto",
@@ -2,7 +2,9 @@ package test
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -13,9 +15,13 @@ import (
 )
 
 var (
-	andbClient, andbServer, andbStoreReader string
+	andbClient, andbServer, andbStoreReader, andbRecover, andbMigrate string
 
 	andbServerSession *gexec.Session
+
+	// engineArgs pick the storage engine for every server that launchServer
+	// starts.
+	engineArgs []string
 )
 
 func TestAndb(t *testing.T) {
@@ -33,30 +39,29 @@ var _ = BeforeSuite(func() {
 
 	andbStoreReader, err = gexec.Build("github.com/ankeesler/andb/cmd/andbstorereader")
 	Expect(err).NotTo(HaveOccurred())
+
+	andbRecover, err = gexec.Build("github.com/ankeesler/andb/cmd/andbrecover")
+	Expect(err).NotTo(HaveOccurred())
+
+	andbMigrate, err = gexec.Build("github.com/ankeesler/andb/cmd/andbmigrate")
+	Expect(err).NotTo(HaveOccurred())
 })
 
 var _ = AfterSuite(func() {
 	gexec.CleanupBuildArtifacts()
 })
 
-func startServer(storeDir string) {
-	var err error
-	cmd := exec.Command(
-		andbServer,
-		"-storedir",
-		storeDir,
-		"-port",
-		"9000",
-		"-loglevel",
-		"trace",
-	)
-	andbServerSession, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
-	Expect(err).NotTo(HaveOccurred())
+func startServer(storeDir string, args ...string) {
+	startServerWithEnv(storeDir, nil, args...)
+}
+
+func startServerWithEnv(storeDir string, env []string, args ...string) {
+	launchServer(storeDir, env, args...)
 
 	healthy := false
 	for i := 0; i < 3; i++ {
 		time.Sleep(time.Millisecond * 50)
-		output, err := setWithError("healthcheck", "green")
+		output, err := statusWithError()
 		if err == nil {
 			healthy = true
 			break
@@ -72,13 +77,73 @@ func startServer(storeDir string) {
 	Expect(healthy).To(BeTrue(), "andbserver did not come up within 3 healthchecks!")
 }
 
+// launchServer starts the server without waiting for it to be healthy.
+func launchServer(storeDir string, env []string, args ...string) {
+	var err error
+	cmd := exec.Command(
+		andbServer,
+		append(
+			[]string{
+				"-storedir",
+				storeDir,
+				"-port",
+				"9000",
+				"-loglevel",
+				"trace",
+			},
+			append(append([]string{}, engineArgs...), args...)...,
+		)...,
+	)
+	cmd.Env = append(os.Environ(), env...)
+	andbServerSession, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+	Expect(err).NotTo(HaveOccurred())
+}
+
 func stopServer() {
 	andbServerSession.Kill().Wait(time.Second * 3)
 }
 
-func rebootServer(storeDir string) {
+func rebootServer(storeDir string, args ...string) {
 	stopServer()
-	startServer(storeDir)
+	startServer(storeDir, args...)
+}
+
+// startFollower starts a read-only server on the provided port, over the
+// store dir that the server on port 9000 writes to.
+func startFollower(storeDir, port string, args ...string) *gexec.Session {
+	session, err := gexec.Start(
+		exec.Command(
+			andbServer,
+			append(
+				[]string{
+					"-storedir",
+					storeDir,
+					"-port",
+					port,
+					"-loglevel",
+					"trace",
+					"-readonly",
+				},
+				args...,
+			)...,
+		),
+		GinkgoWriter,
+		GinkgoWriter,
+	)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	EventuallyWithOffset(1, func() error {
+		_, err := clientOn(port, "status")
+		return err
+	}).Should(Succeed())
+
+	return session
+}
+
+// clientOn runs the client against the server on the provided port.
+func clientOn(port string, args ...string) (string, error) {
+	output, err := exec.Command(andbClient, append([]string{"-address", ":" + port}, args...)...).CombinedOutput()
+	return strings.TrimSpace(string(output)), err
 }
 
 func getWithError(key string) (string, error) {
@@ -102,6 +167,21 @@ func set(key, value string) {
 	ExpectWithOffset(1, err).NotTo(HaveOccurred(), output)
 }
 
+func setDurablyWithError(durability, key, value string) (string, error) {
+	output, err := exec.Command(andbClient, "-address", ":9000", "-durability", durability, "set", key, value).CombinedOutput()
+	return string(output), err
+}
+
+func setDurably(durability, key, value string) {
+	output, err := setDurablyWithError(durability, key, value)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), output)
+}
+
+func deleteDurably(durability, key string) {
+	output, err := exec.Command(andbClient, "-address", ":9000", "-durability", durability, "delete", key).CombinedOutput()
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), string(output))
+}
+
 func deleteWithError(key string) (string, error) {
 	output, err := exec.Command(andbClient, "-address", ":9000", "delete", key).CombinedOutput()
 	return string(output), err
@@ -117,8 +197,77 @@ func sync() {
 	ExpectWithOffset(1, err).NotTo(HaveOccurred(), string(output))
 }
 
+func statusWithError() (string, error) {
+	output, err := exec.Command(andbClient, "-address", ":9000", "status").CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+func status() string {
+	output, err := statusWithError()
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), output)
+	return output
+}
+
+func scanWithError(args ...string) (string, error) {
+	output, err := exec.Command(andbClient, append([]string{"-address", ":9000", "scan"}, args...)...).CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+// scan returns the keys (and values) that the scan found, one per line.
+func scan(args ...string) []string {
+	output, err := scanWithError(args...)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), output)
+	if output == "" {
+		return []string{}
+	}
+	return strings.Split(output, "\n")
+}
+
+func syncWithError() (string, error) {
+	output, err := exec.Command(andbClient, "-address", ":9000", "sync").CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+func fileSize(filename string) int64 {
+	info, err := os.Stat(filename)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return info.Size()
+}
+
+// dataSize returns the size of every data segment in the store dir put
+// together.
+func dataSize(storeDir string) int64 {
+	segments, err := filepath.Glob(filepath.Join(storeDir, "andbdata*.bin"))
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	size := int64(0)
+	for _, segment := range segments {
+		size += fileSize(segment)
+	}
+	return size
+}
+
+func appendToFile(filename string, data []byte) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	_, err = file.Write(data)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	ExpectWithOffset(1, file.Close()).To(Succeed())
+}
+
 func printStore(storeDir string) {
 	output, err := exec.Command(andbStoreReader, storeDir).CombinedOutput()
 	ExpectWithOffset(1, err).NotTo(HaveOccurred(), string(output))
 	fmt.Println(string(output))
 }
+
+func recoverStore(storeDir string) {
+	output, err := exec.Command(andbRecover, storeDir).CombinedOutput()
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), string(output))
+}
+
+func migrateStore(storeDir string, args ...string) string {
+	output, err := exec.Command(andbMigrate, append(args, storeDir)...).CombinedOutput()
+	ExpectWithOffset(1, err).NotTo(HaveOccurred(), string(output))
+	return strings.TrimSpace(string(output))
+}
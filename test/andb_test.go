@@ -1,21 +1,73 @@
 package test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	syncpkg "sync"
 	"time"
 
+	"github.com/ankeesler/andb"
+	"github.com/ankeesler/andb/filestore/datastore"
+	"github.com/ankeesler/andb/filestore/lock"
+	"github.com/ankeesler/andb/filestore/manifest"
+	"github.com/ankeesler/andb/filestore/metastore"
+	"github.com/ankeesler/andb/lsmstore"
+	"github.com/ankeesler/andb/memstore"
+	"github.com/ankeesler/andb/wal"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/gexec"
 )
 
 var _ = Describe("ANDB", func() {
+	for _, engine := range []string{andb.EngineFile, andb.EngineLSM, andb.EngineBTree} {
+		engine := engine
+		Context(fmt.Sprintf("with the %s engine", engine), func() {
+			describeANDB(engine)
+		})
+	}
+})
+
+func describeANDB(engine string) {
 	var storeDir string
 
+	// fileEngineOnly skips specs that look at the file engine's files, or at
+	// features that only it has.
+	fileEngineOnly := func() {
+		if engine != andb.EngineFile {
+			Skip("only the file engine does this")
+		}
+	}
+
+	// walEnginesOnly skips specs that look at the wal, which the btree engine
+	// does not have.
+	walEnginesOnly := func() {
+		if engine == andb.EngineBTree {
+			Skip("the btree engine has no wal")
+		}
+	}
+
 	BeforeEach(func() {
+		engineArgs = []string{"-engine", engine}
+		if engine == andb.EngineLSM {
+			// Flush the memtable often, so that specs run against tables
+			// and compaction, not just the memtable.
+			engineArgs = append(engineArgs, "-engine-opt", "memtablebytes=256")
+		}
+		if engine == andb.EngineBTree {
+			// Small pages, so that specs run against a tree of them, not just
+			// one leaf.
+			engineArgs = append(engineArgs, "-engine-opt", "pagebytes=1024")
+		}
+
 		var err error
 		storeDir, err = ioutil.TempDir("", "andb_test")
 		Expect(err).NotTo(HaveOccurred())
@@ -73,52 +125,1171 @@ var _ = Describe("ANDB", func() {
 			set(key, value)
 		}
 
-		for i := 3; i < 7; i++ {
-			key := fmt.Sprintf("key-%d", i)
-			delete(key)
-		}
+		for i := 3; i < 7; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			delete(key)
+		}
+
+		rebootServer(storeDir)
+
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			value := fmt.Sprintf("value-%d", i)
+			Expect(get(key)).To(Equal(value))
+		}
+
+		for i := 3; i < 7; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			output, err := getWithError(key)
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+		}
+
+		for i := 7; i < 10; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			value := fmt.Sprintf("value-%d", i)
+			Expect(get(key)).To(Equal(value))
+		}
+	})
+
+	for _, durability := range []string{"async", "written", "fsynced"} {
+		durability := durability
+		It(fmt.Sprintf("stores %s writes", durability), func() {
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				value := fmt.Sprintf("value-%d", i)
+				setDurably(durability, key, value)
+			}
+
+			for i := 3; i < 7; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				deleteDurably(durability, key)
+			}
+
+			if durability == "async" {
+				sync()
+			}
+			rebootServer(storeDir)
+
+			for i := 0; i < 10; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				if i >= 3 && i < 7 {
+					output, err := getWithError(key)
+					Expect(err).To(HaveOccurred())
+					Expect(output).To(Equal("error: get: not found"))
+				} else {
+					Expect(get(key)).To(Equal(fmt.Sprintf("value-%d", i)))
+				}
+			}
+		})
+	}
+
+	It("makes an fsynced write durable even if the store already holds it", func() {
+		setDurably("async", "key-0", "value-0")
+		setDurably("fsynced", "key-0", "value-0")
+		deleteDurably("fsynced", "key-1")
+
+		rebootServer(storeDir)
+		Expect(get("key-0")).To(Equal("value-0"))
+		output, err := getWithError("key-1")
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(Equal("error: get: not found"))
+	})
+
+	It("only deletes the key asked for, even if another key has the same crc32", func() {
+		// These keys both have a crc32 of 0x4DDB0C25.
+		Expect(crc32.ChecksumIEEE([]byte("plumless"))).To(Equal(crc32.ChecksumIEEE([]byte("buckeroo"))))
+
+		set("plumless", "value-0")
+		set("buckeroo", "value-1")
+		delete("plumless")
+
+		expectOnlyPlumlessToBeDeleted := func() {
+			output, err := getWithError("plumless")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+			Expect(get("buckeroo")).To(Equal("value-1"))
+		}
+		expectOnlyPlumlessToBeDeleted()
+
+		rebootServer(storeDir)
+		expectOnlyPlumlessToBeDeleted()
+
+		// The rest is about the file engine's compaction.
+		if engine != andb.EngineFile {
+			return
+		}
+		rebootServer(storeDir, "-compactinterval", "10ms")
+		set("buckeroo", "value-1")
+		Eventually(func() int64 {
+			return fileSize(filepath.Join(storeDir, "andbdata.bin"))
+		}).Should(Equal(int64(datastore.RecordHeaderSize + len("buckeroo") + len("value-1"))))
+		expectOnlyPlumlessToBeDeleted()
+
+		rebootServer(storeDir)
+		expectOnlyPlumlessToBeDeleted()
+	})
+
+	It("stores stuff past 4 GiB into the data file", func() {
+		fileEngineOnly()
+
+		// The data file is not rolled over into segments before 8 GiB.
+		rebootServer(storeDir, "-segmentbytes", fmt.Sprint(8<<30))
+		set("key-0", "value-0")
+		sync()
+		stopServer()
+
+		// The server only finds out where the data file ends when it opens
+		// it, and then throws away anything past the last record in the meta
+		// file, so the record past 4 GiB is written here.
+		dataFilename := filepath.Join(storeDir, "andbdata.bin")
+		Expect(os.Truncate(dataFilename, 5<<30)).To(Succeed())
+		data, err := datastore.Open(dataFilename, datastore.ReadWrite)
+		Expect(err).NotTo(HaveOccurred())
+		defer data.Close()
+		meta, err := metastore.Open(filepath.Join(storeDir, "andbmeta.bin"), metastore.ReadWrite)
+		Expect(err).NotTo(HaveOccurred())
+		defer meta.Close()
+		data.SetSegmentSize(8 << 30)
+		data.WriteKeyValue(
+			datastore.OpSet,
+			1000,
+			"key-1",
+			"value-1",
+			func(key, value string, keyOffset, valueOffset uint64) {
+				Expect(keyOffset).To(BeNumerically(">", 5<<30))
+				_, err = meta.Write(key, value, keyOffset, valueOffset)
+			},
+			func(err0 error) { err = err0 },
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data.Sync()).To(Succeed())
+		Expect(meta.Sync()).To(Succeed())
+
+		startServer(storeDir, "-segmentbytes", fmt.Sprint(8<<30))
+		Expect(get("key-0")).To(Equal("value-0"))
+		Expect(get("key-1")).To(Equal("value-1"))
+		Expect(fileSize(dataFilename)).To(BeNumerically(">", 5<<30))
+	})
+
+	It("rolls the data file over into segments, each with a hint file once it is closed", func() {
+		fileEngineOnly()
+
+		rebootServer(storeDir, "-segmentbytes", "256")
+		for i := 0; i < 20; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		delete("key-0")
+		sync()
+
+		segments, err := filepath.Glob(filepath.Join(storeDir, "andbdata.*.bin"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(segments)).To(BeNumerically(">=", 2))
+		hints, err := filepath.Glob(filepath.Join(storeDir, "andbdata*.hint"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hints).To(HaveLen(len(segments)))
+		Expect(fileSize(filepath.Join(storeDir, "andbdata.bin"))).To(BeNumerically("<", 512))
+
+		expectValues := func(format string) {
+			output, err := getWithError("key-0")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+			for i := 1; i < 20; i++ {
+				Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf(format, i)))
+			}
+		}
+		rebootServer(storeDir, "-segmentbytes", "256")
+		expectValues("value-%d")
+
+		// The meta file can be rebuilt from the hint files.
+		stopServer()
+		Expect(os.Remove(filepath.Join(storeDir, "andbmeta.bin"))).To(Succeed())
+		Expect(os.Remove(filepath.Join(storeDir, "andbwal.log"))).To(Succeed())
+		recoverStore(storeDir)
+		startServer(storeDir, "-segmentbytes", "256")
+		expectValues("value-%d")
+
+		// Compaction rewrites the old segments one at a time, and removes the
+		// ones with nothing left in them.
+		rebootServer(storeDir, "-segmentbytes", "256", "-compactinterval", "10ms")
+		for j := 0; j < 2; j++ {
+			for i := 1; i < 20; i++ {
+				set(fmt.Sprintf("key-%d", i), fmt.Sprintf("VALUE-%d", i))
+			}
+		}
+		Eventually(func() []string {
+			left := []string{}
+			for _, segment := range segments {
+				if _, err := os.Stat(segment); err == nil {
+					left = append(left, segment)
+				}
+			}
+			return left
+		}).Should(BeEmpty())
+		Expect(fileSize(filepath.Join(storeDir, "andbdata.bin"))).To(BeZero())
+		expectValues("VALUE-%d")
+
+		rebootServer(storeDir, "-segmentbytes", "256")
+		expectValues("VALUE-%d")
+		Expect(status()).To(Equal("ok"))
+	})
+
+	It("writes hint files for segments that were active across a reboot", func() {
+		fileEngineOnly()
+
+		rebootServer(storeDir, "-segmentbytes", "256")
+		for i := 0; i < 3; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		sync() // so that the wal does not write them again
+		rebootServer(storeDir, "-segmentbytes", "256")
+		for i := 3; i < 10; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		sync()
+
+		hints, err := filepath.Glob(filepath.Join(storeDir, "andbdata*.hint"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hints).To(ContainElement(filepath.Join(storeDir, "andbdata.hint")))
+
+		stopServer()
+		Expect(os.Remove(filepath.Join(storeDir, "andbmeta.bin"))).To(Succeed())
+		Expect(os.Remove(filepath.Join(storeDir, "andbwal.log"))).To(Succeed())
+		recoverStore(storeDir)
+		startServer(storeDir, "-segmentbytes", "256")
+		for i := 0; i < 10; i++ {
+			Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+	})
+
+	It("flushes writes to sorted tables, and merges them down into levels", func() {
+		if engine != andb.EngineLSM {
+			Skip("only the lsm engine does this")
+		}
+
+		for j := 0; j < 3; j++ {
+			for i := 0; i < 100; i++ {
+				set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d-%d", i, j))
+			}
+		}
+		for i := 0; i < 100; i += 10 {
+			delete(fmt.Sprintf("key-%03d", i))
+		}
+
+		expectValues := func() {
+			for i := 0; i < 100; i++ {
+				key := fmt.Sprintf("key-%03d", i)
+				if i%10 == 0 {
+					output, err := getWithError(key)
+					Expect(err).To(HaveOccurred())
+					Expect(output).To(Equal("error: get: not found"))
+				} else {
+					Expect(get(key)).To(Equal(fmt.Sprintf("value-%d-2", i)))
+				}
+			}
+		}
+		expectValues()
+
+		levels := struct {
+			Levels [][]string `json:"levels"`
+		}{}
+		Eventually(func() int {
+			data, err := ioutil.ReadFile(filepath.Join(storeDir, "lsmlevels.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(data, &levels)).To(Succeed())
+			if len(levels.Levels) < 2 {
+				return 0
+			}
+			return len(levels.Levels[1])
+		}).Should(BeNumerically(">", 0))
+
+		// Every table on disk is listed in a level, and level 0 does not
+		// keep growing.
+		tables, err := filepath.Glob(filepath.Join(storeDir, "*.sst"))
+		Expect(err).NotTo(HaveOccurred())
+		listed := 0
+		for _, level := range levels.Levels {
+			listed += len(level)
+		}
+		Expect(tables).To(HaveLen(listed))
+		Expect(len(levels.Levels[0])).To(BeNumerically("<", 4))
+
+		rebootServer(storeDir)
+		expectValues()
+		Expect(status()).To(Equal("ok"))
+	})
+
+	It("flushes a memtable again if the store died while flushing it", func() {
+		if engine != andb.EngineLSM {
+			Skip("only the lsm engine does this")
+		}
+
+		for i := 0; i < 3; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		sync()
+		stopServer()
+
+		// This is what the store dir looks like once a full memtable has been
+		// swapped out for a new one, but before it is in a table.
+		flushingWALFilename := filepath.Join(storeDir, lsmstore.FlushingWALFile)
+		Expect(os.Rename(filepath.Join(storeDir, lsmstore.WALFile), flushingWALFilename)).To(Succeed())
+
+		startServer(storeDir)
+		for i := 0; i < 3; i++ {
+			Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+		Eventually(func() bool {
+			_, err := os.Stat(flushingWALFilename)
+			return os.IsNotExist(err)
+		}).Should(BeTrue())
+
+		rebootServer(storeDir)
+		for i := 0; i < 3; i++ {
+			Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+		Expect(status()).To(Equal("ok"))
+	})
+
+	It("scans keys in order", func() {
+		if engine == andb.EngineFile {
+			output, err := scanWithError("a")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: scan: store cannot scan keys in order"))
+			return
+		}
+
+		// Out of order, so that the scan has to sort them.
+		for j := 0; j < 50; j++ {
+			i := j * 7 % 50
+			set(fmt.Sprintf("key-%02d", i), fmt.Sprintf("value-%d", i))
+		}
+		for i := 0; i < 50; i += 5 {
+			delete(fmt.Sprintf("key-%02d", i))
+		}
+		set("key-07", "value-7-again")
+
+		expectScans := func() {
+			entries := []string{}
+			for i := 0; i < 50; i++ {
+				switch {
+				case i%5 == 0:
+				case i == 7:
+					entries = append(entries, "key-07 value-7-again")
+				default:
+					entries = append(entries, fmt.Sprintf("key-%02d value-%d", i, i))
+				}
+			}
+			Expect(scan("")).To(Equal(entries))
+			Expect(scan("key-06", "key-12")).To(Equal([]string{
+				"key-06 value-6",
+				"key-07 value-7-again",
+				"key-08 value-8",
+				"key-09 value-9",
+				"key-11 value-11",
+			}))
+			Expect(scan("key-455")).To(Equal([]string{
+				"key-46 value-46",
+				"key-47 value-47",
+				"key-48 value-48",
+				"key-49 value-49",
+			}))
+			Expect(scan("key-5")).To(BeEmpty())
+
+			output, err := exec.Command(andbClient, "-address", ":9000", "-limit", "2", "scan", "key-2").CombinedOutput()
+			Expect(err).NotTo(HaveOccurred(), string(output))
+			Expect(string(output)).To(Equal("key-21 value-21\nkey-22 value-22\n"))
+		}
+		expectScans()
+
+		rebootServer(storeDir)
+		expectScans()
+	})
+
+	It("scans more keys than fit in one response", func() {
+		if engine == andb.EngineFile {
+			Skip("the file engine cannot scan")
+		}
+
+		// 6 MiB in all, well over gRPC's 4 MiB message limit.
+		value := strings.Repeat("v", 64*1024)
+		for i := 0; i < 96; i++ {
+			set(fmt.Sprintf("key-%02d", i), value)
+		}
+
+		entries := scan("")
+		Expect(entries).To(HaveLen(96))
+		for i, entry := range entries {
+			Expect(entry).To(Equal(fmt.Sprintf("key-%02d %s", i, value)))
+		}
+
+		output, err := exec.Command(andbClient, "-address", ":9000", "-limit", "40", "scan", "key-10").CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(output))
+		entries = strings.Split(strings.TrimSpace(string(output)), "\n")
+		Expect(entries).To(HaveLen(40))
+		Expect(entries[0]).To(HavePrefix("key-10 "))
+		Expect(entries[39]).To(HavePrefix("key-49 "))
+	})
+
+	It("keeps its tree in pages, and reuses the ones that it frees", func() {
+		if engine != andb.EngineBTree {
+			Skip("only the btree engine does this")
+		}
+
+		filename := filepath.Join(storeDir, "andbbtree.db")
+		writeAll := func(j int) {
+			for i := 0; i < 100; i++ {
+				set(fmt.Sprintf("key-%03d", i), fmt.Sprintf("value-%d-%d", i, j))
+			}
+		}
+		writeAll(0)
+		size := fileSize(filename)
+		Expect(size).To(BeNumerically(">", 4*1024))
+		for j := 1; j < 4; j++ {
+			writeAll(j)
+		}
+		for i := 0; i < 100; i += 10 {
+			delete(fmt.Sprintf("key-%03d", i))
+		}
+		Expect(fileSize(filename)).To(BeNumerically("<", 2*size))
+
+		rebootServer(storeDir)
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key-%03d", i)
+			if i%10 == 0 {
+				output, err := getWithError(key)
+				Expect(err).To(HaveOccurred())
+				Expect(output).To(Equal("error: get: not found"))
+			} else {
+				Expect(get(key)).To(Equal(fmt.Sprintf("value-%d-3", i)))
+			}
+		}
+		Expect(status()).To(Equal("ok"))
+	})
+
+	It("keeps the last commit when it is killed before the next one's meta is written", func() {
+		if engine != andb.EngineBTree {
+			Skip("only the btree engine does this")
+		}
+
+		set("key-0", "value-0")
+		set("key-1", "value-1")
+
+		stopServer()
+		startServerWithEnv(storeDir, []string{"ANDB_FAILPOINTS=btree-before-meta"})
+		_, err := setWithError("key-0", "value-0-lost")
+		Expect(err).To(HaveOccurred())
+		Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+
+		startServer(storeDir)
+		Expect(get("key-0")).To(Equal("value-0"))
+		Expect(get("key-1")).To(Equal("value-1"))
+		set("key-2", "value-2")
+		Expect(get("key-2")).To(Equal("value-2"))
+		Expect(status()).To(Equal("ok"))
+	})
+
+	Context("when the store was written in an older format", func() {
+		var metaFilename, dataFilename string
+		var metaBytes, dataBytes []byte
+
+		BeforeEach(func() {
+			fileEngineOnly()
+
+			metaFilename = filepath.Join(storeDir, "andbmeta.bin")
+			dataFilename = filepath.Join(storeDir, "andbdata.bin")
+			stopServer()
+
+			// BlockVersion2 blocks, with 32-bit offsets and no record headers.
+			type blockV2 struct {
+				Version                              uint32
+				KeyOffset, KeyLength, KeyCRC32       uint32
+				ValueOffset, ValueLength, ValueCRC32 uint32
+				Kind                                 metastore.BlockKind
+				CRC32                                uint32
+			}
+			data, meta := bytes.NewBuffer([]byte{}), bytes.NewBuffer([]byte{})
+			write := func(kind metastore.BlockKind, key, value string) {
+				b := blockV2{
+					Version:     metastore.BlockVersion2,
+					KeyOffset:   uint32(data.Len()),
+					KeyLength:   uint32(len(key)),
+					KeyCRC32:    crc32.ChecksumIEEE([]byte(key)),
+					ValueOffset: uint32(data.Len() + len(key)),
+					ValueLength: uint32(len(value)),
+					ValueCRC32:  crc32.ChecksumIEEE([]byte(value)),
+					Kind:        kind,
+				}
+				if kind == metastore.BlockKindDelete {
+					b.ValueOffset, b.ValueCRC32 = 0, 0
+				}
+				data.WriteString(key + value)
+
+				buf := bytes.NewBuffer([]byte{})
+				Expect(binary.Write(buf, binary.BigEndian, &b)).To(Succeed())
+				b.CRC32 = crc32.ChecksumIEEE(buf.Bytes())
+				Expect(binary.Write(meta, binary.BigEndian, &b)).To(Succeed())
+			}
+			write(metastore.BlockKindSet, "key-0", "value-0")
+			write(metastore.BlockKindSet, "key-1", "value-1")
+			write(metastore.BlockKindSet, "key-0", "value-0-new")
+			write(metastore.BlockKindDelete, "key-1", "")
+
+			metaBytes, dataBytes = meta.Bytes(), data.Bytes()
+			Expect(ioutil.WriteFile(metaFilename, metaBytes, 0600)).To(Succeed())
+			Expect(ioutil.WriteFile(dataFilename, dataBytes, 0600)).To(Succeed())
+		})
+
+		expectOldStore := func() {
+			Expect(get("key-0")).To(Equal("value-0-new"))
+			output, err := getWithError("key-1")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+		}
+
+		It("reads it as it is", func() {
+			startServer(storeDir)
+			expectOldStore()
+
+			set("key-2", "value-2")
+			rebootServer(storeDir)
+			expectOldStore()
+			Expect(get("key-2")).To(Equal("value-2"))
+		})
+
+		It("migrates it to the current format, and can roll back", func() {
+			Expect(migrateStore(storeDir)).To(ContainSubstring("migrated 4 block(s)"))
+			Expect(migrateStore(storeDir, "-rollback")).To(Equal("rolled back"))
+			Expect(ioutil.ReadFile(metaFilename)).To(Equal(metaBytes))
+			Expect(ioutil.ReadFile(dataFilename)).To(Equal(dataBytes))
+
+			Expect(migrateStore(storeDir)).To(ContainSubstring("migrated 4 block(s)"))
+			Expect(os.Remove(metaFilename + ".bak")).To(Succeed())
+			Expect(os.Remove(dataFilename + ".bak")).To(Succeed())
+			Expect(migrateStore(storeDir)).To(Equal("already up to date"))
+
+			migratedMetaBytes, err := ioutil.ReadFile(metaFilename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binary.BigEndian.Uint32(migratedMetaBytes)).To(Equal(uint32(metastore.BlockVersion)))
+
+			startServer(storeDir)
+			expectOldStore()
+		})
+	})
+
+	Context("the manifest", func() {
+		var manifestFilename string
+
+		BeforeEach(func() {
+			fileEngineOnly()
+
+			manifestFilename = filepath.Join(storeDir, manifest.Filename)
+		})
+
+		readManifest := func() manifest.Manifest {
+			data, err := ioutil.ReadFile(manifestFilename)
+			Expect(err).NotTo(HaveOccurred())
+
+			m := manifest.Manifest{}
+			Expect(json.Unmarshal(data, &m)).To(Succeed())
+			return m
+		}
+
+		It("describes the store", func() {
+			m := readManifest()
+			Expect(m.FormatVersion).To(Equal(manifest.FormatVersion))
+			Expect(m.StoreID).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+			Expect(m.DataFile).To(Equal("andbdata.bin"))
+			Expect(m.MetaFile).To(Equal("andbmeta.bin"))
+			Expect(m.WALFile).To(Equal("andbwal.log"))
+			Expect(m.SegmentFiles).To(BeEmpty())
+
+			set("key-0", "value-0")
+			sync()
+			rebootServer(storeDir)
+
+			checkpointed := readManifest()
+			Expect(checkpointed.StoreID).To(Equal(m.StoreID))
+			Expect(checkpointed.CreatedAt).To(Equal(m.CreatedAt))
+			Expect(checkpointed.LastCheckpoint).To(BeTemporally(">", m.CreatedAt))
+			Expect(get("key-0")).To(Equal("value-0"))
+
+			// Checkpoints with nothing in the wal leave the manifest alone.
+			before, err := os.Stat(manifestFilename)
+			Expect(err).NotTo(HaveOccurred())
+			sync()
+			rebootServer(storeDir)
+			after, err := os.Stat(manifestFilename)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after.ModTime()).To(Equal(before.ModTime()))
+			Expect(readManifest()).To(Equal(checkpointed))
+
+			set("key-1", "value-1")
+			sync()
+			Expect(readManifest().LastCheckpoint).To(BeTemporally(">", checkpointed.LastCheckpoint))
+		})
+
+		It("lists the data file's segments and hint files", func() {
+			expectSegmentFiles := func() {
+				filenames := []string{}
+				for _, pattern := range []string{"andbdata.*.bin", "andbdata*.hint"} {
+					matches, err := filepath.Glob(filepath.Join(storeDir, pattern))
+					Expect(err).NotTo(HaveOccurred())
+					for _, match := range matches {
+						filenames = append(filenames, filepath.Base(match))
+					}
+				}
+				Expect(filenames).NotTo(BeEmpty())
+				Expect(readManifest().SegmentFiles).To(ConsistOf(filenames))
+			}
+
+			rebootServer(storeDir, "-segmentbytes", "256")
+			for i := 0; i < 20; i++ {
+				set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			}
+			sync()
+			expectSegmentFiles()
+
+			// Compaction removes segments once nothing is left in them.
+			Expect(readManifest().SegmentFiles).To(ContainElement("andbdata.000001.bin"))
+			rebootServer(storeDir, "-segmentbytes", "256", "-compactinterval", "10ms")
+			for i := 0; i < 20; i++ {
+				delete(fmt.Sprintf("key-%d", i))
+			}
+			Eventually(func() []string {
+				return readManifest().SegmentFiles
+			}).ShouldNot(ContainElement("andbdata.000001.bin"))
+
+			// The server is killed, maybe in the middle of a compaction, so
+			// the list is only sure to be up to date once it is opened again.
+			rebootServer(storeDir, "-segmentbytes", "256")
+			sync()
+			expectSegmentFiles()
+		})
+
+		It("upgrades a store in an older format that it understands", func() {
+			set("key-0", "value-0")
+			stopServer()
+
+			m := readManifest()
+			m.FormatVersion = 1
+			data, err := json.Marshal(&m)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(manifestFilename, data, 0600)).To(Succeed())
+
+			startServer(storeDir)
+			Expect(readManifest().FormatVersion).To(Equal(manifest.FormatVersion))
+			Expect(get("key-0")).To(Equal("value-0"))
+		})
+
+		It("refuses to open a store in a format it does not understand", func() {
+			stopServer()
+
+			m := readManifest()
+			m.FormatVersion = manifest.FormatVersion + 1
+			data, err := json.Marshal(&m)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ioutil.WriteFile(manifestFilename, data, 0600)).To(Succeed())
+
+			launchServer(storeDir, nil)
+			Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+			Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring("unsupported store format version"))
+		})
+	})
+
+	It("keeps other processes out of its store dir while it is running", func() {
+		fileEngineOnly()
+
+		pid := andbServerSession.Command.Process.Pid
+		Expect(ioutil.ReadFile(filepath.Join(storeDir, lock.Filename))).To(Equal([]byte(fmt.Sprintf("%d\n", pid))))
+		locked := fmt.Sprintf("is locked by another process (pid %d)", pid)
+
+		otherServer, err := gexec.Start(
+			exec.Command(andbServer, "-storedir", storeDir, "-port", "9001"),
+			GinkgoWriter,
+			GinkgoWriter,
+		)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(otherServer, time.Second*3).Should(gexec.Exit())
+		Expect(string(otherServer.Err.Contents())).To(ContainSubstring(locked))
+
+		for _, tool := range []string{andbRecover, andbStoreReader} {
+			output, err := exec.Command(tool, storeDir).CombinedOutput()
+			Expect(err).To(HaveOccurred())
+			Expect(string(output)).To(ContainSubstring(locked))
+		}
+
+		set("key-0", "value-0")
+		stopServer()
+		printStore(storeDir)
+
+		startServer(storeDir)
+		Expect(get("key-0")).To(Equal("value-0"))
+	})
+
+	It("never creates or changes files when inspecting a store", func() {
+		fileEngineOnly()
+
+		emptyDir, err := ioutil.TempDir("", "andb_test")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(emptyDir)
+
+		output, err := exec.Command(andbStoreReader, emptyDir).CombinedOutput()
+		Expect(err).To(HaveOccurred())
+		Expect(string(output)).To(ContainSubstring("no such file or directory"))
+		Expect(ioutil.ReadDir(emptyDir)).To(BeEmpty())
+
+		readStoreDir := func() map[string][]byte {
+			files := map[string][]byte{}
+			infos, err := ioutil.ReadDir(storeDir)
+			Expect(err).NotTo(HaveOccurred())
+			for _, info := range infos {
+				files[info.Name()], err = ioutil.ReadFile(filepath.Join(storeDir, info.Name()))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			return files
+		}
+
+		set("key-0", "value-0")
+		stopServer()
+		before := readStoreDir()
+
+		output, err = exec.Command(andbStoreReader, storeDir).CombinedOutput()
+		Expect(err).NotTo(HaveOccurred(), string(output))
+		Expect(string(output)).To(ContainSubstring(`"key-0" => "value-0"`))
+		Expect(readStoreDir()).To(Equal(before))
+
+		startServer(storeDir)
+	})
+
+	It("replays writes left in the wal", func() {
+		walEnginesOnly()
+
+		set("key-0", "value-0")
+		set("key-1", "value-1")
+		stopServer()
+
+		walFilename := "andbwal.log"
+		if engine == andb.EngineLSM {
+			walFilename = lsmstore.WALFile
+		}
+		walFile, err := os.OpenFile(filepath.Join(storeDir, walFilename), os.O_RDWR, 0600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wal.New(walFile).Append([]wal.Record{
+			{Op: wal.OpSet, Key: "key-0", Value: "value-0-replayed"},
+			{Op: wal.OpDelete, Key: "key-1"},
+			{Op: wal.OpSet, Key: "key-2", Value: "value-2"},
+		})).To(Succeed())
+		Expect(walFile.Close()).To(Succeed())
+
+		startServer(storeDir)
+
+		Expect(get("key-0")).To(Equal("value-0-replayed"))
+		output, err := getWithError("key-1")
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(Equal("error: get: not found"))
+		Expect(get("key-2")).To(Equal("value-2"))
+
+		rebootServer(storeDir)
+
+		Expect(get("key-0")).To(Equal("value-0-replayed"))
+		Expect(get("key-2")).To(Equal("value-2"))
+	})
+
+	It("leaves the wal alone when the store cannot be loaded", func() {
+		fileEngineOnly()
+
+		// Only the first block is corrupted, since a bad block at the end of
+		// the meta file is thrown away as torn.
+		for i := 0; i < 3; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		stopServer()
+
+		walFilename := filepath.Join(storeDir, "andbwal.log")
+		walFile, err := os.OpenFile(walFilename, os.O_RDWR, 0600)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(wal.New(walFile).Append([]wal.Record{
+			{Op: wal.OpSet, Key: "key-3", Value: "value-3"},
+		})).To(Succeed())
+		Expect(walFile.Close()).To(Succeed())
+		walSize := fileSize(walFilename)
+
+		metaFilename := filepath.Join(storeDir, "andbmeta.bin")
+		metaBytes, err := ioutil.ReadFile(metaFilename)
+		Expect(err).NotTo(HaveOccurred())
+		corrupted := append([]byte{}, metaBytes...)
+		corrupted[0] = 0xFF
+		Expect(ioutil.WriteFile(metaFilename, corrupted, 0600)).To(Succeed())
+
+		startServer(storeDir, "-compactinterval", "10ms")
+		Expect(status()).To(HavePrefix("degraded: load store:"))
+		_, err = syncWithError()
+		Expect(err).To(HaveOccurred())
+		Consistently(func() int64 {
+			return fileSize(walFilename)
+		}, "200ms").Should(Equal(walSize))
+
+		stopServer()
+		Expect(ioutil.WriteFile(metaFilename, metaBytes, 0600)).To(Succeed())
+		startServer(storeDir)
+
+		Expect(status()).To(Equal("ok"))
+		for i := 0; i < 4; i++ {
+			Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+	})
+
+	for _, args := range [][]string{
+		{"-indexonly"},
+		{"-cachebytes", "32"},
+		{"-indexonly", "-cachebytes", "32"},
+		{"-indexonly", "-cachebytes", "-1"},
+	} {
+		args := args
+		Context(fmt.Sprintf("when run with %s", strings.Join(args, " ")), func() {
+			BeforeEach(func() {
+				fileEngineOnly()
+
+				rebootServer(storeDir, args...)
+			})
+
+			It("reads values from disk on demand", func() {
+				for i := 0; i < 10; i++ {
+					key := fmt.Sprintf("key-%d", i)
+					value := fmt.Sprintf("value-%d", i)
+					set(key, value)
+				}
+
+				for i := 3; i < 7; i++ {
+					key := fmt.Sprintf("key-%d", i)
+					delete(key)
+				}
+
+				for j := 0; j < 2; j++ {
+					for i := 0; i < 10; i++ {
+						key := fmt.Sprintf("key-%d", i)
+						if i >= 3 && i < 7 {
+							output, err := getWithError(key)
+							Expect(err).To(HaveOccurred())
+							Expect(output).To(Equal("error: get: not found"))
+						} else {
+							Expect(get(key)).To(Equal(fmt.Sprintf("value-%d", i)))
+						}
+					}
+
+					rebootServer(storeDir, args...)
+				}
+			})
+		})
+	}
+
+	It("bounds its cache by default in index-only mode", func() {
+		fileEngineOnly()
+
+		rebootServer(storeDir, "-indexonly")
+		Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring(fmt.Sprintf("cache bytes: %d", andb.DefaultCacheBytes)))
+
+		rebootServer(storeDir, "-indexonly", "-cachebytes", "-1")
+		Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring("cache bytes: unbounded"))
+	})
+
+	Context("when a write fails", func() {
+		BeforeEach(func() {
+			walEnginesOnly()
+
+			stopServer()
+			startServerWithEnv(storeDir, []string{"ANDB_FAILPOINTS=wal-append"})
+
+			_, err := setWithError("key", "value")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("returns 'not found' from get", func() {
+			output, err := getWithError("key")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+
+			rebootServer(storeDir)
+
+			output, err = getWithError("key")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+		})
+
+		It("goes read-only until the failure is dealt with", func() {
+			fileEngineOnly()
+
+			Expect(status()).To(HavePrefix("degraded: append to wal: failpoint wal-append"))
+
+			output, err := setWithError("another-key", "value")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("store is degraded"))
+
+			output, err = syncWithError()
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("set key => value: append to wal: failpoint wal-append"))
+
+			rebootServer(storeDir)
+
+			Expect(status()).To(HavePrefix("degraded: 1 failed write(s) recorded in"))
+			_, err = setWithError("another-key", "value")
+			Expect(err).To(HaveOccurred())
+
+			Expect(os.Remove(filepath.Join(storeDir, "andbfailures.log"))).To(Succeed())
+			rebootServer(storeDir)
+
+			Expect(status()).To(Equal("ok"))
+			set("another-key", "value")
+			Expect(get("another-key")).To(Equal("value"))
+		})
+
+		It("reports asynchronous write failures from sync", func() {
+			fileEngineOnly()
+
+			rebootServer(storeDir)
+			Expect(os.Remove(filepath.Join(storeDir, "andbfailures.log"))).To(Succeed())
+			stopServer()
+			startServerWithEnv(storeDir, []string{"ANDB_FAILPOINTS=wal-append"})
+
+			setDurably("async", "async-key", "value")
+
+			output, err := syncWithError()
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("set async-key => value: append to wal: failpoint wal-append"))
+
+			output, err = getWithError("async-key")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+		})
+	})
+
+	for _, failure := range []struct{ failpoint, durability, err string }{
+		{"apply", "written", "apply: failpoint apply"},
+		{"wal-sync", "fsynced", "sync wal: failpoint wal-sync"},
+	} {
+		failure := failure
+		Context(fmt.Sprintf("when a write fails after it is in the wal (%s)", failure.failpoint), func() {
+			It("does not replay it", func() {
+				fileEngineOnly()
+
+				// The wal is checkpointed first, so that nothing is replayed
+				// through the failpoint.
+				set("key-0", "value-0")
+				sync()
+				stopServer()
+				startServerWithEnv(storeDir, []string{"ANDB_FAILPOINTS=" + failure.failpoint})
+
+				output, err := setDurablyWithError(failure.durability, "key-0", "value-1")
+				Expect(err).To(HaveOccurred())
+				Expect(output).To(ContainSubstring(failure.err))
+				Expect(get("key-0")).To(Equal("value-0"))
+
+				rebootServer(storeDir)
+
+				Expect(status()).To(HavePrefix("degraded: 1 failed write(s) recorded in"))
+				Expect(get("key-0")).To(Equal("value-0"))
+			})
+		})
+	}
+
+	Context("when the server crashes", func() {
+		var metaFilename, dataFilename string
+
+		BeforeEach(func() {
+			metaFilename = filepath.Join(storeDir, "andbmeta.bin")
+			dataFilename = filepath.Join(storeDir, "andbdata.bin")
+
+			for i := 0; i < 3; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				value := fmt.Sprintf("value-%d", i)
+				set(key, value)
+			}
+			sync()
+		})
+
+		expectStoreToBeIntact := func() {
+			for i := 0; i < 3; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				value := fmt.Sprintf("value-%d", i)
+				Expect(get(key)).To(Equal(value))
+			}
+
+			set("key-3", "value-3")
+			rebootServer(storeDir)
+			Expect(get("key-3")).To(Equal("value-3"))
+			Expect(status()).To(Equal("ok"))
+		}
+
+		It("rebuilds a lost meta file from the data file", func() {
+			fileEngineOnly()
+
+			set("key-4", "value-4")
+			delete("key-4")
+			sync()
+			stopServer()
+
+			Expect(os.Remove(metaFilename)).To(Succeed())
+			Expect(os.Remove(filepath.Join(storeDir, "andbwal.log"))).To(Succeed())
+			recoverStore(storeDir)
+
+			startServer(storeDir)
+			output, err := getWithError("key-4")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+
+			expectStoreToBeIntact()
+		})
+
+		It("recovers from a torn block at the end of the meta file", func() {
+			fileEngineOnly()
+
+			stopServer()
+			size := fileSize(metaFilename)
+			appendToFile(metaFilename, []byte{0x01, 0x02, 0x03, 0x05, 0xAA, 0xBB})
+
+			startServer(storeDir)
+			Expect(fileSize(metaFilename)).To(Equal(size))
+
+			expectStoreToBeIntact()
+		})
+
+		It("recovers from a block at the end of the meta file whose data never made it", func() {
+			fileEngineOnly()
+
+			stopServer()
+			size := fileSize(metaFilename)
+
+			metaFile, err := os.OpenFile(metaFilename, os.O_RDWR, 0600)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = metastore.New(metaFile).Write("key-4", "value-4", 1000, 1005)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metaFile.Close()).To(Succeed())
+
+			startServer(storeDir)
+			Expect(fileSize(metaFilename)).To(Equal(size))
+			output, err := getWithError("key-4")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+
+			expectStoreToBeIntact()
+		})
+
+		It("recovers from a torn write at the end of the data file", func() {
+			fileEngineOnly()
+
+			stopServer()
+			size := fileSize(dataFilename)
+			appendToFile(dataFilename, []byte("key-4val"))
+
+			startServer(storeDir)
+			Expect(fileSize(dataFilename)).To(Equal(size))
+
+			expectStoreToBeIntact()
+		})
+
+		for _, fp := range []string{
+			"compact-before-commit",
+			"compact-after-commit",
+			"compact-after-data-rename",
+			"compact-after-meta-rename",
+		} {
+			fp := fp
+			It(fmt.Sprintf("recovers from being killed during compaction (%s)", fp), func() {
+				fileEngineOnly()
+
+				stopServer()
+				startServerWithEnv(
+					storeDir,
+					[]string{"ANDB_FAILPOINTS=" + fp},
+					"-compactinterval", "50ms",
+				)
+
+				for i := 0; i < 3; i++ {
+					key := fmt.Sprintf("key-%d", i)
+					value := fmt.Sprintf("value-%d", i)
+					set(key, value)
+				}
+				Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+
+				startServer(storeDir)
 
-		rebootServer(storeDir)
+				leftovers, err := filepath.Glob(filepath.Join(storeDir, "andbcompact*"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(leftovers).To(BeEmpty())
+				leftovers, err = filepath.Glob(filepath.Join(storeDir, "*.compact"))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(leftovers).To(BeEmpty())
 
-		for i := 0; i < 3; i++ {
-			key := fmt.Sprintf("key-%d", i)
-			value := fmt.Sprintf("value-%d", i)
-			Expect(get(key)).To(Equal(value))
+				expectStoreToBeIntact()
+			})
 		}
 
-		for i := 3; i < 7; i++ {
-			key := fmt.Sprintf("key-%d", i)
-			output, err := getWithError(key)
-			Expect(err).To(HaveOccurred())
-			Expect(output).To(Equal("error: get: not found"))
-		}
+		It("finishes an interrupted compaction before rebuilding the meta file", func() {
+			fileEngineOnly()
 
-		for i := 7; i < 10; i++ {
-			key := fmt.Sprintf("key-%d", i)
-			value := fmt.Sprintf("value-%d", i)
-			Expect(get(key)).To(Equal(value))
-		}
-	})
+			stopServer()
+			startServerWithEnv(
+				storeDir,
+				[]string{"ANDB_FAILPOINTS=compact-after-commit"},
+				"-compactinterval", "50ms",
+			)
+			for i := 0; i < 3; i++ {
+				set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			}
+			Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
 
-	XContext("when a write fails", func() {
-		BeforeEach(func() {
-			// TODO: this doesn't work! The go stdlib keeps writing stuff!
-			Expect(os.RemoveAll(filepath.Join(storeDir, "andbdata.bin"))).To(Succeed())
+			recoverStore(storeDir)
 
-			_, err := setWithError("key", "value")
-			Expect(err).To(HaveOccurred())
+			leftovers, err := filepath.Glob(filepath.Join(storeDir, "*.compact"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(leftovers).To(BeEmpty())
+
+			startServer(storeDir)
+			expectStoreToBeIntact()
 		})
 
-		It("returns 'not found' from get", func() {
-			output, err := getWithError("key")
-			Expect(err).To(HaveOccurred())
-			Expect(output).To(Equal("error: get: not found"))
+		It("keeps every acknowledged write across a kill -9", func() {
+			acked := make(chan string, 10000)
+			stop := make(chan struct{})
+			wg := syncpkg.WaitGroup{}
+			for w := 0; w < 4; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer GinkgoRecover()
+					defer wg.Done()
 
-			rebootServer(storeDir)
+					for i := 0; ; i++ {
+						select {
+						case <-stop:
+							return
+						default:
+						}
 
-			output, err = getWithError("key")
-			Expect(err).To(HaveOccurred())
-			Expect(output).To(Equal("error: get: not found"))
+						key := fmt.Sprintf("crash-key-%d-%d", w, i)
+						if _, err := setWithError(key, "value-"+key); err == nil {
+							acked <- key
+						}
+					}
+				}(w)
+			}
+
+			time.Sleep(time.Millisecond * 500)
+			stopServer()
+			close(stop)
+			wg.Wait()
+			close(acked)
+
+			startServer(storeDir)
+
+			count := 0
+			for key := range acked {
+				Expect(get(key)).To(Equal("value-" + key))
+				count++
+			}
+			Expect(count).To(BeNumerically(">", 0))
+
+			expectStoreToBeIntact()
 		})
 	})
 
@@ -128,6 +1299,8 @@ var _ = Describe("ANDB", func() {
 		)
 
 		BeforeEach(func() {
+			fileEngineOnly()
+
 			for i := 0; i < 3; i++ {
 				key := fmt.Sprintf("key-%d", i)
 				value := fmt.Sprintf("value-%d", i)
@@ -150,6 +1323,14 @@ var _ = Describe("ANDB", func() {
 			output, err := getWithError("key-0")
 			Expect(err).To(HaveOccurred())
 			Expect(output).To(ContainSubstring("error: get: load store: for each block: block handler: incorrect"))
+
+			Expect(status()).To(HavePrefix("degraded: load store: for each block: block handler: incorrect"))
+			output, err = setWithError("key-3", "value-3")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("error: set: load store:"))
+			output, err = syncWithError()
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("error: sync: load store:"))
 		})
 
 		It("gracefully handles a block version being wrong", func() {
@@ -161,31 +1342,113 @@ var _ = Describe("ANDB", func() {
 		})
 
 		It("gracefully handles a key length being wrong", func() {
-			metaBytes[8] = 0xFF
+			metaBytes[12] = 0xFF
 		})
 
 		It("gracefully handles a key crc32 being wrong", func() {
-			metaBytes[12] = 0xFF
+			metaBytes[16] = 0xFF
 		})
 
-		It("gracefully handles a key being wrong", func() {
+		It("gracefully handles a record header being wrong", func() {
 			dataBytes[0] = 0xFF
 		})
 
+		It("gracefully handles a key being wrong", func() {
+			dataBytes[datastore.RecordHeaderSize] = 0xFF
+		})
+
 		It("gracefully handles a value offset being wrong", func() {
-			metaBytes[16] = 0xFF
+			metaBytes[20] = 0xFF
 		})
 
 		It("gracefully handles a value length being wrong", func() {
-			metaBytes[20] = 0xFF
+			metaBytes[28] = 0xFF
 		})
 
 		It("gracefully handles a value crc32 being wrong", func() {
-			metaBytes[24] = 0xFF
+			metaBytes[32] = 0xFF
 		})
 
 		It("gracefully handles a value being wrong", func() {
-			dataBytes[5] = 0xFF
+			dataBytes[datastore.RecordHeaderSize+5] = 0xFF
+		})
+	})
+
+	Context("when the btree file is corrupted", func() {
+		var filename string
+
+		BeforeEach(func() {
+			if engine != andb.EngineBTree {
+				Skip("only the btree engine does this")
+			}
+
+			filename = filepath.Join(storeDir, "andbbtree.db")
+			for i := 0; i < 3; i++ {
+				key := fmt.Sprintf("key-%d", i)
+				value := fmt.Sprintf("value-%d", i)
+				set(key, value)
+			}
+			stopServer()
+		})
+
+		corrupt := func(offsets ...int64) {
+			data, err := ioutil.ReadFile(filename)
+			Expect(err).NotTo(HaveOccurred())
+			for _, offset := range offsets {
+				data[offset] ^= 0xFF
+			}
+			Expect(ioutil.WriteFile(filename, data, 0600)).To(Succeed())
+		}
+
+		// Every page after the meta page, since any of them could be the
+		// leaf that the last commit wrote.
+		everyPage := func(offset int64) []int64 {
+			offsets := []int64{}
+			for page := int64(1024); page < fileSize(filename); page += 1024 {
+				offsets = append(offsets, page+offset)
+			}
+			return offsets
+		}
+
+		It("gracefully handles a page header being wrong", func() {
+			corrupt(everyPage(4)...)
+
+			startServer(storeDir)
+			output, err := getWithError("key-0")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("error: get: incorrect page type"))
+		})
+
+		It("gracefully handles a page's entries being wrong", func() {
+			corrupt(everyPage(20)...)
+
+			startServer(storeDir)
+			output, err := getWithError("key-0")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("error: get: incorrect crc32"))
+		})
+
+		It("falls back to the commit before when the last meta is wrong", func() {
+			// The third commit went to slot 1.
+			corrupt(512 + 8)
+
+			startServer(storeDir)
+			Expect(get("key-0")).To(Equal("value-0"))
+			Expect(get("key-1")).To(Equal("value-1"))
+			output, err := getWithError("key-2")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+		})
+
+		It("refuses to start when both metas are wrong", func() {
+			corrupt(8, 512+8)
+
+			launchServer(storeDir, nil)
+			Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+			Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring("no valid meta page"))
+
+			corrupt(8, 512+8)
+			startServer(storeDir)
 		})
 	})
 
@@ -221,10 +1484,145 @@ var _ = Describe("ANDB", func() {
 		wg.Wait()
 	})
 
-	XIt("can run multiple services on top of one backing store", func() {
+	It("can run multiple services on top of one backing store", func() {
+		fileEngineOnly()
+
+		rebootServer(storeDir, "-compactinterval", "10ms")
+		for i := 0; i < 5; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+
+		followers := []string{"9001", "9002"}
+		for i, port := range followers {
+			args := []string{}
+			if i%2 == 1 {
+				args = append(args, "-indexonly")
+			}
+			follower := startFollower(storeDir, port, args...)
+			defer func() {
+				follower.Kill().Wait(time.Second * 3)
+			}()
+		}
+
+		expectFollowersToSee := func(key, value string) {
+			for _, port := range followers {
+				Eventually(func() string {
+					output, _ := clientOn(port, "get", key)
+					return output
+				}).Should(Equal(value), "follower on port %s", port)
+			}
+		}
+		for i := 0; i < 5; i++ {
+			expectFollowersToSee(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+
+		set("key-0", "value-0-new")
+		delete("key-1")
+		set("key-5", "value-5")
+		expectFollowersToSee("key-0", "value-0-new")
+		expectFollowersToSee("key-1", "error: get: not found")
+		expectFollowersToSee("key-5", "value-5")
+
+		for _, port := range followers {
+			output, err := clientOn(port, "set", "key-6", "value-6")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("store is read-only"))
+
+			output, err = clientOn(port, "delete", "key-0")
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(ContainSubstring("store is read-only"))
+		}
+
+		// Overwriting a key over and over again makes the writer compact the
+		// files out from under the followers.
+		for i := 0; i < 10; i++ {
+			set("key-2", fmt.Sprintf("value-2-%d", i))
+		}
+		Eventually(func() int64 {
+			return dataSize(storeDir)
+		}).Should(BeNumerically("<", 10*(datastore.RecordHeaderSize+len("key-2value-2-0"))))
+		set("key-7", "value-7")
+
+		expectFollowersToSee("key-0", "value-0-new")
+		expectFollowersToSee("key-1", "error: get: not found")
+		expectFollowersToSee("key-2", "value-2-9")
+		expectFollowersToSee("key-7", "value-7")
+
+		rebootServer(storeDir)
+		set("key-8", "value-8")
+		expectFollowersToSee("key-8", "value-8")
+	})
+
+	It("keeps following a store that it could not load at first", func() {
+		fileEngineOnly()
+
+		for i := 0; i < 3; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		sync()
+		stopServer()
+
+		metaFilename := filepath.Join(storeDir, "andbmeta.bin")
+		metaBytes, err := ioutil.ReadFile(metaFilename)
+		Expect(err).NotTo(HaveOccurred())
+		corrupted := append([]byte{}, metaBytes...)
+		corrupted[0] = 0xFF
+		Expect(ioutil.WriteFile(metaFilename, corrupted, 0600)).To(Succeed())
+
+		follower := startFollower(storeDir, "9001")
+		defer func() {
+			follower.Kill().Wait(time.Second * 3)
+		}()
+		Expect(clientOn("9001", "status")).To(HavePrefix("degraded: load store:"))
+
+		Expect(ioutil.WriteFile(metaFilename, metaBytes, 0600)).To(Succeed())
+		Eventually(func() string {
+			output, _ := clientOn("9001", "status")
+			return output
+		}).Should(Equal("ok"))
+		for i := 0; i < 3; i++ {
+			Expect(clientOn("9001", "get", fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+
+		startServer(storeDir)
 	})
 
-	XIt("defragments the data storage file over time", func() {
+	It("defragments the data storage file over time", func() {
+		fileEngineOnly()
+
+		rebootServer(storeDir, "-compactinterval", "100ms")
+
+		written := 0
+		for i := 0; i < 10; i++ {
+			for j := 0; j < 5; j++ {
+				key := fmt.Sprintf("key-%d", i)
+				value := fmt.Sprintf("value-%d-%d", i, j)
+				set(key, value)
+				written += datastore.RecordHeaderSize + len(key) + len(value)
+			}
+		}
+
+		for i := 3; i < 7; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			delete(key)
+		}
+
+		Eventually(func() int64 {
+			return dataSize(storeDir)
+		}, time.Second*5).Should(BeNumerically("<", written/2))
+
+		rebootServer(storeDir)
+
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key-%d", i)
+			if i >= 3 && i < 7 {
+				output, err := getWithError(key)
+				Expect(err).To(HaveOccurred())
+				Expect(output).To(Equal("error: get: not found"))
+			} else {
+				Expect(get(key)).To(Equal(fmt.Sprintf("value-%d-4", i)))
+			}
+		}
 	})
 
 	Context("performance", func() {
@@ -257,6 +1655,31 @@ var _ = Describe("ANDB", func() {
 			Expect(reads).To(BeNumerically("<", time.Second*20))
 		}, 2)
 
+		Measure("concurrent reads", func(b Benchmarker) {
+			for i := 0; i < 100; i++ {
+				set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+			}
+
+			reads := b.Time("reads", func() {
+				wg := syncpkg.WaitGroup{}
+				for w := 0; w < 8; w++ {
+					wg.Add(1)
+					go func(w int) {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						for i := w; i < 1000; i += 8 {
+							key := fmt.Sprintf("key-%d", i%100)
+							value := fmt.Sprintf("value-%d", i%100)
+							Expect(get(key)).To(Equal(value))
+						}
+					}(w)
+				}
+				wg.Wait()
+			})
+			Expect(reads).To(BeNumerically("<", time.Second*20))
+		}, 2)
+
 		XMeasure("random, non-overlapping writes", func(b Benchmarker) {
 			for i := 0; i < 1000; i++ {
 				key := fmt.Sprintf("key-%d", i)
@@ -281,7 +1704,7 @@ var _ = Describe("ANDB", func() {
 			}
 		}, 2)
 
-		XMeasure("sequential deletes", func(b Benchmarker) {
+		Measure("sequential deletes", func(b Benchmarker) {
 			for i := 0; i < 1000; i++ {
 				key := fmt.Sprintf("key-%d", i)
 				value := fmt.Sprintf("value-%d", i)
@@ -292,10 +1715,243 @@ var _ = Describe("ANDB", func() {
 				}
 			}
 
-			for i := 0; i < 1000; i++ {
-				key := fmt.Sprintf("key-%d", i)
-				delete(key)
-			}
+			deletes := b.Time("deletes", func() {
+				for i := 0; i < 1000; i++ {
+					key := fmt.Sprintf("key-%d", i)
+					delete(key)
+
+					if i%100 == 0 {
+						fmt.Printf("deleted %d values\n", i)
+					}
+				}
+			})
+			Expect(deletes).To(BeNumerically("<", time.Second*20))
 		}, 2)
 	})
+}
+
+var _ = Describe("the engine registry", func() {
+	var storeDir string
+
+	BeforeEach(func() {
+		var err error
+		storeDir, err = ioutil.TempDir("", "andb_test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		engineArgs = nil
+		stopServer()
+		Expect(os.RemoveAll(storeDir)).To(Succeed())
+	})
+
+	It("runs the memory engine, which keeps nothing in the store dir", func() {
+		engineArgs = []string{"-engine", andb.EngineMemory}
+		startServer(storeDir)
+
+		set("key-0", "value-0")
+		set("key-1", "value-1")
+		delete("key-1")
+		sync()
+		Expect(get("key-0")).To(Equal("value-0"))
+		output, err := getWithError("key-1")
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(Equal("error: get: not found"))
+		Expect(status()).To(Equal("ok"))
+
+		rebootServer(storeDir)
+		output, err = getWithError("key-0")
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(Equal("error: get: not found"))
+		Expect(ioutil.ReadDir(storeDir)).To(BeEmpty())
+	})
+
+	It("snapshots the memory engine to the store dir on sync and on shutdown", func() {
+		engineArgs = []string{"-engine", andb.EngineMemory, "-engine-opt", "snapshot=true"}
+		startServer(storeDir)
+
+		set("key-0", "value-0")
+		set("key-1", "value-1")
+		sync()
+		Expect(filepath.Join(storeDir, "andbsnapshot.log")).To(BeAnExistingFile())
+
+		// A kill -9 loses whatever was written after the last sync, unless it
+		// was fsynced.
+		set("key-2", "value-2")
+		setDurably("fsynced", "key-3", "value-3")
+		set("key-4", "value-4")
+		stopServer()
+		startServer(storeDir)
+		Expect(get("key-0")).To(Equal("value-0"))
+		Expect(get("key-1")).To(Equal("value-1"))
+		Expect(get("key-3")).To(Equal("value-3"))
+		for _, key := range []string{"key-2", "key-4"} {
+			output, err := getWithError(key)
+			Expect(err).To(HaveOccurred())
+			Expect(output).To(Equal("error: get: not found"))
+		}
+
+		// Shutting down snapshots everything.
+		delete("key-0")
+		set("key-4", "value-4")
+		Eventually(andbServerSession.Terminate(), time.Second*3).Should(gexec.Exit())
+		startServer(storeDir)
+		output, err := getWithError("key-0")
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(Equal("error: get: not found"))
+		Expect(get("key-4")).To(Equal("value-4"))
+	})
+
+	It("appends fsynced writes to the memory engine's snapshot instead of rewriting it", func() {
+		engineArgs = []string{"-engine", andb.EngineMemory, "-engine-opt", "snapshot=true"}
+		startServer(storeDir)
+
+		snapshot := filepath.Join(storeDir, "andbsnapshot.log")
+		for i := 0; i < 50; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		sync()
+		before, err := os.Stat(snapshot)
+		Expect(err).NotTo(HaveOccurred())
+
+		setDurably("fsynced", "key-50", "value-50")
+		deleteDurably("fsynced", "key-0")
+		after, err := os.Stat(snapshot)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.SameFile(before, after)).To(BeTrue())
+		Expect(after.Size()).To(BeNumerically(">", before.Size()))
+
+		stopServer()
+		startServer(storeDir)
+		Expect(get("key-50")).To(Equal("value-50"))
+		output, err := getWithError("key-0")
+		Expect(err).To(HaveOccurred())
+		Expect(output).To(Equal("error: get: not found"))
+		for i := 1; i < 50; i++ {
+			Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+
+		// A sync rewrites the snapshot with just the latest value of each key.
+		sync()
+		after, err = os.Stat(snapshot)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.SameFile(before, after)).To(BeFalse())
+		Expect(after.Size()).To(BeNumerically("<", before.Size()+wal.RecordSize(wal.Record{Key: "key-50", Value: "value-50"})))
+	})
+
+	for _, engines := range [][]string{
+		{andb.EngineLSM, andb.EngineFile, "holds an lsm engine store"},
+		{andb.EngineBTree, andb.EngineFile, "holds a btree engine store"},
+		{andb.EngineMemory, andb.EngineFile, "holds a memory engine snapshot"},
+		{andb.EngineFile, andb.EngineLSM, "holds a file engine store"},
+		{andb.EngineFile, andb.EngineBTree, "holds a file engine store"},
+	} {
+		writer, opener, refusal := engines[0], engines[1], engines[2]
+		It(fmt.Sprintf("refuses to open a store dir that the %s engine wrote with the %s engine", writer, opener), func() {
+			filenames := func() []string {
+				infos, err := ioutil.ReadDir(storeDir)
+				Expect(err).NotTo(HaveOccurred())
+				names := []string{}
+				for _, info := range infos {
+					names = append(names, info.Name())
+				}
+				return names
+			}
+
+			engineArgs = []string{"-engine", writer}
+			if writer == andb.EngineMemory {
+				engineArgs = append(engineArgs, "-engine-opt", "snapshot=true")
+			}
+			startServer(storeDir)
+			set("key-0", "value-0")
+			sync()
+			stopServer()
+			before := filenames()
+
+			engineArgs = []string{"-engine", opener}
+			launchServer(storeDir, nil)
+			Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+			Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring(refusal))
+			Expect(filenames()).To(Equal(before))
+		})
+	}
+
+	for _, engine := range []string{andb.EngineMemory, andb.EngineLSM, andb.EngineBTree} {
+		engine := engine
+		for _, flag := range [][]string{
+			{"-compactinterval", "10ms"},
+			{"-indexonly"},
+			{"-cachebytes", "32"},
+			{"-segmentbytes", "256"},
+		} {
+			flag := flag
+			It(fmt.Sprintf("refuses to start the %s engine with %s, which only the file engine takes", engine, flag[0]), func() {
+				engineArgs = append([]string{"-engine", engine}, flag...)
+				launchServer(storeDir, nil)
+				Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+				Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring(
+					fmt.Sprintf("the %s engine does not take the file engine's %s option", engine, flag[0][1:]),
+				))
+			})
+		}
+	}
+
+	It("takes the file engine's options as engine options", func() {
+		engineArgs = []string{
+			"-engine", andb.EngineFile,
+			"-engine-opt", "file.segmentbytes=256",
+			"-engine-opt", "indexonly=true",
+		}
+		startServer(storeDir)
+		for i := 0; i < 10; i++ {
+			set(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		}
+		sync()
+		Expect(filepath.Join(storeDir, "andbdata.000001.bin")).To(BeAnExistingFile())
+		for i := 0; i < 10; i++ {
+			Expect(get(fmt.Sprintf("key-%d", i))).To(Equal(fmt.Sprintf("value-%d", i)))
+		}
+	})
+
+	It("refuses to start with an engine that is not registered", func() {
+		engineArgs = []string{"-engine", "tape"}
+		launchServer(storeDir, nil)
+		Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+		Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring(`unknown engine "tape"`))
+	})
+
+	It("refuses to start with an option that the engine does not understand", func() {
+		engineArgs = []string{"-engine", andb.EngineLSM, "-engine-opt", "pagebytes=1024"}
+		launchServer(storeDir, nil)
+		Eventually(andbServerSession, time.Second*3).Should(gexec.Exit())
+		Expect(string(andbServerSession.Err.Contents())).To(ContainSubstring(`unknown engine option "pagebytes"`))
+	})
+})
+
+var _ = Describe("the LRU cache", func() {
+	It("caches entries up to a shard's share of its bytes, and counts the ones that are too big", func() {
+		lru := memstore.NewLRU(64 << 20)
+		Expect(lru.MaxEntryBytes()).To(Equal(int64(2 << 20)))
+
+		value := strings.Repeat("v", int(lru.MaxEntryBytes())-len("key-0"))
+		Expect(lru.Set("key-0", value)).To(Succeed())
+		Expect(lru.Get("key-0")).To(Equal(value))
+
+		Expect(lru.Set("key-1", value+"v")).To(Succeed())
+		_, err := lru.Get("key-1")
+		Expect(err).To(HaveOccurred())
+
+		stats := lru.Stats()
+		Expect(stats.Entries).To(Equal(1))
+		Expect(stats.TooBig).To(Equal(uint64(1)))
+	})
+
+	It("gives small caches a single shard, so that they can hold entries as big as the whole cache", func() {
+		lru := memstore.NewLRU(32)
+		Expect(lru.MaxEntryBytes()).To(Equal(int64(32)))
+
+		value := strings.Repeat("v", 32-len("key-0"))
+		Expect(lru.Set("key-0", value)).To(Succeed())
+		Expect(lru.Get("key-0")).To(Equal(value))
+	})
 })
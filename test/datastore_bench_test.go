@@ -0,0 +1,90 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ankeesler/andb/filestore/datastore"
+)
+
+// BenchmarkParallelReadData reads values out of a datastore from every
+// benchmark goroutine while another goroutine keeps appending to it. Run it
+// on its own with:
+//
+//	go test ./test -run '^$' -bench ParallelReadData -cpu 1,4,8
+func BenchmarkParallelReadData(b *testing.B) {
+	const (
+		recordCount = 10000
+		valueLength = 128
+	)
+
+	dir, err := ioutil.TempDir("", "andb-datastore-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := datastore.Open(filepath.Join(dir, "andbdata.bin"), datastore.ReadWrite)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+
+	value := string(make([]byte, valueLength))
+	write := func(i int) (uint64, error) {
+		var address uint64
+		var writeErr error
+		d.WriteKeyValue(
+			datastore.OpSet,
+			uint64(i),
+			fmt.Sprintf("key-%d", i),
+			value,
+			func(_, _ string, _, valueOffset uint64) { address = valueOffset },
+			func(err error) { writeErr = err },
+		)
+		return address, writeErr
+	}
+
+	addresses := make([]uint64, recordCount)
+	for i := range addresses {
+		if addresses[i], err = write(i); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	stopC, doneC := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(doneC)
+		for i := recordCount; ; i++ {
+			select {
+			case <-stopC:
+				return
+			default:
+			}
+			if _, err := write(i); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stopC)
+		<-doneC
+	}()
+
+	b.SetBytes(valueLength)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := d.ReadData(addresses[r.Intn(recordCount)], valueLength); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/ankeesler/andb/filestore"
+	"github.com/ankeesler/andb/memstore"
+	api "github.com/ankeesler/andb/server"
+)
+
+// BenchmarkFilestoreGet gets random keys out of a store, first from a single
+// goroutine, and then from every benchmark goroutine at once, both with
+// every value cached and with only the index in memory in front of a small
+// cache. Parallel gets should take less time per get than the single
+// goroutine does, as long as there are cores to run them on. Run it on its
+// own with:
+//
+//	go test ./test -run '^$' -bench FilestoreGet -cpu 1,4,8
+func BenchmarkFilestoreGet(b *testing.B) {
+	const (
+		keyCount    = 10000
+		valueLength = 128
+	)
+
+	for _, c := range []struct {
+		name  string
+		cache func() filestore.Cache
+		mode  filestore.Mode
+	}{
+		{"cached", func() filestore.Cache { return memstore.New() }, filestore.ModeFull},
+		{"index-only", func() filestore.Cache { return memstore.NewLRU(keyCount * valueLength / 4) }, filestore.ModeIndexOnly},
+	} {
+		b.Run(c.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "andb-filestore-bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			fs, closeStore, err := filestore.Open(dir, filestore.Options{Cache: c.cache(), Mode: c.mode})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer closeStore()
+
+			value := string(make([]byte, valueLength))
+			keys := make([]string, keyCount)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key-%d", i)
+				if err := fs.Set(keys[i], value, api.Durability_ASYNC); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := fs.Sync(); err != nil {
+				b.Fatal(err)
+			}
+
+			b.Run("1-goroutine", func(b *testing.B) {
+				r := rand.New(rand.NewSource(rand.Int63()))
+				b.SetBytes(valueLength)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := fs.Get(keys[r.Intn(keyCount)]); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			b.Run("parallel", func(b *testing.B) {
+				b.SetBytes(valueLength)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					r := rand.New(rand.NewSource(rand.Int63()))
+					for pb.Next() {
+						if _, err := fs.Get(keys[r.Intn(keyCount)]); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				})
+			})
+		})
+	}
+}
@@ -0,0 +1,241 @@
+// Package wal is the log of set and delete records that the storage engines
+// write ahead of their other files.
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/ankeesler/andb/failpoint"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+type Op uint8
+
+const (
+	OpSet Op = iota
+	OpDelete
+)
+
+type Record struct {
+	Op         Op
+	Key, Value string
+}
+
+// header precedes every record's key and value in the log. Its CRC32 covers
+// the rest of the header, the key, and the value.
+type header struct {
+	CRC32       uint32
+	Op          Op
+	KeyLength   uint32
+	ValueLength uint32
+}
+
+var byteOrder = binary.BigEndian
+
+// WAL is a log of records that a store appends to before it applies them,
+// e.g., until they have been checkpointed to the file engine's data and meta
+// files.
+type WAL struct {
+	file  *os.File
+	mutex *sync.Mutex
+}
+
+func New(file *os.File) *WAL {
+	return &WAL{
+		file:  file,
+		mutex: &sync.Mutex{},
+	}
+}
+
+// Append writes all of the provided records to the end of the log with a
+// single write.
+func (w *WAL) Append(records []Record) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := failpoint.Error("wal-append"); err != nil {
+		return err
+	}
+
+	buf := bytes.NewBuffer([]byte{})
+	for _, r := range records {
+		if err := encode(buf, r); err != nil {
+			return errors.Wrap(err, "encode record")
+		}
+	}
+
+	if _, err := w.file.Seek(0, 2); err != nil {
+		return errors.Wrap(err, "seek to end")
+	}
+
+	if _, err := w.file.Write(buf.Bytes()); err != nil {
+		return errors.Wrap(err, "write records")
+	}
+
+	return nil
+}
+
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := failpoint.Error("wal-sync"); err != nil {
+		return err
+	}
+
+	return w.file.Sync()
+}
+
+func (w *WAL) Size() (int64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return 0, errors.Wrap(err, "stat")
+	}
+
+	return info.Size(), nil
+}
+
+// Truncate throws away every record in the log, e.g., once they have all
+// been checkpointed.
+func (w *WAL) Truncate() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "truncate")
+	}
+
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return errors.Wrap(err, "seek to start")
+	}
+
+	return w.file.Sync()
+}
+
+// Rewind throws away everything in the log past the provided size, e.g., the
+// records from a batch that was never acknowledged, and makes that durable.
+func (w *WAL) Rewind(size int64) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.file.Truncate(size); err != nil {
+		return errors.Wrap(err, "truncate")
+	}
+
+	return w.file.Sync()
+}
+
+// RecordSize returns the number of bytes that the provided record takes up
+// in the log.
+func RecordSize(r Record) int64 {
+	return int64(binary.Size(&header{})) + int64(len(r.Key)) + int64(len(r.Value))
+}
+
+// ForEachRecord calls the provided handler with each record in the log, in
+// order. A torn or corrupt record ends the log; it, and anything after it,
+// was never acknowledged.
+func (w *WAL) ForEachRecord(recordHandler func(r Record) error) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "stat")
+	}
+
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return errors.Wrap(err, "seek to start")
+	}
+
+	i := 0
+	for {
+		offset, err := w.file.Seek(0, 1)
+		if err != nil {
+			return errors.Wrap(err, "seek")
+		}
+
+		r, err := decode(w.file, info.Size()-offset)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warnf("ignoring the rest of the wal after record %d: %s", i, err.Error())
+			break
+		}
+
+		log.Tracef("handle record %d (%s)", i, r.Key)
+		i++
+
+		if err := recordHandler(r); err != nil {
+			return errors.Wrap(err, "record handler")
+		}
+	}
+
+	return nil
+}
+
+func encode(w io.Writer, r Record) error {
+	h := header{
+		Op:          r.Op,
+		KeyLength:   uint32(len(r.Key)),
+		ValueLength: uint32(len(r.Value)),
+	}
+	h.CRC32 = h.calculateCRC32(r.Key, r.Value)
+
+	if err := binary.Write(w, byteOrder, &h); err != nil {
+		return errors.Wrap(err, "write header")
+	}
+
+	if _, err := io.WriteString(w, r.Key); err != nil {
+		return errors.Wrap(err, "write key")
+	}
+
+	if _, err := io.WriteString(w, r.Value); err != nil {
+		return errors.Wrap(err, "write value")
+	}
+
+	return nil
+}
+
+// decode reads a record that must fit in the remaining bytes of the log.
+func decode(r io.Reader, remaining int64) (Record, error) {
+	h := header{}
+	if err := binary.Read(r, byteOrder, &h); err != nil {
+		return Record{}, err
+	}
+
+	if int64(binary.Size(&h))+int64(h.KeyLength)+int64(h.ValueLength) > remaining {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+
+	data := make([]byte, int(h.KeyLength)+int(h.ValueLength))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return Record{}, errors.Wrap(err, "read key/value")
+	}
+
+	key, value := string(data[:h.KeyLength]), string(data[h.KeyLength:])
+	if crc := h.calculateCRC32(key, value); crc != h.CRC32 {
+		return Record{}, errors.Errorf("incorrect crc32 (0x%08X != 0x%08X)", h.CRC32, crc)
+	}
+
+	return Record{Op: h.Op, Key: key, Value: value}, nil
+}
+
+func (h header) calculateCRC32(key, value string) uint32 {
+	h.CRC32 = 0
+
+	buf := bytes.NewBuffer([]byte{})
+	binary.Write(buf, byteOrder, &h)
+	buf.WriteString(key)
+	buf.WriteString(value)
+
+	return crc32.ChecksumIEEE(buf.Bytes())
+}